@@ -181,6 +181,19 @@ func (v *ForExpr) String() string {
 	return "tbd"
 }
 
+// A loop over the values of an iterable, `for x in expr { ... }`. The values
+// are assigned to Var, which is an identifier or a list of them to destructure
+type ForInExpr struct {
+	Var      Expr
+	Iterable Expr
+	Then     Expr
+	lexer.Area
+}
+
+func (v *ForInExpr) String() string {
+	return fmt.Sprintf("ForIn(%s, %s, %s)", v.Var, v.Iterable, v.Then)
+}
+
 type Nop struct {
 	lexer.Area
 }
@@ -258,6 +271,7 @@ type FuncDefExpr struct {
 	Ident      *Ident     // might be nil
 	ClassParam *ParamExpr // might be nil
 	Params     []*ParamExpr
+	ReturnType *Ident // might be nil
 	Body       *BlockExpr
 	lexer.Area
 }
@@ -276,6 +290,18 @@ func (v *TypeDefExpr) String() string {
 	return "type"
 }
 
+// effect Log(msg: Str) -> Nil
+type EffectDefExpr struct {
+	Ident      *Ident
+	Params     []*ParamExpr
+	ReturnType *Ident // might be nil
+	lexer.Area
+}
+
+func (v *EffectDefExpr) String() string {
+	return "effect"
+}
+
 type ListExpr struct {
 	Elems []Expr
 	lexer.Area
@@ -347,8 +373,10 @@ func (v *PatternExpr) String() string {
 }
 
 type TryExpr struct {
-	TryBlock    *BlockExpr
-	HandleBlock []*HandleCaseExpr
+	TryBlock     *BlockExpr
+	HandleBlock  []*HandleCaseExpr
+	ReturnCase   *HandleCaseExpr // might be nil
+	FinallyBlock *BlockExpr      // might be nil
 	lexer.Area
 }
 
@@ -375,6 +403,28 @@ func (v *ReturnExpr) String() string {
 	return "tbd"
 }
 
+// Exit the innermost loop, which evaluates to Value or () if it's not set
+type BreakExpr struct {
+	Value Expr // optional
+	lexer.Area
+}
+
+func (v *BreakExpr) String() string {
+	if v.Value == nil {
+		return "Break()"
+	}
+	return fmt.Sprintf("Break(%s)", v.Value)
+}
+
+// Skip to the next iteration of the innermost loop
+type ContinueExpr struct {
+	lexer.Area
+}
+
+func (v *ContinueExpr) String() string {
+	return "Continue()"
+}
+
 type ResumeExpr struct {
 	Ident *Ident
 	Value Expr // optional
@@ -0,0 +1,79 @@
+package ast
+
+// The direct subexpressions of expr, in the order they appear in the source
+func Children(expr Expr) []Expr {
+	children := []Expr{}
+	add := func(exprs ...Expr) {
+		for _, e := range exprs {
+			if e != nil {
+				children = append(children, e)
+			}
+		}
+	}
+	switch v := expr.(type) {
+	case *BlockExpr:
+		add(v.Children...)
+	case *CallExpr:
+		add(v.Lhs)
+		add(v.Args...)
+	case *AttrExpr:
+		add(v.Lhs)
+	case *SubscrExpr:
+		add(v.Lhs)
+		add(v.Sub...)
+	case *PipeExpr:
+		add(v.Left, v.Right)
+	case *CaptureExpr:
+		add(v.Ident, v.Right)
+	case *AssignExpr:
+		add(v.Left, v.Right)
+	case *IfExpr:
+		for _, part := range v.ElifParts {
+			add(part.Cond, part.Then)
+		}
+		add(v.Else)
+	case *ForExpr:
+		add(v.Cond, v.Then)
+	case *ForInExpr:
+		add(v.Var, v.Iterable, v.Then)
+	case *ParenthExpr:
+		add(v.Inside)
+	case *OpExpr:
+		add(v.Left, v.Right)
+	case *UnaryExpr:
+		add(v.Right)
+	case *FuncDefExpr:
+		add(v.Body)
+	case *ListExpr:
+		add(v.Elems...)
+	case *MapExpr:
+		for _, entry := range v.Elems {
+			add(entry.Val)
+		}
+	case *MatchExpr:
+		add(v.Expr)
+		for _, c := range v.Cases {
+			add(c.Left, c.Then)
+		}
+	case *TryExpr:
+		add(v.TryBlock)
+		for _, handler := range v.HandleBlock {
+			add(handler.Then)
+		}
+		if v.ReturnCase != nil {
+			add(v.ReturnCase.Then)
+		}
+		if v.FinallyBlock != nil {
+			add(v.FinallyBlock)
+		}
+	case *DoExpr:
+		add(v.Arguments...)
+	case *ReturnExpr:
+		add(v.Value)
+	case *BreakExpr:
+		add(v.Value)
+	case *ResumeExpr:
+		add(v.Ident, v.Value)
+	}
+	return children
+}
@@ -1,24 +1,60 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 
 	"github.com/rymdhund/wosh/ast"
 	"github.com/rymdhund/wosh/eval"
 	"github.com/rymdhund/wosh/interpret"
-	"github.com/rymdhund/wosh/lexer"
 	"github.com/rymdhund/wosh/parser"
+	"github.com/rymdhund/wosh/sandbox"
 )
 
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Printf("Usage: %s <filename> [filenames...]\n", os.Args[0])
+	noTypeChecks := flag.Bool("no-type-checks", false, "don't check parameter type annotations at runtime")
+	sandboxed := flag.Bool("sandbox", false, "only allow the file access, commands and environment variables given by the flags below")
+	allowRead := flag.String("allow-read", "", "comma separated paths that can be read with -sandbox")
+	denyRead := flag.String("deny-read", "", "comma separated paths inside the -allow-read paths that can't be read")
+	allowWrite := flag.String("allow-write", "", "comma separated paths that can be written with -sandbox")
+	denyWrite := flag.String("deny-write", "", "comma separated paths inside the -allow-write paths that can't be written")
+	allowCommands := flag.String("allow-commands", "", "comma separated commands that can be run with -sandbox, requires -allow-network")
+	allowEnv := flag.String("allow-env", "", "comma separated environment variables that can be read with -sandbox")
+	allowNetwork := flag.Bool("allow-network", false, "allow network access with -sandbox")
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		fmt.Printf("Usage: %s [flags] <filename> [filenames...]\n", os.Args[0])
+		flag.PrintDefaults()
 		os.Exit(1)
 	}
+	options := interpret.DefaultCompileOptions
+	options.TypeChecks = !*noTypeChecks
+
+	vm := interpret.NewVm()
+	vm.HandleDefaultEffects(os.Stdin, os.Stderr)
+	options.HostEffects = vm.HostEffects()
+	if *sandboxed {
+		policy := &sandbox.Policy{
+			Read:     sandbox.Paths{Allow: splitList(*allowRead), Deny: splitList(*denyRead)},
+			Write:    sandbox.Paths{Allow: splitList(*allowWrite), Deny: splitList(*denyWrite)},
+			Commands: splitList(*allowCommands),
+			Env:      splitList(*allowEnv),
+			Network:  *allowNetwork,
+		}
+		if err := policy.Validate(); err != nil {
+			fmt.Printf("%s, use -allow-network with -allow-commands\n", err)
+			os.Exit(1)
+		}
+		vm.SetSandbox(policy)
+	}
+	// The files are joined into one program, keeping the file of each
+	// expression for the tracebacks
 	total := ast.BlockExpr{}
-	for _, filename := range os.Args[1:] {
+	for _, filename := range flag.Args() {
 		content, err := ioutil.ReadFile(filename)
 		if err != nil {
 			fmt.Println(err)
@@ -33,32 +69,52 @@ func main() {
 		if len(imports) > 0 {
 			panic("Imports not implemented")
 		}
+		source := interpret.NewSource(filename, string(content))
 		total.Children = append(total.Children, block.Children...)
+		for range block.Children {
+			options.ExprSources = append(options.ExprSources, source)
+		}
+	}
+	options.Warn = func(w *interpret.Warning) {
+		if w.Source != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", w.Source.Name, w)
+		} else {
+			fmt.Fprintln(os.Stderr, w)
+		}
 	}
-	// runEval(block)
-	runCompiled(&total)
+
+	// runEval(&total)
+	v := runCompiled(vm, &total, options)
+	fmt.Println("Exited with", v.String())
 }
 
-func runCompiled(block *ast.BlockExpr) {
-	main := &ast.FuncDefExpr{
-		Ident:      &ast.Ident{"main", lexer.Area{}},
-		ClassParam: nil,
-		Params:     []*ast.ParamExpr{},
-		Body:       block,
+func splitList(s string) []string {
+	if s == "" {
+		return nil
 	}
-	function, err := interpret.Compile(main)
+	return strings.Split(s, ",")
+}
+
+func runCompiled(vm *interpret.VM, block *ast.BlockExpr, options interpret.CompileOptions) interpret.Value {
+	function, err := interpret.CompileProgram(block, options)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 
-	vm := interpret.NewVm()
 	v, err := vm.Interpret(function)
+	if exit, ok := err.(*interpret.ExitError); ok {
+		os.Exit(exit.Code)
+	}
 	if err != nil {
-		fmt.Println(err)
+		if rtErr, ok := err.(*interpret.RuntimeError); ok {
+			fmt.Println(rtErr.Traceback())
+		} else {
+			fmt.Println(err)
+		}
 		os.Exit(1)
 	}
-	fmt.Println("Exited with", v.String())
+	return v
 }
 
 func runEval(block *ast.BlockExpr) {
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"fmt"
 	"log"
+	"os"
 	"os/exec"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -14,15 +16,22 @@ import (
 	"github.com/rymdhund/wosh/lexer"
 	"github.com/rymdhund/wosh/obj"
 	. "github.com/rymdhund/wosh/obj"
+	"github.com/rymdhund/wosh/sandbox"
 )
 
 type Runner struct {
 	baseEnv *Env
 	ast     *ast.BlockExpr
+	sandbox *sandbox.Policy
 }
 
 func NewRunner(ast *ast.BlockExpr) *Runner {
-	return &Runner{NewOuterEnv(), ast}
+	return &Runner{NewOuterEnv(), ast, nil}
+}
+
+// Restrict the commands that the program may run, nil removes the restriction
+func (runner *Runner) SetSandbox(policy *sandbox.Policy) {
+	runner.sandbox = policy
 }
 
 func (runner *Runner) Run() error {
@@ -69,34 +78,49 @@ func (runner *Runner) RunExpr(env *Env, exp ast.Expr) (Object, Exception) {
 		return runner.RunSubscrExpr(env, v)
 	case *ast.AttrExpr:
 		return runner.RunAttrExpr(env, v)
-	//case *ast.IfExpr:
-	//	cond, exn := runner.RunExpr(env, v.Cond)
-	//	if exn != NoExnVal {
-	//		return UnitVal, exn
-	//	}
-	//	if GetBool(cond) {
-	//		return runner.RunExpr(env, v.Then)
-	//	} else if v.Else != nil {
-	//		return runner.RunExpr(env, v.Else)
-	//	} else {
-	//		return UnitVal, NoExnVal
-	//	}
+	case *ast.IfExpr:
+		for _, part := range v.ElifParts {
+			cond, exn := runner.RunExpr(env, part.Cond)
+			if exn != NoExnVal {
+				return UnitVal, exn
+			}
+			if GetBool(cond) {
+				return runner.RunExpr(env, part.Then)
+			}
+		}
+		if v.Else != nil {
+			return runner.RunExpr(env, v.Else)
+		}
+		return UnitVal, NoExnVal
 	case *ast.ForExpr:
 		for true {
 			cond, exn := runner.RunExpr(env, v.Cond)
 			if exn != NoExnVal {
 				return UnitVal, exn
 			}
-			if GetBool(cond) {
-				_, exn = runner.RunExpr(env, v.Then)
-				if exn != NoExnVal {
-					return UnitVal, exn
-				}
-			} else {
+			if !GetBool(cond) {
 				break
 			}
+			_, exn = runner.RunExpr(env, v.Then)
+			if res, done, exn := loopControl(exn); done {
+				return res, exn
+			}
 		}
 		return UnitVal, NoExnVal
+	case *ast.ForInExpr:
+		return runner.RunForInExpr(env, v)
+	case *ast.BreakExpr:
+		var value Object = UnitVal
+		if v.Value != nil {
+			var exn Exception
+			value, exn = runner.RunExpr(env, v.Value)
+			if exn != NoExnVal {
+				return UnitVal, exn
+			}
+		}
+		return UnitVal, &breakExn{ExnObject{Val: "'break' outside of a loop"}, value}
+	case *ast.ContinueExpr:
+		return UnitVal, &continueExn{ExnObject{Val: "'continue' outside of a loop"}}
 	case *ast.CaptureExpr:
 		switch v.Mod {
 		case "", "1":
@@ -151,6 +175,95 @@ func (runner *Runner) RunExpr(env *Env, exp ast.Expr) (Object, Exception) {
 	}
 }
 
+// Break and continue are exceptions that are caught by the innermost loop.
+// Their messages are only seen if they escape a function.
+type breakExn struct {
+	ExnObject
+	value Object
+}
+
+type continueExn struct {
+	ExnObject
+}
+
+// Handle the exception that ended an iteration of a loop. Returns true with
+// the result of the loop if the loop is done.
+func loopControl(exn Exception) (Object, bool, Exception) {
+	switch e := exn.(type) {
+	case *breakExn:
+		return e.value, true, NoExnVal
+	case *continueExn:
+		return nil, false, NoExnVal
+	}
+	return UnitVal, exn != NoExnVal, exn
+}
+
+func (runner *Runner) RunForInExpr(env *Env, forr *ast.ForInExpr) (Object, Exception) {
+	iterable, exn := runner.RunExpr(env, forr.Iterable)
+	if exn != NoExnVal {
+		return UnitVal, exn
+	}
+	var items []Object
+	switch v := iterable.(type) {
+	case *ListObject:
+		items = v.Items()
+	case *StringObject:
+		for _, c := range v.Val {
+			items = append(items, StrVal(string(c)))
+		}
+	case *MapObject:
+		items = mapItems(v).Items()
+	default:
+		msg := fmt.Sprintf("Can't iterate over %s", iterable.Class().Name)
+		return UnitVal, ExnVal(msg, "for", forr.Start.Line)
+	}
+	for _, item := range items {
+		if exn := runner.assignPattern(env, forr.Var, item); exn != NoExnVal {
+			return UnitVal, exn
+		}
+		_, exn := runner.RunExpr(env, forr.Then)
+		if res, done, exn := loopControl(exn); done {
+			return res, exn
+		}
+	}
+	return UnitVal, NoExnVal
+}
+
+// Assign o to an identifier, or destructure it into a list of them
+func (runner *Runner) assignPattern(env *Env, pattern ast.Expr, o Object) Exception {
+	switch v := pattern.(type) {
+	case *ast.Ident:
+		env.put(v.Name, o)
+		return NoExnVal
+	case *ast.ListExpr:
+		lst, ok := o.(*ListObject)
+		if !ok || lst.Len() != len(v.Elems) {
+			return ExnVal(fmt.Sprintf("Can't destructure %s", o), "for", v.Start.Line)
+		}
+		for i, item := range lst.Items() {
+			if exn := runner.assignPattern(env, v.Elems[i], item); exn != NoExnVal {
+				return exn
+			}
+		}
+		return NoExnVal
+	}
+	return ExnVal("Can't assign to expression", "for", pattern.GetArea().Start.Line)
+}
+
+// The [key, value] pairs of the map ordered by key
+func mapItems(m *MapObject) *ListObject {
+	keys := make([]string, 0, len(m.Map))
+	for k := range m.Map {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	items := ListNil()
+	for _, k := range keys {
+		items.PrivPush(ListVal(StrVal(k), ListVal(m.Map[k], ListNil())))
+	}
+	return items
+}
+
 func (runner *Runner) RunOpExpr(env *Env, op *ast.OpExpr) (Object, Exception) {
 	o1, exn := runner.RunExpr(env, op.Left)
 	if exn != NoExnVal {
@@ -304,7 +417,11 @@ func (runner *Runner) RunAttrExpr(env *Env, sub *ast.AttrExpr) (Object, Exceptio
 }
 
 func (runner *Runner) RunCommandExpr(env *Env, cmd *ast.CommandExpr) (Object, Exception) {
+	if err := runner.sandbox.CheckCommand(cmd.CmdParts[0]); err != nil {
+		return UnitVal, ExnVal(err.Error(), strings.Join(cmd.CmdParts, " "), cmd.Start.Line)
+	}
 	cmdObj := exec.Command(cmd.CmdParts[0], cmd.CmdParts[1:]...)
+	cmdObj.Env = runner.sandbox.Environ(os.Environ())
 
 	var stdout, stderr bytes.Buffer
 	cmdObj.Stdout = &stdout
@@ -452,6 +569,19 @@ func (runner *Runner) RunCallIdent(env *Env, call *ast.CallExpr, ident *ast.Iden
 		}
 		s := builtin.Len(param)
 		return s, NoExnVal
+	case "items":
+		if len(call.Args) != 1 {
+			panic("Expected 1 argument to items()")
+		}
+		param, exn := runner.RunExpr(env, call.Args[0])
+		if exn != NoExnVal {
+			return UnitVal, exn
+		}
+		m, ok := param.(*MapObject)
+		if !ok {
+			return UnitVal, ExnVal("Expected a map", ident.Name, call.Start.Line)
+		}
+		return mapItems(m), NoExnVal
 	case "new_map":
 		if len(call.Args) != 0 {
 			panic("Expected 0 argument to new_map()")
@@ -515,6 +645,11 @@ func (runner *Runner) RunCallObj(env *Env, call *ast.CallExpr, o Object, classAr
 		innerEnv.put(f.Expr.Params[i].Name.Name, param)
 	}
 	res, exn := runner.RunExpr(innerEnv, f.Expr.Body)
+	switch exn.(type) {
+	case *breakExn, *continueExn:
+		// Loops don't continue in the caller
+		exn = &ExnObject{Val: exn.Msg()}
+	}
 	if exn != NoExnVal {
 		exn.AddStackEntry(StackEntry{name, call.Start.Line})
 	}
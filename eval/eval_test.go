@@ -1,10 +1,12 @@
 package eval
 
 import (
+	"strings"
 	"testing"
 
 	. "github.com/rymdhund/wosh/obj"
 	"github.com/rymdhund/wosh/parser"
+	"github.com/rymdhund/wosh/sandbox"
 )
 
 func runner(t *testing.T, prog string) *Runner {
@@ -290,3 +292,78 @@ func TestEvalFor(t *testing.T) {
 		t.Errorf("Expected int(0), got %v", o)
 	}
 }
+
+func TestEvalForIn(t *testing.T) {
+	r := runner(t, `
+	s = ""
+	for [k, v] in items(new_map()) {
+		s = "never"
+	}
+	for x in [1, 2, 3, 4, 5] {
+		if x == 2 {
+			continue
+		}
+		if x == 4 {
+			break
+		}
+		s = s + str(x)
+	}
+	for c in "ab" {
+		s = s + c
+	}
+	found = for x in [3, 4, 5] {
+		if x > 3 {
+			break x * 10
+		}
+	}
+	`)
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+	o, _ := r.baseEnv.get("s")
+	if !Equal(o, StrVal("13ab")) {
+		t.Errorf("Expected str(13ab), got %v", o)
+	}
+	o, _ = r.baseEnv.get("found")
+	if !Equal(o, IntVal(40)) {
+		t.Errorf("Expected int(40), got %v", o)
+	}
+
+	r = runner(t, `
+	m = new_map()
+	map_set(m, "b", 2)
+	map_set(m, "a", 1)
+	s = ""
+	for [k, v] in items(m) {
+		s = s + k + str(v)
+	}
+	`)
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+	o, _ = r.baseEnv.get("s")
+	if !Equal(o, StrVal("a1b2")) {
+		t.Errorf("Expected str(a1b2), got %v", o)
+	}
+
+	r = runner(t, "fn f() { break }\nfor x in [1] { f() }")
+	err := r.Run()
+	if err == nil || !strings.Contains(err.Error(), "'break' outside of a loop") {
+		t.Errorf("Expected break error, got %v", err)
+	}
+
+	r = runner(t, "for [1, x] in [[1, 2]] { x }")
+	err = r.Run()
+	if err == nil || !strings.Contains(err.Error(), "Can't assign to expression") {
+		t.Errorf("Expected assignment error, got %v", err)
+	}
+}
+
+func TestSandboxedCommand(t *testing.T) {
+	r := runner(t, "`echo hello`")
+	r.SetSandbox(&sandbox.Policy{})
+	err := r.Run()
+	if err == nil || !strings.Contains(err.Error(), "Permission denied: run 'echo'") {
+		t.Errorf("Expected permission error, got %v", err)
+	}
+}
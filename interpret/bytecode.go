@@ -3,6 +3,8 @@ package interpret
 import (
 	"fmt"
 	"io"
+
+	"github.com/rymdhund/wosh/lexer"
 )
 
 type Op uint8
@@ -12,7 +14,7 @@ const (
 	OP_RETURN_NIL
 	OP_RESUME
 	OP_NOP
-	OP_LOAD_CONSTANT // TODO: Add OP_LOAD_CONSTANT_LONG to be able to use more than 256 constants
+	OP_LOAD_CONSTANT
 	OP_MAKE_CLOSURE
 	OP_TRUE
 	OP_FALSE
@@ -45,8 +47,9 @@ const (
 	OP_POP
 	OP_SWAP // swap top two elements on stack
 
-	// Jump instructions. All instructions are relative to current pos.
-	// Instructions are 1 byte followed by two byte offset to where to jump
+	// Jump instructions. All jumps are relative to the end of the instruction.
+	// Instructions are 1 byte followed by a four byte offset to where to jump,
+	// which is always four bytes wide, also without an OP_WIDE prefix
 	OP_JUMP          // jump forward
 	OP_JUMP_IF_FALSE // pop top of stack and optionally jump forward
 	OP_LOOP          // jump backwards
@@ -76,7 +79,8 @@ const (
 	// takes one parameter: length of stack and pops twice that many elements from stack and builds a map of them
 	OP_CREATE_MAP
 
-	// Set closure on top of stack to handler for effect with name given by op-param
+	// Set handler for effect with name given by op-param. The last param is the
+	// number of handlers set before it by the same try
 	OP_SET_HANDLER
 
 	// Pop n handlers from current frame
@@ -90,78 +94,170 @@ const (
 
 	// Verify that top of stack is true and otherwise exit with an error
 	OP_CHECK
+
+	// Pop a type from the stack and verify that the parameter in the slot given by op-param has that type
+	OP_CHECK_PARAM
+
+	// Pop a type from the stack and verify that the value being returned on top of stack has that type
+	OP_CHECK_RETURN
+
+	// Marks the end of an effect handler that finished without resuming. Pops
+	// the continuation of the handler
+	OP_HANDLER_END
+
+	// Register a finally block that is run if the try block is aborted
+	OP_SET_FINALLY
+
+	// Marks the end of a finally block that was run because of an abort
+	OP_END_FINALLY
+
+	// Call in tail position, reusing the frame of the caller if possible
+	OP_TAIL_CALL
+
+	// Pop an effect declaration from the stack and check performs of the
+	// effect against it
+	OP_DECLARE_EFFECT
+
+	// Replace top of stack with an iterator over it
+	OP_ITER
+
+	// Pop an iterator and push its next value, or jump forward if it has no
+	// more values
+	OP_ITER_NEXT
+
+	// Store the stack size and handlers of the frame in the slot given by
+	// op-param when a loop starts, for break and continue to restore
+	OP_LOOP_MARK
+
+	// Exit the loop marked in the slot given by the first op-param, running
+	// the finally blocks of the try blocks left. Jumps forward to the end of
+	// the loop with the popped top of stack as its value
+	OP_BREAK
+
+	// Like OP_BREAK, but jumps forward to the next iteration without a value
+	OP_CONTINUE
+
+	// Pop two ints and push a range between them. The op-param is 1 if the
+	// range includes the end
+	OP_RANGE
+
+	// Pop a collection and a value and push whether the value is in it
+	OP_IN
+
+	// Prefix that makes the arg operands of the next instruction four bytes
+	// wide instead of one
+	OP_WIDE
+)
+
+// Kinds of instruction operands
+type operand int
+
+const (
+	OPERAND_ARG  operand = iota // one byte, four bytes after OP_WIDE
+	OPERAND_JUMP                // four bytes, a jump offset or an absolute position
 )
 
+// Largest value of a wide arg or a jump operand. Operands are read as ints,
+// so they are kept within an int32 for 32 bit platforms.
+const MAX_OPERAND = 1<<31 - 1
+
 var op_names = []struct {
-	name string
-	size int
+	name     string
+	operands []operand
 }{
-	OP_RETURN:           {"OP_RETURN", 1},
-	OP_RETURN_NIL:       {"OP_RETURN_NIL", 1},
-	OP_RESUME:           {"OP_RESUME", 1},
-	OP_NOP:              {"OP_NOP", 1},
-	OP_LOAD_CONSTANT:    {"OP_LOAD_CONSTANT", 2},
-	OP_MAKE_CLOSURE:     {"OP_MAKE_CLOSURE", 2},
-	OP_NIL:              {"OP_NIL", 1},
-	OP_TRUE:             {"OP_TRUE", 1},
-	OP_FALSE:            {"OP_FALSE", 1},
-	OP_EQ:               {"OP_EQ", 1},
-	OP_LESS:             {"OP_LESS", 1},
-	OP_LESS_EQ:          {"OP_LESS_EQ", 1},
-	OP_NOT:              {"OP_NOT", 1},
-	OP_AND:              {"OP_AND", 1},
-	OP_OR:               {"OP_OR", 1},
-	OP_COPY:             {"OP_COPY", 1},
-	OP_POP:              {"OP_POP", 1},
-	OP_SWAP:             {"OP_SWAP", 1},
-	OP_JUMP:             {"OP_JUMP", 3},
-	OP_JUMP_IF_FALSE:    {"OP_JUMP_IF_FALSE", 3},
-	OP_LOOP:             {"OP_LOOP", 3},
-	OP_LOAD_SLOT:        {"OP_LOAD_SLOT", 2},
-	OP_LOAD_SLOT_HEAP:   {"OP_LOAD_SLOT_HEAP", 2},
-	OP_LOAD_GLOBAL_NAME: {"OP_LOAD_GLOBAL_NAME", 2},
-	OP_LOAD_METHOD_NAME: {"OP_LOAD_METHOD_NAME", 2},
-	OP_PUT_SLOT:         {"OP_PUT_SLOT", 2},
-	OP_PUT_SLOT_HEAP:    {"OP_PUT_SLOT_HEAP", 2},
-	OP_PUT_GLOBAL_NAME:  {"OP_PUT_GLOBAL_NAME", 2},
-	OP_SET_METHOD:       {"OP_SET_METHOD", 3},
-	OP_NEG:              {"OP_NEG", 1},
-	OP_ADD:              {"OP_ADD", 1},
-	OP_SUB:              {"OP_SUB", 1},
-	OP_MULT:             {"OP_MULT", 1},
-	OP_DIV:              {"OP_DIV", 1},
-	OP_MOD:              {"OP_MOD", 1},
-	OP_SUBSCRIPT_BINARY: {"OP_SUBSCRIPT_BINARY", 1},
-	OP_SUBSCRIPT_ASSIGN: {"OP_SUBSCRIPT_ASSIGN", 1},
-	OP_CONS:             {"OP_CONS", 1},
-	OP_SUB_SLICE:        {"OP_SUB_SLICE", 1},
-	OP_ATTR:             {"OP_ATTR", 2},
-	OP_CALL:             {"OP_CALL", 2},
-	OP_CALL_METHOD:      {"OP_CALL_METHOD", 3},
-	OP_CREATE_LIST:      {"OP_CREATE_LIST", 2},
-	OP_CREATE_MAP:       {"OP_CREATE_MAP", 2},
-	OP_SET_HANDLER:      {"OP_SET_HANDLER", 4},
-	OP_POP_HANDLERS:     {"OP_POP_HANDLERS", 2},
-	OP_DO:               {"OP_DO", 2},
-	OP_TYPE:             {"OP_TYPE", 1},
-	OP_CHECK:            {"OP_CHECK", 2},
+	OP_RETURN:           {"OP_RETURN", []operand{}},
+	OP_RETURN_NIL:       {"OP_RETURN_NIL", []operand{}},
+	OP_RESUME:           {"OP_RESUME", []operand{}},
+	OP_NOP:              {"OP_NOP", []operand{}},
+	OP_LOAD_CONSTANT:    {"OP_LOAD_CONSTANT", []operand{OPERAND_ARG}},
+	OP_MAKE_CLOSURE:     {"OP_MAKE_CLOSURE", []operand{OPERAND_ARG}},
+	OP_NIL:              {"OP_NIL", []operand{}},
+	OP_TRUE:             {"OP_TRUE", []operand{}},
+	OP_FALSE:            {"OP_FALSE", []operand{}},
+	OP_EQ:               {"OP_EQ", []operand{}},
+	OP_LESS:             {"OP_LESS", []operand{}},
+	OP_LESS_EQ:          {"OP_LESS_EQ", []operand{}},
+	OP_NOT:              {"OP_NOT", []operand{}},
+	OP_AND:              {"OP_AND", []operand{}},
+	OP_OR:               {"OP_OR", []operand{}},
+	OP_COPY:             {"OP_COPY", []operand{}},
+	OP_POP:              {"OP_POP", []operand{}},
+	OP_SWAP:             {"OP_SWAP", []operand{}},
+	OP_JUMP:             {"OP_JUMP", []operand{OPERAND_JUMP}},
+	OP_JUMP_IF_FALSE:    {"OP_JUMP_IF_FALSE", []operand{OPERAND_JUMP}},
+	OP_LOOP:             {"OP_LOOP", []operand{OPERAND_JUMP}},
+	OP_LOAD_SLOT:        {"OP_LOAD_SLOT", []operand{OPERAND_ARG}},
+	OP_LOAD_SLOT_HEAP:   {"OP_LOAD_SLOT_HEAP", []operand{OPERAND_ARG}},
+	OP_LOAD_GLOBAL_NAME: {"OP_LOAD_GLOBAL_NAME", []operand{OPERAND_ARG}},
+	OP_LOAD_METHOD_NAME: {"OP_LOAD_METHOD_NAME", []operand{OPERAND_ARG}},
+	OP_PUT_SLOT:         {"OP_PUT_SLOT", []operand{OPERAND_ARG}},
+	OP_PUT_SLOT_HEAP:    {"OP_PUT_SLOT_HEAP", []operand{OPERAND_ARG}},
+	OP_PUT_GLOBAL_NAME:  {"OP_PUT_GLOBAL_NAME", []operand{OPERAND_ARG}},
+	OP_SET_METHOD:       {"OP_SET_METHOD", []operand{OPERAND_ARG, OPERAND_ARG}},
+	OP_NEG:              {"OP_NEG", []operand{}},
+	OP_ADD:              {"OP_ADD", []operand{}},
+	OP_SUB:              {"OP_SUB", []operand{}},
+	OP_MULT:             {"OP_MULT", []operand{}},
+	OP_DIV:              {"OP_DIV", []operand{}},
+	OP_MOD:              {"OP_MOD", []operand{}},
+	OP_SUBSCRIPT_BINARY: {"OP_SUBSCRIPT_BINARY", []operand{}},
+	OP_SUBSCRIPT_ASSIGN: {"OP_SUBSCRIPT_ASSIGN", []operand{}},
+	OP_CONS:             {"OP_CONS", []operand{}},
+	OP_SUB_SLICE:        {"OP_SUB_SLICE", []operand{}},
+	OP_ATTR:             {"OP_ATTR", []operand{OPERAND_ARG}},
+	OP_CALL:             {"OP_CALL", []operand{OPERAND_ARG}},
+	OP_CALL_METHOD:      {"OP_CALL_METHOD", []operand{OPERAND_ARG, OPERAND_ARG}},
+	OP_CREATE_LIST:      {"OP_CREATE_LIST", []operand{OPERAND_ARG}},
+	OP_CREATE_MAP:       {"OP_CREATE_MAP", []operand{OPERAND_ARG}},
+	OP_SET_HANDLER:      {"OP_SET_HANDLER", []operand{OPERAND_ARG, OPERAND_JUMP, OPERAND_ARG}},
+	OP_POP_HANDLERS:     {"OP_POP_HANDLERS", []operand{OPERAND_ARG}},
+	OP_DO:               {"OP_DO", []operand{OPERAND_ARG}},
+	OP_TYPE:             {"OP_TYPE", []operand{}},
+	OP_CHECK:            {"OP_CHECK", []operand{OPERAND_ARG}},
+	OP_CHECK_PARAM:      {"OP_CHECK_PARAM", []operand{OPERAND_ARG}},
+	OP_CHECK_RETURN:     {"OP_CHECK_RETURN", []operand{}},
+	OP_HANDLER_END:      {"OP_HANDLER_END", []operand{}},
+	OP_SET_FINALLY:      {"OP_SET_FINALLY", []operand{OPERAND_JUMP}},
+	OP_END_FINALLY:      {"OP_END_FINALLY", []operand{}},
+	OP_TAIL_CALL:        {"OP_TAIL_CALL", []operand{OPERAND_ARG}},
+	OP_DECLARE_EFFECT:   {"OP_DECLARE_EFFECT", []operand{}},
+	OP_ITER:             {"OP_ITER", []operand{}},
+	OP_ITER_NEXT:        {"OP_ITER_NEXT", []operand{OPERAND_JUMP}},
+	OP_LOOP_MARK:        {"OP_LOOP_MARK", []operand{OPERAND_ARG}},
+	OP_BREAK:            {"OP_BREAK", []operand{OPERAND_ARG, OPERAND_JUMP}},
+	OP_CONTINUE:         {"OP_CONTINUE", []operand{OPERAND_ARG, OPERAND_JUMP}},
+	OP_RANGE:            {"OP_RANGE", []operand{OPERAND_ARG}},
+	OP_IN:               {"OP_IN", []operand{}},
+	OP_WIDE:             {"OP_WIDE", []operand{}},
 }
 
 func (o Op) String() string {
 	return op_names[o].name
 }
 
+// Size of the instruction without the OP_WIDE prefix
 func (o Op) Size() int {
-	s := op_names[o].size
-	if s <= 0 {
-		panic(fmt.Sprintf("Invalid size: %d", s))
+	return o.size(false)
+}
+
+func (o Op) size(wide bool) int {
+	s := 1
+	for _, kind := range op_names[o].operands {
+		s += kind.size(wide)
 	}
 	return s
 }
 
+func (kind operand) size(wide bool) int {
+	if kind == OPERAND_ARG && !wide {
+		return 1
+	}
+	return 4
+}
+
 type Chunk struct {
 	Code       []Op
-	LineNr     []int
+	Positions  *SourceMap // source position of each byte in Code
 	Constants  []Value
 	Names      []string       // for calling dynamic methods
 	LocalNames []string       // for debugging purposes
@@ -169,73 +265,111 @@ type Chunk struct {
 }
 
 func NewChunk() *Chunk {
-	return &Chunk{[]Op{}, []int{}, []Value{}, []string{}, []string{}, make(map[int]string)}
+	return &Chunk{[]Op{}, NewSourceMap(), []Value{}, []string{}, []string{}, make(map[int]string)}
+}
+
+// Source position of the byte at offset
+func (c *Chunk) Position(offset int) SourcePos {
+	return c.Positions.Lookup(offset)
 }
 
 func (c *Chunk) currentPos() int {
 	return len(c.Code)
 }
 
-func (c *Chunk) addNopComment(comment string, line int) {
-	c.addOp1(OP_NOP, line)
+func (c *Chunk) addNopComment(comment string, area lexer.Area) {
+	c.addOp1(OP_NOP, area)
 	c.Comments[len(c.Code)-1] = comment
 }
 
 // Add one-byte op
-func (c *Chunk) addOp1(op Op, line int) {
-	if op_names[op].size != 1 {
-		panic(fmt.Sprintf("Expected op of size 1, got %s of size %d", op_names[op].name, op_names[op].size))
+func (c *Chunk) addOp1(op Op, area lexer.Area) {
+	if op.Size() != 1 {
+		panic(fmt.Sprintf("Expected op of size 1, got %s of size %d", op, op.Size()))
 	}
 	c.Code = append(c.Code, op)
-	c.LineNr = append(c.LineNr, line)
+	c.Positions.add(area, 1)
 }
 
-// Add two-byte op
-func (c *Chunk) addOp2(op Op, arg Op, line int) {
-	if op_names[op].size != 2 {
-		panic(fmt.Sprintf("Expected op of size 2, got %s of size %d", op_names[op].name, op_names[op].size))
+// Add an op with operands. The op is prefixed with OP_WIDE if an arg doesn't
+// fit in one byte
+func (c *Chunk) addOp(op Op, area lexer.Area, args ...int) {
+	kinds := op_names[op].operands
+	if len(args) != len(kinds) {
+		panic(fmt.Sprintf("Expected %d operands for %s, got %d", len(kinds), op, len(args)))
 	}
-
-	c.Code = append(c.Code, op, arg)
-	c.LineNr = append(c.LineNr, line, line)
-}
-
-// Add three-byte op
-func (c *Chunk) addOp3(op, arg1, arg2 Op, line int) {
-	if op_names[op].size != 3 {
-		panic(fmt.Sprintf("Expected op of size 3, got %s of size %d", op_names[op].name, op_names[op].size))
+	wide := false
+	for i, arg := range args {
+		if arg < 0 || arg > MAX_OPERAND {
+			panic(fmt.Sprintf("Operand %d of %s out of range", arg, op))
+		}
+		if kinds[i] == OPERAND_ARG && arg > 0xff {
+			wide = true
+		}
+	}
+	if wide {
+		c.add(OP_WIDE, area)
+	}
+	c.add(op, area)
+	for i, arg := range args {
+		if kinds[i].size(wide) == 1 {
+			c.add(Op(arg), area)
+		} else {
+			c.addBytes4(arg, area)
+		}
 	}
+}
 
-	c.Code = append(c.Code, op, arg1, arg2)
-	c.LineNr = append(c.LineNr, line, line, line)
+func (c *Chunk) add(op Op, area lexer.Area) {
+	c.Code = append(c.Code, op)
+	c.Positions.add(area, 1)
 }
 
-// Add four-byte op
-func (c *Chunk) addOp4(op, arg1, arg2 Op, arg3 Op, line int) {
-	if op_names[op].size != 4 {
-		panic(fmt.Sprintf("Expected op of size 4, got %s of size %d", op_names[op].name, op_names[op].size))
-	}
+func (c *Chunk) addConst(v Value) int {
+	c.Constants = append(c.Constants, v)
+	return len(c.Constants) - 1
+}
 
-	c.Code = append(c.Code, op, arg1, arg2, arg3)
-	c.LineNr = append(c.LineNr, line, line, line, line)
+// Add a big-endian four byte operand
+func (c *Chunk) addBytes4(value int, area lexer.Area) {
+	c.add(Op(uint8(value>>24)), area)
+	c.add(Op(uint8(value>>16)), area)
+	c.add(Op(uint8(value>>8)), area)
+	c.add(Op(uint8(value)), area)
 }
 
-func (c *Chunk) add(op Op, line int) {
-	c.Code = append(c.Code, op)
-	c.LineNr = append(c.LineNr, line)
+// Overwrite the four byte operand at offset
+func (c *Chunk) setBytes4(offset int, value int) {
+	c.Code[offset] = Op(uint8(value >> 24))
+	c.Code[offset+1] = Op(uint8(value >> 16))
+	c.Code[offset+2] = Op(uint8(value >> 8))
+	c.Code[offset+3] = Op(uint8(value))
 }
 
-func (c *Chunk) addConst(v Value) Op {
-	if len(c.Constants) >= 256 {
-		panic("No support for more than 256 constants")
-	}
-	c.Constants = append(c.Constants, v)
-	return Op(len(c.Constants) - 1)
+func (c *Chunk) readBytes4(offset int) int {
+	return int(c.Code[offset])<<24 | int(c.Code[offset+1])<<16 | int(c.Code[offset+2])<<8 | int(c.Code[offset+3])
 }
 
-func (c *Chunk) addBytes2(value uint16) {
-	c.add(Op(uint8(value>>8)), 0)
-	c.add(Op(uint8(value)), 0)
+// Decode the instruction at offset. Returns the op, its operands and the size
+// of the instruction including any OP_WIDE prefix
+func (c *Chunk) decode(offset int) (Op, []int, int) {
+	pos := offset
+	wide := c.Code[pos] == OP_WIDE
+	if wide {
+		pos++
+	}
+	op := c.Code[pos]
+	pos++
+	args := []int{}
+	for _, kind := range op_names[op].operands {
+		if kind.size(wide) == 1 {
+			args = append(args, int(c.Code[pos]))
+		} else {
+			args = append(args, c.readBytes4(pos))
+		}
+		pos += kind.size(wide)
+	}
+	return op, args, pos - offset
 }
 
 func (chunk *Chunk) disassemble(name string, w io.Writer) {
@@ -250,166 +384,187 @@ func (chunk *Chunk) disassemble(name string, w io.Writer) {
 func (chunk *Chunk) disassembleInstruction(offset int, w io.Writer) int {
 	fmt.Fprintf(w, "%04d ", offset)
 
-	if offset == 0 || chunk.LineNr[offset] != chunk.LineNr[offset-1] {
-		fmt.Fprintf(w, "%4d ", chunk.LineNr[offset])
+	pos := chunk.Position(offset)
+	if offset == 0 || pos != chunk.Position(offset-1) {
+		fmt.Fprintf(w, "%7s ", fmt.Sprintf("%d:%d", pos.Line(), pos.Col()))
 	} else {
-		fmt.Fprint(w, "   | ")
+		fmt.Fprint(w, "      | ")
 	}
 
-	instr := chunk.Code[offset]
+	instr, args, size := chunk.decode(offset)
+	name := instr.String()
+	if size > instr.Size() {
+		name = "OP_WIDE " + name
+	}
 	switch instr {
 	case OP_RETURN:
-		chunk.simpleInstruction(instr.String(), w)
+		chunk.simpleInstruction(name, w)
 	case OP_RETURN_NIL:
-		chunk.simpleInstruction(instr.String(), w)
+		chunk.simpleInstruction(name, w)
 	case OP_RESUME:
-		chunk.simpleInstruction(instr.String(), w)
+		chunk.simpleInstruction(name, w)
 	case OP_NOP:
 		chunk.nop(offset, w)
 	case OP_MAKE_CLOSURE, OP_LOAD_CONSTANT:
-		chunk.constantInstruction(instr.String(), offset, w)
+		chunk.constantInstruction(name, args, w)
 	case OP_NIL:
-		chunk.simpleInstruction(instr.String(), w)
+		chunk.simpleInstruction(name, w)
 	case OP_TRUE:
-		chunk.simpleInstruction(instr.String(), w)
+		chunk.simpleInstruction(name, w)
 	case OP_FALSE:
-		chunk.simpleInstruction(instr.String(), w)
+		chunk.simpleInstruction(name, w)
 	case OP_EQ:
-		chunk.simpleInstruction(instr.String(), w)
+		chunk.simpleInstruction(name, w)
 	case OP_LESS:
-		chunk.simpleInstruction(instr.String(), w)
+		chunk.simpleInstruction(name, w)
 	case OP_LESS_EQ:
-		chunk.simpleInstruction(instr.String(), w)
+		chunk.simpleInstruction(name, w)
 	case OP_NOT:
-		chunk.simpleInstruction(instr.String(), w)
+		chunk.simpleInstruction(name, w)
 	case OP_AND:
-		chunk.simpleInstruction(instr.String(), w)
+		chunk.simpleInstruction(name, w)
 	case OP_OR:
-		chunk.simpleInstruction(instr.String(), w)
+		chunk.simpleInstruction(name, w)
 	case OP_NEG:
-		chunk.simpleInstruction(instr.String(), w)
+		chunk.simpleInstruction(name, w)
 	case OP_ADD, OP_CONS, OP_SUB_SLICE:
-		chunk.simpleInstruction(instr.String(), w)
+		chunk.simpleInstruction(name, w)
 	case OP_MOD:
-		chunk.simpleInstruction(instr.String(), w)
+		chunk.simpleInstruction(name, w)
 	case OP_MULT:
-		chunk.simpleInstruction(instr.String(), w)
+		chunk.simpleInstruction(name, w)
 	case OP_SUB:
-		chunk.simpleInstruction(instr.String(), w)
+		chunk.simpleInstruction(name, w)
 	case OP_SUBSCRIPT_BINARY:
-		chunk.simpleInstruction(instr.String(), w)
+		chunk.simpleInstruction(name, w)
 	case OP_SUBSCRIPT_ASSIGN:
-		chunk.simpleInstruction(instr.String(), w)
+		chunk.simpleInstruction(name, w)
 	case OP_COPY:
-		chunk.simpleInstruction(instr.String(), w)
+		chunk.simpleInstruction(name, w)
 	case OP_POP:
-		chunk.simpleInstruction(instr.String(), w)
+		chunk.simpleInstruction(name, w)
 	case OP_SWAP:
-		chunk.simpleInstruction(instr.String(), w)
+		chunk.simpleInstruction(name, w)
 	case OP_JUMP:
-		chunk.jumpInstruction(instr.String(), offset, w)
-	case OP_JUMP_IF_FALSE:
-		chunk.jumpInstruction(instr.String(), offset, w)
+		chunk.jumpInstruction(name, offset, w)
+	case OP_JUMP_IF_FALSE, OP_ITER_NEXT:
+		chunk.jumpInstruction(name, offset, w)
 	case OP_LOOP:
-		chunk.jumpBackInstruction(instr.String(), offset, w)
+		chunk.jumpBackInstruction(name, offset, w)
 	case OP_LOAD_GLOBAL_NAME:
-		chunk.loadNameInstruction(instr.String(), offset, w)
+		chunk.loadNameInstruction(name, args, w)
 	case OP_LOAD_METHOD_NAME:
-		chunk.loadNameInstruction(instr.String(), offset, w)
-	case OP_PUT_SLOT, OP_LOAD_SLOT:
-		chunk.slotInstruction(instr.String(), offset, w)
+		chunk.loadNameInstruction(name, args, w)
+	case OP_PUT_SLOT, OP_LOAD_SLOT, OP_LOOP_MARK:
+		chunk.slotInstruction(name, args, w)
+	case OP_BREAK, OP_CONTINUE:
+		chunk.loopExitInstruction(name, offset+size, args, w)
 	case OP_PUT_GLOBAL_NAME:
-		chunk.loadNameInstruction(instr.String(), offset, w)
+		chunk.loadNameInstruction(name, args, w)
 	case OP_SET_METHOD:
-		chunk.nameNameInstruction(instr.String(), offset, w, "class", "method")
-	case OP_CALL:
-		chunk.callInstruction(instr.String(), offset, w)
+		chunk.nameNameInstruction(name, args, w, "class", "method")
+	case OP_CALL, OP_TAIL_CALL:
+		chunk.callInstruction(name, args, w)
 	case OP_CALL_METHOD:
-		chunk.callMethodInstruction(instr.String(), offset, w)
+		chunk.callMethodInstruction(name, args, w)
 	case OP_CREATE_LIST:
-		chunk.createListInstruction(instr.String(), offset, w)
+		chunk.createListInstruction(name, args, w)
 	case OP_TYPE:
-		chunk.simpleInstruction(instr.String(), w)
+		chunk.simpleInstruction(name, w)
 	case OP_SET_HANDLER:
-		chunk.setHandler(instr.String(), offset, w)
+		chunk.setHandler(name, args, w)
 	case OP_POP_HANDLERS, OP_DO:
-		chunk.oneParamInstruction(instr.String(), offset, w)
+		chunk.oneParamInstruction(name, args, w)
 	case OP_CHECK:
-		chunk.simpleInstruction(instr.String(), w)
+		chunk.simpleInstruction(name, w)
+	case OP_CHECK_PARAM:
+		chunk.slotInstruction(name, args, w)
+	case OP_RANGE:
+		chunk.oneParamInstruction(name, args, w)
+	case OP_CHECK_RETURN, OP_HANDLER_END, OP_END_FINALLY, OP_DECLARE_EFFECT, OP_ITER, OP_IN:
+		chunk.simpleInstruction(name, w)
+	case OP_SET_FINALLY:
+		chunk.setFinally(name, args, w)
 	default:
 		fmt.Fprintf(w, "Unknown opcode %s\n", instr.String())
 	}
-	return instr.Size()
+	return size
 }
 
 func (chunk *Chunk) simpleInstruction(name string, w io.Writer) {
 	fmt.Fprintf(w, "%-20s\n", name)
 }
 
-func (chunk *Chunk) constantInstruction(name string, offset int, w io.Writer) {
-	constIdx := chunk.Code[offset+1]
+func (chunk *Chunk) constantInstruction(name string, args []int, w io.Writer) {
+	constIdx := args[0]
 	constant := chunk.Constants[constIdx]
 	fmt.Fprintf(w, "%-20s (idx=%d) [value='%s']\n", name, constIdx, constant)
 }
 
 func (chunk *Chunk) jumpInstruction(name string, offset int, w io.Writer) {
-	jumpOffset := (uint16(chunk.Code[offset+1]) << 8) + uint16(chunk.Code[offset+2])
-	jumpPos := offset + 3 + int(jumpOffset)
+	jumpOffset := chunk.readBytes4(offset + 1)
+	jumpPos := offset + Op(OP_JUMP).Size() + jumpOffset
 	fmt.Fprintf(w, "%-20s %4d => %d\n", name, jumpOffset, jumpPos)
 }
 
 func (chunk *Chunk) jumpBackInstruction(name string, offset int, w io.Writer) {
-	jumpOffset := (uint16(chunk.Code[offset+1]) << 8) + uint16(chunk.Code[offset+2])
-	jumpPos := offset + 3 - int(jumpOffset)
+	jumpOffset := chunk.readBytes4(offset + 1)
+	jumpPos := offset + Op(OP_LOOP).Size() - jumpOffset
 	fmt.Fprintf(w, "%-20s %4d => %d\n", name, jumpOffset, jumpPos)
 }
 
-func (chunk *Chunk) loadNameInstruction(name string, offset int, w io.Writer) {
-	nameIdx := chunk.Code[offset+1]
+func (chunk *Chunk) loopExitInstruction(name string, next int, args []int, w io.Writer) {
+	slot := args[0]
+	fmt.Fprintf(w, "%-20s %4d '%s' %4d => %d\n", name, slot, chunk.LocalNames[slot], args[1], next+args[1])
+}
+
+func (chunk *Chunk) loadNameInstruction(name string, args []int, w io.Writer) {
+	nameIdx := args[0]
 	namex := chunk.Names[nameIdx]
 	fmt.Fprintf(w, "%-20s %4d '%s'\n", name, nameIdx, namex)
 }
 
-func (chunk *Chunk) nameNameInstruction(op string, offset int, w io.Writer, label1, label2 string) {
-	name1Idx := chunk.Code[offset+1]
-	name2Idx := chunk.Code[offset+2]
-	name1 := chunk.Names[name1Idx]
-	name2 := chunk.Names[name2Idx]
+func (chunk *Chunk) nameNameInstruction(op string, args []int, w io.Writer, label1, label2 string) {
+	name1 := chunk.Names[args[0]]
+	name2 := chunk.Names[args[1]]
 	fmt.Fprintf(w, "%-20s (%s='%s', %s='%s')\n", op, label1, name1, label2, name2)
 }
 
-func (chunk *Chunk) slotInstruction(name string, offset int, w io.Writer) {
-	slot := chunk.Code[offset+1]
+func (chunk *Chunk) slotInstruction(name string, args []int, w io.Writer) {
+	slot := args[0]
 	namex := chunk.LocalNames[slot]
 	fmt.Fprintf(w, "%-20s %4d '%s'\n", name, slot, namex)
 }
 
-func (chunk *Chunk) callInstruction(name string, offset int, w io.Writer) {
-	arity := chunk.Code[offset+1]
+func (chunk *Chunk) callInstruction(name string, args []int, w io.Writer) {
+	arity := args[0]
 	fmt.Fprintf(w, "%-20s %4d\n", name, arity)
 }
 
-func (chunk *Chunk) callMethodInstruction(name string, offset int, w io.Writer) {
-	arity := chunk.Code[offset+1]
-	methodNameIdx := chunk.Code[offset+2]
+func (chunk *Chunk) callMethodInstruction(name string, args []int, w io.Writer) {
+	arity := args[0]
+	methodNameIdx := args[1]
 	methodName := chunk.Names[methodNameIdx]
 	fmt.Fprintf(w, "%-20s (arity=%d, method='%s'(%d))\n", name, arity, methodName, methodNameIdx)
 }
 
-func (chunk *Chunk) createListInstruction(name string, offset int, w io.Writer) {
-	size := chunk.Code[offset+1]
+func (chunk *Chunk) createListInstruction(name string, args []int, w io.Writer) {
+	size := args[0]
 	fmt.Fprintf(w, "%-20s (size=%d)\n", name, size)
 }
 
-func (chunk *Chunk) setHandler(name string, offset int, w io.Writer) {
-	nameIdx := chunk.Code[offset+1]
+func (chunk *Chunk) setHandler(name string, args []int, w io.Writer) {
+	nameIdx := args[0]
 	namex := chunk.Names[nameIdx]
-	jumpOffset := (uint16(chunk.Code[offset+2]) << 8) + uint16(chunk.Code[offset+3])
-	fmt.Fprintf(w, "%-20s %4d '%s' %4d\n", name, nameIdx, namex, jumpOffset)
+	fmt.Fprintf(w, "%-20s %4d '%s' %4d (index=%d)\n", name, nameIdx, namex, args[1], args[2])
+}
+
+func (chunk *Chunk) setFinally(name string, args []int, w io.Writer) {
+	fmt.Fprintf(w, "%-20s %4d\n", name, args[0])
 }
 
-func (chunk *Chunk) oneParamInstruction(name string, offset int, w io.Writer) {
-	argument := chunk.Code[offset+1]
+func (chunk *Chunk) oneParamInstruction(name string, args []int, w io.Writer) {
+	argument := args[0]
 	fmt.Fprintf(w, "%-20s %4d\n", name, argument)
 }
 
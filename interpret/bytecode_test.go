@@ -2,15 +2,18 @@ package interpret
 
 import (
 	"os"
+	"reflect"
 	"testing"
+
+	"github.com/rymdhund/wosh/lexer"
 )
 
 func TestBytecode(t *testing.T) {
 	c := NewChunk()
-	c.add(OP_RETURN, 1)
+	c.add(OP_RETURN, lexer.Position{1, 0}.Extend(1))
 	constant := c.addConst(NewInt(3))
-	c.add(OP_LOAD_CONSTANT, 2)
-	c.add(constant, 2)
+	c.add(OP_LOAD_CONSTANT, lexer.Position{2, 0}.Extend(1))
+	c.add(Op(constant), lexer.Position{2, 0}.Extend(1))
 
 	c.disassemble("test", os.Stdout)
 
@@ -19,3 +22,65 @@ func TestBytecode(t *testing.T) {
 	}
 	//t.Fail()
 }
+
+func TestSourceMap(t *testing.T) {
+	source := NewSource("test.wosh", "a + b\nc")
+	area1 := lexer.Position{0, 0}.Extend(5)
+	area2 := lexer.Position{1, 0}.Extend(1)
+
+	c := NewChunk()
+	c.Positions.setFile(source)
+	c.addOp(OP_LOAD_SLOT, area1, 1)
+	c.addOp(OP_LOAD_SLOT, area1, 2)
+	c.addOp1(OP_ADD, area1)
+	c.addOp(OP_JUMP, area2, 0)
+	c.Positions.setFile(nil)
+	c.addOp1(OP_RETURN, area2)
+
+	if len(c.Positions.runs) != 3 {
+		t.Errorf("Expected 3 runs, got %d", len(c.Positions.runs))
+	}
+	tests := []struct {
+		offset   int
+		expected SourcePos
+	}{
+		{0, SourcePos{source, area1}},
+		{4, SourcePos{source, area1}},
+		{5, SourcePos{source, area2}},
+		{9, SourcePos{source, area2}},
+		{10, SourcePos{nil, area2}},
+	}
+	for _, test := range tests {
+		if pos := c.Position(test.offset); pos != test.expected {
+			t.Errorf("Expected %v at offset %d, got %v", test.expected, test.offset, pos)
+		}
+	}
+}
+
+func TestWideOperands(t *testing.T) {
+	c := NewChunk()
+	area := lexer.Position{0, 0}.Extend(1)
+	c.addOp(OP_LOAD_SLOT, area, 3)
+	c.addOp(OP_CALL_METHOD, area, 2, 70000)
+	c.addOp(OP_JUMP, area, 1)
+
+	tests := []struct {
+		offset int
+		op     Op
+		args   []int
+		size   int
+	}{
+		{0, OP_LOAD_SLOT, []int{3}, 2},
+		{2, OP_CALL_METHOD, []int{2, 70000}, 10},
+		{12, OP_JUMP, []int{1}, 5},
+	}
+	for _, test := range tests {
+		op, args, size := c.decode(test.offset)
+		if op != test.op || !reflect.DeepEqual(args, test.args) || size != test.size {
+			t.Errorf("Expected %s %v (size %d) at %d, got %s %v (size %d)", test.op, test.args, test.size, test.offset, op, args, size)
+		}
+	}
+	if c.Code[2] != OP_WIDE {
+		t.Errorf("Expected OP_WIDE prefix, got %s", c.Code[2])
+	}
+}
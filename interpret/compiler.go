@@ -11,23 +11,40 @@ import (
 
 type Compiler struct {
 	chunk             *Chunk
-	localLookupTables []map[string]uint8
+	localLookupTables []map[string]int
 	nameLookupTable   map[string]int
-	heapLookupTable   map[uint8]bool // is the variable in a given slot index on the heap?
+	heapLookupTable   map[int]bool // is the variable in a given slot index on the heap?
 
 	// when creating the closure we put slot from old scope into the captures
-	outerCaptureSlots []uint8
+	outerCaptureSlots []int
 	// When calling the closure we put captures into the slots in the new call frame
-	innerCaptureSlots []uint8
+	innerCaptureSlots []int
 
 	arity     int
 	prevScope *Compiler
+	options   CompileOptions
+
+	// Name of the annotated return type, or "" if there is none
+	returnType string
 
 	// indexes to placeHolders for jumps etc
 	jumpPositions []int
+
+	// The loops being compiled, innermost last
+	loops []*loop
+
+	// Calls that are compiled to tail calls
+	tailCalls map[*ast.CallExpr]bool
+}
+
+// A loop that break and continue can exit
+type loop struct {
+	markSlot  int   // hidden local with the loop mark, see OP_LOOP_MARK
+	breaks    []int // placeholders of the jumps to the end of the loop
+	continues []int // placeholders of the jumps to the next iteration
 }
 
-func (c *Compiler) lookupLocalVar(name string) (uint8, bool) {
+func (c *Compiler) lookupLocalVar(name string) (int, bool) {
 	currentScope := len(c.localLookupTables) - 1
 	for currentScope >= 0 {
 		idx, ok := c.localLookupTables[currentScope][name]
@@ -40,63 +57,106 @@ func (c *Compiler) lookupLocalVar(name string) (uint8, bool) {
 }
 
 func (c *Compiler) scopeBegin() {
-	c.localLookupTables = append(c.localLookupTables, map[string]uint8{})
+	c.localLookupTables = append(c.localLookupTables, map[string]int{})
 }
 
 func (c *Compiler) scopeEnd() {
 	c.localLookupTables = c.localLookupTables[:len(c.localLookupTables)-1]
 }
 
-func (c *Compiler) getOrCreateLocalVar(name string) uint8 {
+func (c *Compiler) getOrCreateLocalVar(name string) int {
 	idx, ok := c.lookupLocalVar(name)
 	if !ok {
 		newIdx := len(c.chunk.LocalNames)
-		if newIdx > 255 {
-			panic("Too many locals")
-		}
 		currentScope := len(c.localLookupTables) - 1
-		c.localLookupTables[currentScope][name] = uint8(newIdx)
+		c.localLookupTables[currentScope][name] = newIdx
 		c.chunk.LocalNames = append(c.chunk.LocalNames, name)
-		return uint8(newIdx)
+		return newIdx
 	}
 	return idx
 }
 
 // Create a local variable in current scope, even if it exists in outer scope
 // Will panic if variable of same name exists in current scope
-func (c *Compiler) createScopedLocal(name string) uint8 {
+func (c *Compiler) createScopedLocal(name string) int {
 	currentScope := len(c.localLookupTables) - 1
 	_, ok := c.localLookupTables[currentScope][name]
 	if ok {
 		panic(fmt.Sprintf("Cant creat local variable in scope when it already exists: '%s'", name))
 	}
 	idx := len(c.chunk.LocalNames)
-	if idx > 255 {
-		panic("Too many locals")
-	}
-	c.localLookupTables[currentScope][name] = uint8(idx)
+	c.localLookupTables[currentScope][name] = idx
 	c.chunk.LocalNames = append(c.chunk.LocalNames, name)
-	return uint8(idx)
+	return idx
 }
 
-func (c *Compiler) getOrSetName(name string) uint8 {
+func (c *Compiler) getOrSetName(name string) int {
 	idx, ok := c.nameLookupTable[name]
 	if !ok {
 		idx = len(c.chunk.Names)
 		c.nameLookupTable[name] = idx
 		c.chunk.Names = append(c.chunk.Names, name)
 	}
-	if idx > 255 {
-		panic("Too many names")
-	}
-	return uint8(idx)
+	return idx
+}
+
+type CompileOptions struct {
+	// Check parameter type annotations when entering a function
+	TypeChecks bool
+
+	// The source file for stack traces, might be nil
+	Source *Source
+
+	// The source file of each top level expression of a program that is
+	// joined from several files, used instead of Source. Might be nil
+	ExprSources []*Source
+
+	// Called with the warnings of the static checks of a program, might be nil
+	Warn func(w *Warning)
+
+	// Effects with go handlers, which are handled at the top level of a program
+	HostEffects []string
+}
+
+var DefaultCompileOptions = CompileOptions{
+	TypeChecks: true,
 }
 
 func Compile(function *ast.FuncDefExpr) (*FunctionValue, error) {
-	return compileFunction(function, nil)
+	return CompileWithOptions(function, DefaultCompileOptions)
+}
+
+func CompileWithOptions(function *ast.FuncDefExpr, options CompileOptions) (fn *FunctionValue, err error) {
+	// The compiler panics on unsupported constructs, report them as errors
+	defer func() {
+		if r := recover(); r != nil {
+			fn, err = nil, fmt.Errorf("Compile error: %v", r)
+		}
+	}()
+	return compileFunction(function, nil, options)
+}
+
+// Compile the top level block of a program as a main function
+func CompileProgram(block *ast.BlockExpr, options CompileOptions) (*FunctionValue, error) {
+	warnings, err := checkEffects(block, options)
+	if err != nil {
+		return nil, err
+	}
+	if options.Warn != nil {
+		for _, w := range warnings {
+			options.Warn(w)
+		}
+	}
+	main := &ast.FuncDefExpr{
+		Ident:      &ast.Ident{"main", lexer.Area{}},
+		ClassParam: nil,
+		Params:     []*ast.ParamExpr{},
+		Body:       block,
+	}
+	return CompileWithOptions(main, options)
 }
 
-func compileFunction(function *ast.FuncDefExpr, prev *Compiler) (*FunctionValue, error) {
+func compileFunction(function *ast.FuncDefExpr, prev *Compiler, options CompileOptions) (*FunctionValue, error) {
 	params := function.Params
 	if function.ClassParam != nil {
 		params = append([]*ast.ParamExpr{function.ClassParam}, params...)
@@ -105,22 +165,31 @@ func compileFunction(function *ast.FuncDefExpr, prev *Compiler) (*FunctionValue,
 	if function.Ident != nil {
 		name = function.Ident.Name
 	}
-	return compileFunctionFromBlock(name, params, function.Body, prev)
+	returnType := ""
+	if function.ReturnType != nil && options.TypeChecks {
+		returnType = function.ReturnType.Name
+	}
+	return compileFunctionFromBlock(name, params, returnType, function.Body, prev, options)
 }
 
-func compileFunctionFromBlock(name string, params []*ast.ParamExpr, block *ast.BlockExpr, prev *Compiler) (*FunctionValue, error) {
+func compileFunctionFromBlock(name string, params []*ast.ParamExpr, returnType string, block *ast.BlockExpr, prev *Compiler, options CompileOptions) (*FunctionValue, error) {
 	if DEBUG_TRACE {
 		fmt.Printf("[DEBUG COMPILER] Compiling %s\n", name)
 	}
 	arity := len(params)
 	c := Compiler{
 		chunk:             NewChunk(),
-		localLookupTables: []map[string]uint8{},
+		localLookupTables: []map[string]int{},
 		nameLookupTable:   map[string]int{},
-		heapLookupTable:   map[uint8]bool{},
+		heapLookupTable:   map[int]bool{},
 		arity:             arity,
 		prevScope:         prev,
+		options:           options,
+		returnType:        returnType,
+		tailCalls:         map[*ast.CallExpr]bool{},
 	}
+	c.chunk.Positions.setFile(options.Source)
+
 	// create initial scope
 	c.scopeBegin()
 
@@ -132,13 +201,31 @@ func compileFunctionFromBlock(name string, params []*ast.ParamExpr, block *ast.B
 		c.getOrCreateLocalVar(param.Name.Name)
 	}
 
-	if err := c.CompileBlockExpr(block); err != nil {
+	if c.options.TypeChecks {
+		for _, param := range params {
+			if param.Type != nil {
+				slot, _ := c.lookupLocalVar(param.Name.Name)
+				c.macroCheckParamType(slot, param.Type.Name, param.GetArea())
+			}
+		}
+	}
+
+	// Calls at the top level keep the frame of the program for the traceback
+	if prev != nil {
+		c.markTailCalls(block)
+	}
+	if prev == nil && options.ExprSources != nil {
+		if err := c.compileFiles(block); err != nil {
+			return nil, err
+		}
+	} else if err := c.CompileBlockExpr(block); err != nil {
 		return nil, err
 	}
-	c.chunk.addOp1(OP_RETURN, 1)
+	end := block.GetArea().End
+	c.macroReturn(lexer.NewArea(end, end))
 
 	// find slots that should be put on heap
-	heapSlots := []uint8{}
+	heapSlots := []int{}
 	for k, _ := range c.heapLookupTable {
 		heapSlots = append(heapSlots, k)
 	}
@@ -180,9 +267,25 @@ func (c *Compiler) CompileBlockExpr(block *ast.BlockExpr) error {
 			//	// the pop cancels out the last element pushed to the stack
 			//	c.chunk.Code = c.chunk.Code[:l-1]
 			//} else {
-			//	c.chunk.addOp1(OP_POP, expr.StartLine())
+			//	c.chunk.addOp1(OP_POP, expr.GetArea())
 			//}
-			c.chunk.addOp1(OP_POP, expr.GetArea().End.Line)
+			c.chunk.addOp1(OP_POP, expr.GetArea())
+		}
+	}
+	return nil
+}
+
+// Compile the top level block of a program joined from several files. The
+// functions defined in each expression get the file of the expression.
+func (c *Compiler) compileFiles(block *ast.BlockExpr) error {
+	for i, expr := range block.Children {
+		c.options.Source = c.options.ExprSources[i]
+		c.chunk.Positions.setFile(c.options.Source)
+		if err := c.CompileExpr(expr); err != nil {
+			return err
+		}
+		if i != len(block.Children)-1 {
+			c.chunk.addOp1(OP_POP, expr.GetArea())
 		}
 	}
 	return nil
@@ -206,12 +309,16 @@ func (c *Compiler) CompileExpr(exp ast.Expr) error {
 		return c.CompileFuncDefExpr(v)
 	case *ast.TypeDefExpr:
 		return c.CompileTypeDefExpr(v)
+	case *ast.EffectDefExpr:
+		return c.CompileEffectDefExpr(v)
 	case *ast.TryExpr:
 		return c.CompileTryExpr(v)
 	case *ast.DoExpr:
 		return c.CompileDoExpr(v)
 	case *ast.ForExpr:
 		return c.CompileForExpr(v)
+	case *ast.ForInExpr:
+		return c.CompileForInExpr(v)
 	case *ast.IfExpr:
 		return c.CompileIfExpr(v)
 	case *ast.ResumeExpr:
@@ -226,6 +333,10 @@ func (c *Compiler) CompileExpr(exp ast.Expr) error {
 		return c.CompileSubSlice(v)
 	case *ast.ReturnExpr:
 		return c.CompileReturnExpr(v)
+	case *ast.BreakExpr:
+		return c.CompileBreakExpr(v)
+	case *ast.ContinueExpr:
+		return c.CompileContinueExpr(v)
 	case *ast.AttrExpr:
 		return c.CompileAttrExpr(v)
 	case *ast.MapExpr:
@@ -277,19 +388,19 @@ func (c *Compiler) CompileBasicLit(lit *ast.BasicLit) error {
 		if err != nil {
 			panic(fmt.Sprintf("Expected int in basic lit: %s", err))
 		}
-		c.CompileConstant(NewInt(n), lit.StartLine())
+		c.CompileConstant(NewInt(n), lit.GetArea())
 	case lexer.STRING:
 		return c.CompileStringLit(lit)
 	case lexer.BOOL:
 		if lit.Value == "true" {
-			c.chunk.addOp1(OP_TRUE, lit.StartLine())
+			c.chunk.addOp1(OP_TRUE, lit.GetArea())
 		} else if lit.Value == "false" {
-			c.chunk.addOp1(OP_FALSE, lit.StartLine())
+			c.chunk.addOp1(OP_FALSE, lit.GetArea())
 		} else {
 			panic(fmt.Sprintf("Expected bool in basic lit: %s", lit.Value))
 		}
 	case lexer.UNIT:
-		c.chunk.addOp1(OP_NIL, lit.StartLine())
+		c.chunk.addOp1(OP_NIL, lit.GetArea())
 	default:
 		panic("Not implemented basic literal")
 	}
@@ -322,13 +433,13 @@ func (c *Compiler) CompileStringLit(lit *ast.BasicLit) error {
 		}
 	}
 
-	c.CompileConstant(NewString(sb.String()), lit.StartLine())
+	c.CompileConstant(NewString(sb.String()), lit.GetArea())
 	return nil
 }
 
-func (c *Compiler) CompileConstant(value Value, line int) {
+func (c *Compiler) CompileConstant(value Value, area lexer.Area) {
 	constantIdx := c.chunk.addConst(value)
-	c.chunk.addOp2(OP_LOAD_CONSTANT, constantIdx, line)
+	c.chunk.addOp(OP_LOAD_CONSTANT, area, constantIdx)
 }
 
 func (c *Compiler) CompileOpExpr(op *ast.OpExpr) error {
@@ -340,9 +451,9 @@ func (c *Compiler) CompileOpExpr(op *ast.OpExpr) error {
 	// lazy
 	switch op.Op {
 	case "&&":
-		c.chunk.addOp1(OP_COPY, op.StartLine())
-		firstFalse := c.addJumpToPlaceholder(OP_JUMP_IF_FALSE, op.StartLine())
-		c.chunk.addOp1(OP_POP, op.StartLine())
+		c.chunk.addOp1(OP_COPY, op.GetArea())
+		firstFalse := c.addJumpToPlaceholder(OP_JUMP_IF_FALSE, op.GetArea())
+		c.chunk.addOp1(OP_POP, op.GetArea())
 		err = c.CompileExpr(op.Right)
 		if err != nil {
 			return err
@@ -350,10 +461,10 @@ func (c *Compiler) CompileOpExpr(op *ast.OpExpr) error {
 		c.setPlaceholder(firstFalse, c.chunk.currentPos())
 		return nil
 	case "||":
-		c.chunk.addOp1(OP_COPY, op.StartLine())
-		c.chunk.addOp1(OP_NOT, op.StartLine())
-		firstTrue := c.addJumpToPlaceholder(OP_JUMP_IF_FALSE, op.StartLine())
-		c.chunk.addOp1(OP_POP, op.StartLine())
+		c.chunk.addOp1(OP_COPY, op.GetArea())
+		c.chunk.addOp1(OP_NOT, op.GetArea())
+		firstTrue := c.addJumpToPlaceholder(OP_JUMP_IF_FALSE, op.GetArea())
+		c.chunk.addOp1(OP_POP, op.GetArea())
 		err = c.CompileExpr(op.Right)
 		if err != nil {
 			return err
@@ -369,37 +480,43 @@ func (c *Compiler) CompileOpExpr(op *ast.OpExpr) error {
 
 	switch op.Op {
 	case "+":
-		c.chunk.addOp1(OP_ADD, op.StartLine())
+		c.chunk.addOp1(OP_ADD, op.GetArea())
 	case "-":
-		c.chunk.addOp1(OP_SUB, op.StartLine())
+		c.chunk.addOp1(OP_SUB, op.GetArea())
 	case "*":
-		c.chunk.addOp1(OP_MULT, op.StartLine())
+		c.chunk.addOp1(OP_MULT, op.GetArea())
 	case "/":
-		c.chunk.addOp1(OP_DIV, op.StartLine())
+		c.chunk.addOp1(OP_DIV, op.GetArea())
 	case "%":
-		c.chunk.addOp1(OP_MOD, op.StartLine())
+		c.chunk.addOp1(OP_MOD, op.GetArea())
 	case "==":
-		c.chunk.addOp1(OP_EQ, op.StartLine())
+		c.chunk.addOp1(OP_EQ, op.GetArea())
 	case "!=":
 		// TODO: Optimize these comparisons to only use one opcode each
-		c.chunk.addOp1(OP_EQ, op.StartLine())
-		c.chunk.addOp1(OP_NOT, op.StartLine())
+		c.chunk.addOp1(OP_EQ, op.GetArea())
+		c.chunk.addOp1(OP_NOT, op.GetArea())
 	case "<":
-		c.chunk.addOp1(OP_LESS, op.StartLine())
+		c.chunk.addOp1(OP_LESS, op.GetArea())
 	case ">":
-		c.chunk.addOp1(OP_SWAP, op.StartLine())
-		c.chunk.addOp1(OP_LESS, op.StartLine())
+		c.chunk.addOp1(OP_SWAP, op.GetArea())
+		c.chunk.addOp1(OP_LESS, op.GetArea())
 	case "<=":
-		c.chunk.addOp1(OP_SWAP, op.StartLine())
-		c.chunk.addOp1(OP_LESS, op.StartLine())
-		c.chunk.addOp1(OP_NOT, op.StartLine())
+		c.chunk.addOp1(OP_SWAP, op.GetArea())
+		c.chunk.addOp1(OP_LESS, op.GetArea())
+		c.chunk.addOp1(OP_NOT, op.GetArea())
 	case ">=":
-		c.chunk.addOp1(OP_LESS, op.StartLine())
-		c.chunk.addOp1(OP_NOT, op.StartLine())
+		c.chunk.addOp1(OP_LESS, op.GetArea())
+		c.chunk.addOp1(OP_NOT, op.GetArea())
 	case "[]":
-		c.chunk.addOp1(OP_SUBSCRIPT_BINARY, op.StartLine())
+		c.chunk.addOp1(OP_SUBSCRIPT_BINARY, op.GetArea())
 	case "::":
-		c.chunk.addOp1(OP_CONS, op.StartLine())
+		c.chunk.addOp1(OP_CONS, op.GetArea())
+	case "..":
+		c.chunk.addOp(OP_RANGE, op.GetArea(), 1)
+	case "..<":
+		c.chunk.addOp(OP_RANGE, op.GetArea(), 0)
+	case "in":
+		c.chunk.addOp1(OP_IN, op.GetArea())
 	default:
 		panic(fmt.Sprintf("Not implement operator '%s'", op.Op))
 	}
@@ -413,9 +530,9 @@ func (c *Compiler) CompileUnaryExpr(op *ast.UnaryExpr) error {
 	}
 	switch op.Op {
 	case "!":
-		c.chunk.addOp1(OP_NOT, op.StartLine())
+		c.chunk.addOp1(OP_NOT, op.GetArea())
 	case "-":
-		c.chunk.addOp1(OP_NEG, op.StartLine())
+		c.chunk.addOp1(OP_NEG, op.GetArea())
 	default:
 		panic(fmt.Sprintf("Not implement operator '%s'", op.Op))
 	}
@@ -430,11 +547,7 @@ func (c *Compiler) CompileListExpr(lst *ast.ListExpr) error {
 		}
 	}
 	size := len(lst.Elems)
-	if size > 255 {
-		panic("Too long list")
-	}
-
-	c.chunk.addOp2(OP_CREATE_LIST, Op(uint8(size)), lst.StartLine())
+	c.chunk.addOp(OP_CREATE_LIST, lst.GetArea(), size)
 
 	return nil
 }
@@ -454,10 +567,7 @@ func (c *Compiler) CompileMapExpr(m *ast.MapExpr) error {
 		}
 	}
 	size := len(m.Elems)
-	if size > 255 {
-		panic("Too long map")
-	}
-	c.chunk.addOp2(OP_CREATE_MAP, Op(uint8(size)), m.StartLine())
+	c.chunk.addOp(OP_CREATE_MAP, m.GetArea(), size)
 
 	return nil
 }
@@ -470,7 +580,7 @@ func (c *Compiler) CompileSubSlice(slice *ast.SubscrExpr) error {
 	for _, elem := range slice.Sub {
 		_, ok := elem.(*ast.EmptyExpr)
 		if ok {
-			c.chunk.addOp1(OP_NIL, slice.StartLine())
+			c.chunk.addOp1(OP_NIL, slice.GetArea())
 		} else {
 			err := c.CompileExpr(elem)
 			if err != nil {
@@ -480,13 +590,13 @@ func (c *Compiler) CompileSubSlice(slice *ast.SubscrExpr) error {
 	}
 	// make sure we have three arguments
 	for i := len(slice.Sub); i < 3; i++ {
-		c.chunk.addOp1(OP_NIL, slice.StartLine())
+		c.chunk.addOp1(OP_NIL, slice.GetArea())
 	}
-	c.chunk.addOp1(OP_SUB_SLICE, slice.StartLine())
+	c.chunk.addOp1(OP_SUB_SLICE, slice.GetArea())
 	return nil
 }
 
-func (c *Compiler) CaptureFromOuterScope(name string) (uint8, bool) {
+func (c *Compiler) CaptureFromOuterScope(name string) (int, bool) {
 	outer := c.prevScope
 	// Don't capture from outmost scope since everything is global there
 	if outer == nil || outer.prevScope == nil {
@@ -522,17 +632,17 @@ func (c *Compiler) CompileAssignExpr(assign *ast.AssignExpr) error {
 	switch v := assign.Left.(type) {
 	case *ast.Ident:
 		err := c.CompileAssignIdentPart(v)
-		c.chunk.addOp1(OP_NIL, v.StartLine()) // result is nil
+		c.chunk.addOp1(OP_NIL, v.GetArea()) // result is nil
 		return err
 	case *ast.OpExpr:
 		if v.Op == "[]" {
 			err := c.CompileAssignSubscrPart(v.Left, v.Right)
-			c.chunk.addOp1(OP_NIL, v.Left.GetArea().StartLine()) // result is nil
+			c.chunk.addOp1(OP_NIL, v.Left.GetArea()) // result is nil
 			return err
 		}
 	default:
 		err := c.compileDestructureAssign(assign.Left)
-		c.chunk.addOp1(OP_NIL, assign.Left.GetArea().StartLine()) // result is nil
+		c.chunk.addOp1(OP_NIL, assign.Left.GetArea()) // result is nil
 		return err
 
 	}
@@ -540,25 +650,32 @@ func (c *Compiler) CompileAssignExpr(assign *ast.AssignExpr) error {
 }
 
 // Check that the top of stack has type
-func (c *Compiler) macroCheckType(t *Type, line int) {
-	c.chunk.addOp1(OP_TYPE, line)
-	c.macroCheckEquals(NewTypeValue(ListType), TYPE_ERROR, line)
+func (c *Compiler) macroCheckType(t *Type, area lexer.Area) {
+	c.chunk.addOp1(OP_TYPE, area)
+	c.macroCheckEquals(NewTypeValue(t), TYPE_ERROR, area)
+}
+
+// Check that the parameter in slot has the type with the given global name
+func (c *Compiler) macroCheckParamType(slot int, typeName string, area lexer.Area) {
+	nameIdx := c.getOrSetName(typeName)
+	c.chunk.addOp(OP_LOAD_GLOBAL_NAME, area, nameIdx)
+	c.chunk.addOp(OP_CHECK_PARAM, area, slot)
 }
 
 // Check that the top of stack equals value
-func (c *Compiler) macroCheckEquals(v Value, errNum int, line int) {
-	c.CompileConstant(v, line)
-	c.chunk.addOp1(OP_EQ, line)
-	c.chunk.addOp2(OP_CHECK, Op(errNum), line)
+func (c *Compiler) macroCheckEquals(v Value, errNum int, area lexer.Area) {
+	c.CompileConstant(v, area)
+	c.chunk.addOp1(OP_EQ, area)
+	c.chunk.addOp(OP_CHECK, area, errNum)
 }
 
-func (c *Compiler) macroPutGlobalFunction(name string, line int) {
+func (c *Compiler) macroPutGlobalFunction(name string, area lexer.Area) {
 	nameIdx := c.getOrSetName(name)
-	c.chunk.addOp2(OP_LOAD_GLOBAL_NAME, Op(nameIdx), line)
+	c.chunk.addOp(OP_LOAD_GLOBAL_NAME, area, nameIdx)
 }
 
-func (c *Compiler) macroCall(arity int, line int) {
-	c.chunk.addOp2(OP_CALL, Op(arity), line)
+func (c *Compiler) macroCall(arity int, area lexer.Area) {
+	c.chunk.addOp(OP_CALL, area, arity)
 }
 
 func (c *Compiler) compileDestructureAssign(expr ast.Expr) error {
@@ -567,22 +684,22 @@ func (c *Compiler) compileDestructureAssign(expr ast.Expr) error {
 		return c.CompileAssignIdentPart(v)
 	case *ast.ListExpr:
 		// Do runtime checks
-		c.macroCheckType(ListType, expr.GetArea().StartLine())
+		c.macroCheckType(ListType, expr.GetArea())
 
 		// Check correct length
-		c.chunk.addOp1(OP_COPY, expr.GetArea().StartLine())
-		c.macroPutGlobalFunction("len", expr.GetArea().StartLine())
-		c.chunk.addOp1(OP_SWAP, expr.GetArea().StartLine())
-		c.macroCall(1, expr.GetArea().StartLine())
-		c.macroCheckEquals(NewInt(len(v.Elems)), DESTRUCTURE_ERROR, expr.GetArea().StartLine())
+		c.chunk.addOp1(OP_COPY, expr.GetArea())
+		c.macroPutGlobalFunction("len", expr.GetArea())
+		c.chunk.addOp1(OP_SWAP, expr.GetArea())
+		c.macroCall(1, expr.GetArea())
+		c.macroCheckEquals(NewInt(len(v.Elems)), DESTRUCTURE_ERROR, expr.GetArea())
 
 		for i, elem := range v.Elems {
 			if i < len(v.Elems)-1 {
 				// Copy so we keep the value for the next elem
-				c.chunk.addOp1(OP_COPY, expr.GetArea().StartLine())
+				c.chunk.addOp1(OP_COPY, expr.GetArea())
 			}
-			c.CompileConstant(NewInt(i), expr.GetArea().StartLine())
-			c.chunk.addOp1(OP_SUBSCRIPT_BINARY, expr.GetArea().StartLine())
+			c.CompileConstant(NewInt(i), expr.GetArea())
+			c.chunk.addOp1(OP_SUBSCRIPT_BINARY, expr.GetArea())
 			if err := c.compileDestructureAssign(elem); err != nil {
 				return err
 			}
@@ -615,9 +732,9 @@ func (c *Compiler) CompileAssignIdentPart(ident *ast.Ident) error {
 	// local variable
 	isHeap, ok := c.heapLookupTable[slot]
 	if ok && isHeap {
-		c.chunk.addOp2(OP_PUT_SLOT_HEAP, Op(slot), ident.StartLine())
+		c.chunk.addOp(OP_PUT_SLOT_HEAP, ident.GetArea(), slot)
 	} else {
-		c.chunk.addOp2(OP_PUT_SLOT, Op(slot), ident.StartLine())
+		c.chunk.addOp(OP_PUT_SLOT, ident.GetArea(), slot)
 	}
 	return nil
 }
@@ -630,7 +747,7 @@ func (c *Compiler) CompileAssignSubscrPart(lhs, key ast.Expr) error {
 		return err
 	}
 
-	c.chunk.addOp1(OP_SUBSCRIPT_ASSIGN, lhs.GetArea().StartLine())
+	c.chunk.addOp1(OP_SUBSCRIPT_ASSIGN, lhs.GetArea())
 	return nil
 }
 
@@ -644,16 +761,16 @@ func (c *Compiler) CompileIdent(ident *ast.Ident) error {
 		// local / captured variable
 		isHeap, ok := c.heapLookupTable[slot]
 		if ok && isHeap {
-			c.chunk.addOp2(OP_LOAD_SLOT_HEAP, Op(slot), ident.StartLine())
+			c.chunk.addOp(OP_LOAD_SLOT_HEAP, ident.GetArea(), slot)
 		} else {
-			c.chunk.addOp2(OP_LOAD_SLOT, Op(slot), ident.StartLine())
+			c.chunk.addOp(OP_LOAD_SLOT, ident.GetArea(), slot)
 		}
 		return nil
 	}
 
 	// global variable
 	nameIdx := c.getOrSetName(ident.Name)
-	c.chunk.addOp2(OP_LOAD_GLOBAL_NAME, Op(nameIdx), ident.StartLine())
+	c.chunk.addOp(OP_LOAD_GLOBAL_NAME, ident.GetArea(), nameIdx)
 	return nil
 }
 
@@ -671,7 +788,11 @@ func (c *Compiler) CompileCallExpr(call *ast.CallExpr) error {
 				return err
 			}
 		}
-		c.chunk.addOp2(OP_CALL, Op(len(call.Args)), call.StartLine())
+		var op Op = OP_CALL
+		if c.tailCalls[call] {
+			op = OP_TAIL_CALL
+		}
+		c.chunk.addOp(op, call.GetArea(), len(call.Args))
 		return nil
 	}
 
@@ -690,7 +811,7 @@ func (c *Compiler) CompileCallExpr(call *ast.CallExpr) error {
 			}
 		}
 		nameId := c.getOrSetName(attr.Attr.Name)
-		c.chunk.addOp3(OP_CALL_METHOD, Op(len(call.Args)), Op(nameId), call.StartLine())
+		c.chunk.addOp(OP_CALL_METHOD, call.GetArea(), len(call.Args), nameId)
 		return nil
 	}
 
@@ -707,13 +828,13 @@ func (c *Compiler) CompileCallExpr(call *ast.CallExpr) error {
 }
 
 func (c *Compiler) CompileFuncDefExpr(fn *ast.FuncDefExpr) error {
-	fnValue, err := compileFunction(fn, c)
+	fnValue, err := compileFunction(fn, c, c.options)
 	if err != nil {
 		return err
 	}
 
 	constId := c.chunk.addConst(fnValue)
-	c.chunk.addOp2(OP_MAKE_CLOSURE, constId, fn.StartLine())
+	c.chunk.addOp(OP_MAKE_CLOSURE, fn.GetArea(), constId)
 
 	if fn.Ident == nil {
 		// anonymous function
@@ -722,16 +843,16 @@ func (c *Compiler) CompileFuncDefExpr(fn *ast.FuncDefExpr) error {
 
 	nameId := c.getOrSetName(fn.Ident.Name)
 	if fn.ClassParam == nil {
-		c.chunk.addOp2(OP_PUT_GLOBAL_NAME, Op(nameId), fn.StartLine())
+		c.chunk.addOp(OP_PUT_GLOBAL_NAME, fn.GetArea(), nameId)
 	} else {
 		if len(fnValue.CaptureSlots) > 0 {
 			panic("No capture slots expected in method!")
 		}
 		classNameId := c.getOrSetName(fn.ClassParam.Type.Name)
-		c.chunk.addOp3(OP_SET_METHOD, Op(classNameId), Op(nameId), fn.StartLine())
+		c.chunk.addOp(OP_SET_METHOD, fn.GetArea(), classNameId, nameId)
 	}
 
-	c.chunk.addOp1(OP_NIL, fn.StartLine())
+	c.chunk.addOp1(OP_NIL, fn.GetArea())
 	return nil
 }
 
@@ -739,22 +860,62 @@ func (c *Compiler) CompileTypeDefExpr(tp *ast.TypeDefExpr) error {
 	name := tp.Ident.Name
 
 	attributes := make([]string, 0, len(tp.Params))
+	var attributeTypes []string = nil
 	for _, param := range tp.Params {
 		attributes = append(attributes, param.Name.Name)
 	}
+	if c.options.TypeChecks {
+		attributeTypes = make([]string, 0, len(tp.Params))
+		for _, param := range tp.Params {
+			if param.Type != nil {
+				attributeTypes = append(attributeTypes, param.Type.Name)
+			} else {
+				attributeTypes = append(attributeTypes, "")
+			}
+		}
+	}
 
-	typeValue := NewTypeValue(&Type{name, FunctionMap{}, attributes})
-	c.CompileConstant(typeValue, tp.StartLine())
+	typeValue := NewTypeValue(&Type{Name: name, Attributes: attributes, AttributeTypes: attributeTypes})
+	c.CompileConstant(typeValue, tp.GetArea())
 	nameId := c.getOrSetName(name)
-	c.chunk.addOp2(OP_PUT_GLOBAL_NAME, Op(nameId), tp.StartLine())
-	c.chunk.addOp1(OP_NIL, tp.StartLine())
+	c.chunk.addOp(OP_PUT_GLOBAL_NAME, tp.GetArea(), nameId)
+	c.chunk.addOp1(OP_NIL, tp.GetArea())
 	return nil
 }
 
-// Retuns an id that is used by the setPlaceholder function
-func (c *Compiler) addJumpToPlaceholder(jumpOp Op, line int) int {
-	c.chunk.addOp3(jumpOp, Op(0x98), Op(0x76), line)
-	idx := c.chunk.currentPos() - 2
+func (c *Compiler) CompileEffectDefExpr(effect *ast.EffectDefExpr) error {
+	value := &EffectValue{Name: effect.Ident.Name}
+	for _, param := range effect.Params {
+		value.Params = append(value.Params, param.Name.Name)
+	}
+	if c.options.TypeChecks {
+		value.ParamTypes = make([]string, 0, len(effect.Params))
+		for _, param := range effect.Params {
+			if param.Type != nil {
+				value.ParamTypes = append(value.ParamTypes, param.Type.Name)
+			} else {
+				value.ParamTypes = append(value.ParamTypes, "")
+			}
+		}
+		if effect.ReturnType != nil {
+			value.ReturnType = effect.ReturnType.Name
+		}
+	}
+
+	c.CompileConstant(value, effect.GetArea())
+	c.chunk.addOp1(OP_DECLARE_EFFECT, effect.GetArea())
+	c.chunk.addOp1(OP_NIL, effect.GetArea())
+	return nil
+}
+
+// Magic value of jump operands that haven't been set yet
+const JUMP_PLACEHOLDER = 0x76543210
+
+// Retuns an id that is used by the setPlaceholder function. The jump is the
+// last operand, after args
+func (c *Compiler) addJumpToPlaceholder(jumpOp Op, area lexer.Area, args ...int) int {
+	c.chunk.addOp(jumpOp, area, append(args, JUMP_PLACEHOLDER)...)
+	idx := c.chunk.currentPos() - 4
 	c.jumpPositions = append(c.jumpPositions, idx)
 	return len(c.jumpPositions) - 1
 }
@@ -768,9 +929,9 @@ func (c *Compiler) setPlaceholder(placeholderId, jumpDestIdx int) {
 	}
 
 	// jump from position after placeholder
-	offset := jumpDestIdx - (idx + 2)
+	offset := jumpDestIdx - (idx + 4)
 
-	if offset > (1 << 16) {
+	if offset > MAX_OPERAND {
 		panic("Too long jump")
 	}
 
@@ -778,17 +939,16 @@ func (c *Compiler) setPlaceholder(placeholderId, jumpDestIdx int) {
 		panic("Negative jump")
 	}
 
-	if c.chunk.Code[idx] != Op(0x98) || c.chunk.Code[idx+1] != Op(0x76) {
-		panic("Placeholder does not contain magic values 0x98 0x76")
+	if c.chunk.readBytes4(idx) != JUMP_PLACEHOLDER {
+		panic(fmt.Sprintf("Placeholder does not contain magic value %x", JUMP_PLACEHOLDER))
 	}
 
-	c.chunk.Code[idx] = Op(uint8(offset >> 8))
-	c.chunk.Code[idx+1] = Op(uint8(offset))
+	c.chunk.setBytes4(idx, offset)
 	c.jumpPositions[placeholderId] = -1
 }
 
 func (c *Compiler) CompileTryExpr(try *ast.TryExpr) error {
-	jumpToTryStart := c.addJumpToPlaceholder(OP_JUMP, try.StartLine())
+	jumpToTryStart := c.addJumpToPlaceholder(OP_JUMP, try.GetArea())
 
 	jumpToEnds := []int{}
 	handlers := []string{}
@@ -797,62 +957,98 @@ func (c *Compiler) CompileTryExpr(try *ast.TryExpr) error {
 		c.scopeBegin()
 		handlers = append(handlers, handler.Pattern.Ident.Name)
 		handlerStarts = append(handlerStarts, c.chunk.currentPos())
-		contName := "__cont__"
+
+		// Keep the continuation in a hidden slot for OP_HANDLER_END
+		contSlot := c.createScopedLocal("__cont__")
 		if handler.Pattern.Name != nil {
-			contName = handler.Pattern.Name.Name
-		}
-		slot := c.createScopedLocal(contName)
-		isHeap, ok := c.heapLookupTable[slot]
-		if ok && isHeap {
-			c.chunk.addOp2(OP_PUT_SLOT_HEAP, Op(slot), handler.StartLine())
+			c.chunk.addOp1(OP_COPY, handler.GetArea())
+			c.chunk.addOp(OP_PUT_SLOT, handler.GetArea(), contSlot)
+			c.compilePutScopedLocal(handler.Pattern.Name.Name, handler.GetArea())
 		} else {
-			c.chunk.addOp2(OP_PUT_SLOT, Op(slot), handler.StartLine())
+			c.chunk.addOp(OP_PUT_SLOT, handler.GetArea(), contSlot)
 		}
 
 		for _, param := range handler.Pattern.Params {
-			slot := c.createScopedLocal(param.Name.Name)
-			isHeap, ok := c.heapLookupTable[slot]
-			if ok && isHeap {
-				c.chunk.addOp2(OP_PUT_SLOT_HEAP, Op(slot), handler.StartLine())
-			} else {
-				c.chunk.addOp2(OP_PUT_SLOT, Op(slot), handler.StartLine())
-			}
+			c.compilePutScopedLocal(param.Name.Name, handler.GetArea())
 		}
 
 		if err := c.CompileBlockExpr(handler.Then); err != nil {
 			return err
 		}
 
-		// Maybe clean up the continuation here?
+		c.chunk.addOp(OP_LOAD_SLOT, try.GetArea(), contSlot)
+		c.chunk.addOp1(OP_HANDLER_END, try.GetArea())
 
 		// Jump to end
-		jumpToEnds = append(jumpToEnds, c.addJumpToPlaceholder(OP_JUMP, try.StartLine()))
+		jumpToEnds = append(jumpToEnds, c.addJumpToPlaceholder(OP_JUMP, try.GetArea()))
 		c.scopeEnd()
 	}
 
+	finallyStart := c.chunk.currentPos()
+	if try.FinallyBlock != nil {
+		// The finally block run on aborts, the normal exit runs an inlined copy
+		if err := c.CompileBlockExpr(try.FinallyBlock); err != nil {
+			return err
+		}
+		c.chunk.addOp1(OP_END_FINALLY, try.FinallyBlock.GetArea())
+	}
+
 	c.setPlaceholder(jumpToTryStart, c.chunk.currentPos())
 
+	if try.FinallyBlock != nil {
+		c.chunk.addOp(OP_SET_FINALLY, try.GetArea(), finallyStart)
+	}
+
 	for i, handler := range handlers {
 		// Set handler
 		nameIdx := c.getOrSetName(handler)
-		pos1, pos2 := twoBytes(handlerStarts[i])
-		c.chunk.addOp4(OP_SET_HANDLER, Op(nameIdx), Op(pos1), Op(pos2), try.StartLine())
+		c.chunk.addOp(OP_SET_HANDLER, try.GetArea(), nameIdx, handlerStarts[i], i)
 	}
 
 	if err := c.CompileExpr(try.TryBlock); err != nil {
 		return err
 	}
 
-	c.chunk.addOp2(OP_POP_HANDLERS, Op(len(try.HandleBlock)), try.StartLine())
+	c.chunk.addOp(OP_POP_HANDLERS, try.GetArea(), len(try.HandleBlock))
+
+	// The return clause gets the value of the try block, but not the values
+	// of the handlers. It runs outside the handlers.
+	if try.ReturnCase != nil {
+		c.scopeBegin()
+		c.compilePutScopedLocal(try.ReturnCase.Pattern.Params[0].Name.Name, try.ReturnCase.GetArea())
+		if err := c.CompileBlockExpr(try.ReturnCase.Then); err != nil {
+			return err
+		}
+		c.scopeEnd()
+	}
 
 	endPos := c.chunk.currentPos()
 	for _, endJump := range jumpToEnds {
 		c.setPlaceholder(endJump, endPos)
 	}
 
+	if try.FinallyBlock != nil {
+		c.chunk.addOp(OP_POP_HANDLERS, try.GetArea(), 1)
+		if err := c.CompileBlockExpr(try.FinallyBlock); err != nil {
+			return err
+		}
+		c.chunk.addOp1(OP_POP, try.FinallyBlock.GetArea())
+	}
+
 	return nil
 }
 
+// Pop top of stack into a new local in the current scope
+func (c *Compiler) compilePutScopedLocal(name string, area lexer.Area) {
+	slot := c.createScopedLocal(name)
+	isHeap, ok := c.heapLookupTable[slot]
+	if ok && isHeap {
+		c.chunk.addOp(OP_PUT_SLOT_HEAP, area, slot)
+	} else {
+		c.chunk.addOp(OP_PUT_SLOT, area, slot)
+	}
+}
+
 func (c *Compiler) CompileDoExpr(do *ast.DoExpr) error {
 	for _, expr := range do.Arguments {
 		err := c.CompileExpr(expr)
@@ -860,8 +1056,8 @@ func (c *Compiler) CompileDoExpr(do *ast.DoExpr) error {
 			return err
 		}
 	}
-	c.CompileConstant(NewString(do.Ident.Name), do.Ident.StartLine())
-	c.chunk.addOp2(OP_DO, Op(len(do.Arguments)), do.StartLine())
+	c.CompileConstant(NewString(do.Ident.Name), do.Ident.GetArea())
+	c.chunk.addOp(OP_DO, do.GetArea(), len(do.Arguments))
 	return nil
 }
 
@@ -871,7 +1067,7 @@ func (c *Compiler) CompileIfExpr(iff *ast.IfExpr) error {
 		return err
 	}
 	// Jump to next part
-	lastCondFailed := c.addJumpToPlaceholder(OP_JUMP_IF_FALSE, iff.StartLine())
+	lastCondFailed := c.addJumpToPlaceholder(OP_JUMP_IF_FALSE, iff.GetArea())
 
 	err = c.CompileExpr(iff.ElifParts[0].Then)
 	if err != nil {
@@ -882,7 +1078,7 @@ func (c *Compiler) CompileIfExpr(iff *ast.IfExpr) error {
 
 	for _, elif := range iff.ElifParts[1:] {
 		// Jump to end if previous block ran
-		endJump := c.addJumpToPlaceholder(OP_JUMP, iff.StartLine())
+		endJump := c.addJumpToPlaceholder(OP_JUMP, iff.GetArea())
 		endJumpPlaceholders = append(endJumpPlaceholders, endJump)
 
 		// Jump to here if previous cond failed
@@ -893,7 +1089,7 @@ func (c *Compiler) CompileIfExpr(iff *ast.IfExpr) error {
 			return err
 		}
 		// Jump to next part
-		lastCondFailed = c.addJumpToPlaceholder(OP_JUMP_IF_FALSE, iff.StartLine())
+		lastCondFailed = c.addJumpToPlaceholder(OP_JUMP_IF_FALSE, iff.GetArea())
 
 		err = c.CompileExpr(elif.Then)
 		if err != nil {
@@ -903,7 +1099,7 @@ func (c *Compiler) CompileIfExpr(iff *ast.IfExpr) error {
 
 	if iff.Else != nil {
 		// Skip else if previous condition succeeded
-		endJump := c.addJumpToPlaceholder(OP_JUMP, iff.StartLine())
+		endJump := c.addJumpToPlaceholder(OP_JUMP, iff.GetArea())
 		endJumpPlaceholders = append(endJumpPlaceholders, endJump)
 
 		// Jump to here if previous cond failed
@@ -920,43 +1116,121 @@ func (c *Compiler) CompileIfExpr(iff *ast.IfExpr) error {
 		}
 	} else {
 		// No else block, we return NIL from expr
-		c.chunk.addOp1(OP_POP, iff.StartLine())
+		c.chunk.addOp1(OP_POP, iff.GetArea())
 		c.setPlaceholder(lastCondFailed, c.chunk.currentPos())
 		for _, jumpPlaceholder := range endJumpPlaceholders {
 			c.setPlaceholder(jumpPlaceholder, c.chunk.currentPos())
 		}
-		c.chunk.addOp1(OP_NIL, iff.StartLine())
+		c.chunk.addOp1(OP_NIL, iff.GetArea())
 	}
 	return nil
 }
 
 func (c *Compiler) CompileForExpr(forr *ast.ForExpr) error {
+	c.beginLoop(forr.GetArea())
 	startIdx := c.chunk.currentPos()
 
 	err := c.CompileExpr(forr.Cond)
 	if err != nil {
 		return err
 	}
-	jumpToEnd := c.addJumpToPlaceholder(OP_JUMP_IF_FALSE, forr.StartLine())
+	jumpToEnd := c.addJumpToPlaceholder(OP_JUMP_IF_FALSE, forr.GetArea())
 
 	err = c.CompileExpr(forr.Then)
 	if err != nil {
 		return err
 	}
-	c.chunk.addOp1(OP_POP, forr.StartLine())
+	c.chunk.addOp1(OP_POP, forr.GetArea())
+
+	continueIdx := c.chunk.currentPos()
+	c.chunk.addOp(OP_LOOP, forr.GetArea(), c.chunk.currentPos()+Op(OP_LOOP).Size()-startIdx)
+	c.setPlaceholder(jumpToEnd, c.chunk.currentPos())
+
+	c.chunk.addOp1(OP_NIL, forr.GetArea())
+	c.endLoop(continueIdx)
+
+	return nil
+}
+
+// The iterator is kept in a hidden local while the loop runs, and the loop
+// variable is assigned like any other local
+func (c *Compiler) CompileForInExpr(forr *ast.ForInExpr) error {
+	if err := c.CompileExpr(forr.Iterable); err != nil {
+		return err
+	}
+	c.chunk.addOp1(OP_ITER, forr.Iterable.GetArea())
+	iterSlot := c.getOrCreateLocalVar(fmt.Sprintf("<iter %d>", len(c.chunk.LocalNames)))
+	c.chunk.addOp(OP_PUT_SLOT, forr.GetArea(), iterSlot)
+	c.beginLoop(forr.GetArea())
+
+	startIdx := c.chunk.currentPos()
+	c.chunk.addOp(OP_LOAD_SLOT, forr.GetArea(), iterSlot)
+	jumpToEnd := c.addJumpToPlaceholder(OP_ITER_NEXT, forr.GetArea())
+	if err := c.compileDestructureAssign(forr.Var); err != nil {
+		return err
+	}
 
-	jump1, jump2 := twoBytes(c.chunk.currentPos() + 3 - startIdx)
-	c.chunk.addOp3(OP_LOOP, Op(jump1), Op(jump2), forr.StartLine())
+	if err := c.CompileExpr(forr.Then); err != nil {
+		return err
+	}
+	c.chunk.addOp1(OP_POP, forr.GetArea())
+
+	continueIdx := c.chunk.currentPos()
+	c.chunk.addOp(OP_LOOP, forr.GetArea(), c.chunk.currentPos()+Op(OP_LOOP).Size()-startIdx)
 	c.setPlaceholder(jumpToEnd, c.chunk.currentPos())
 
-	c.chunk.addOp1(OP_NIL, forr.StartLine())
+	c.chunk.addOp1(OP_NIL, forr.GetArea())
+	c.endLoop(continueIdx)
+
+	return nil
+}
+
+// Mark the start of a loop that break and continue can exit
+func (c *Compiler) beginLoop(area lexer.Area) {
+	slot := c.getOrCreateLocalVar(fmt.Sprintf("<loop %d>", len(c.chunk.LocalNames)))
+	c.chunk.addOp(OP_LOOP_MARK, area, slot)
+	c.loops = append(c.loops, &loop{markSlot: slot})
+}
+
+// End the innermost loop at the current position, which break jumps to.
+// Continue jumps to continueIdx.
+func (c *Compiler) endLoop(continueIdx int) {
+	l := c.loops[len(c.loops)-1]
+	c.loops = c.loops[:len(c.loops)-1]
+	for _, id := range l.continues {
+		c.setPlaceholder(id, continueIdx)
+	}
+	for _, id := range l.breaks {
+		c.setPlaceholder(id, c.chunk.currentPos())
+	}
+}
 
+func (c *Compiler) CompileBreakExpr(brk *ast.BreakExpr) error {
+	if len(c.loops) == 0 {
+		return codeError(brk, "'break' outside of a loop")
+	}
+	if brk.Value == nil {
+		c.chunk.addOp1(OP_NIL, brk.GetArea())
+	} else if err := c.CompileExpr(brk.Value); err != nil {
+		return err
+	}
+	l := c.loops[len(c.loops)-1]
+	l.breaks = append(l.breaks, c.addJumpToPlaceholder(OP_BREAK, brk.GetArea(), l.markSlot))
+	return nil
+}
+
+func (c *Compiler) CompileContinueExpr(cont *ast.ContinueExpr) error {
+	if len(c.loops) == 0 {
+		return codeError(cont, "'continue' outside of a loop")
+	}
+	l := c.loops[len(c.loops)-1]
+	l.continues = append(l.continues, c.addJumpToPlaceholder(OP_CONTINUE, cont.GetArea(), l.markSlot))
 	return nil
 }
 
 func (c *Compiler) CompileResumeExpr(resume *ast.ResumeExpr) error {
 	if resume.Value == nil {
-		c.chunk.addOp1(OP_NIL, resume.StartLine())
+		c.chunk.addOp1(OP_NIL, resume.GetArea())
 	} else {
 		err := c.CompileExpr(resume.Value)
 		if err != nil {
@@ -966,56 +1240,86 @@ func (c *Compiler) CompileResumeExpr(resume *ast.ResumeExpr) error {
 	if err := c.CompileIdent(resume.Ident); err != nil {
 		return err
 	}
-	c.chunk.addOp1(OP_RESUME, resume.StartLine())
+	c.chunk.addOp1(OP_RESUME, resume.GetArea())
 
 	return nil
 }
 
-func (c *Compiler) MoveToHeap(slotId uint8) {
+func (c *Compiler) MoveToHeap(slotId int) {
 	c.heapLookupTable[slotId] = true
 	i := 0
 	for i < len(c.chunk.Code) {
-		if c.chunk.Code[i] == OP_PUT_SLOT {
-			if uint8(c.chunk.Code[i+1]) == slotId {
-				c.chunk.Code[i] = OP_PUT_SLOT_HEAP
-			}
-		}
-		if c.chunk.Code[i] == OP_LOAD_SLOT {
-			if uint8(c.chunk.Code[i+1]) == slotId {
-				c.chunk.Code[i] = OP_LOAD_SLOT_HEAP
-			}
+		op, args, size := c.chunk.decode(i)
+		// the op comes after the OP_WIDE prefix of wide instructions
+		opIdx := i + size - op.size(size > op.Size())
+		if op == OP_PUT_SLOT && args[0] == slotId {
+			c.chunk.Code[opIdx] = OP_PUT_SLOT_HEAP
 		}
-		if c.chunk.Code[i].Size() <= 0 {
-			println("name")
-			println(c.chunk.Code[i].String())
-			panic("foo")
+		if op == OP_LOAD_SLOT && args[0] == slotId {
+			c.chunk.Code[opIdx] = OP_LOAD_SLOT_HEAP
 		}
-		i += c.chunk.Code[i].Size()
+		i += size
 	}
 }
 
-func twoBytes(n int) (uint8, uint8) {
-	if n < 0 || (n&0x0000) != 0 {
-		panic(fmt.Sprintf("Expected uint16, got %d", n))
-	}
-	return uint8((n >> 8) & 0xff), uint8(n & 0xff)
-}
-
 func (c *Compiler) CompileReturnExpr(ret *ast.ReturnExpr) error {
 	if ret.Value == nil {
-		c.chunk.addOp1(OP_RETURN_NIL, ret.StartLine())
+		if c.returnType == "" {
+			c.chunk.addOp1(OP_RETURN_NIL, ret.GetArea())
+			return nil
+		}
+		c.chunk.addOp1(OP_NIL, ret.GetArea())
+		c.macroReturn(ret.GetArea())
 		return nil
 	}
 
+	c.markTailCalls(ret.Value)
 	err := c.CompileExpr(ret.Value)
 	if err != nil {
 		return err
 	}
-	c.chunk.addOp1(OP_RETURN, ret.StartLine())
+	c.macroReturn(ret.GetArea())
 
 	return nil
 }
 
+// Mark the calls whose result is returned from expr without anything else
+// being done in the function. The return type check has to be done after the
+// call, so there are no tail calls in functions with a return type.
+func (c *Compiler) markTailCalls(expr ast.Expr) {
+	if c.returnType != "" {
+		return
+	}
+	switch v := expr.(type) {
+	case *ast.CallExpr:
+		c.tailCalls[v] = true
+	case *ast.BlockExpr:
+		if len(v.Children) > 0 {
+			c.markTailCalls(v.Children[len(v.Children)-1])
+		}
+	case *ast.ParenthExpr:
+		c.markTailCalls(v.Inside)
+	case *ast.IfExpr:
+		// Without an else block the if evaluates to nil
+		if v.Else != nil {
+			for _, elif := range v.ElifParts {
+				c.markTailCalls(elif.Then)
+			}
+			c.markTailCalls(v.Else)
+		}
+	}
+}
+
+// Return top of stack, checking it against the return type annotation if there is one
+func (c *Compiler) macroReturn(area lexer.Area) {
+	if c.returnType != "" {
+		nameIdx := c.getOrSetName(c.returnType)
+		c.chunk.addOp(OP_LOAD_GLOBAL_NAME, area, nameIdx)
+		c.chunk.addOp1(OP_CHECK_RETURN, area)
+	}
+	c.chunk.addOp1(OP_RETURN, area)
+}
+
 func (c *Compiler) CompileAttrExpr(attr *ast.AttrExpr) error {
 	err := c.CompileExpr(attr.Lhs)
 	if err != nil {
@@ -1023,7 +1327,7 @@ func (c *Compiler) CompileAttrExpr(attr *ast.AttrExpr) error {
 	}
 
 	nameId := c.getOrSetName(attr.Attr.Name)
-	c.chunk.addOp2(OP_ATTR, Op(nameId), attr.StartLine())
+	c.chunk.addOp(OP_ATTR, attr.GetArea(), nameId)
 
 	return nil
 
@@ -1,11 +1,21 @@
 package interpret
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/rymdhund/wosh/ast"
 	"github.com/rymdhund/wosh/lexer"
 	"github.com/rymdhund/wosh/parser"
+	"github.com/rymdhund/wosh/sandbox"
 )
 
 func parseMain(prog string) (*ast.FuncDefExpr, error) {
@@ -756,3 +766,1715 @@ func TestSmall(t *testing.T) {
 		assertRes(t, prog, expected)
 	}
 }
+
+func TestParamTypeCheck(t *testing.T) {
+	assertInt(t, "fn f(x: Int) { x + 1 }\nf(1)", 2)
+	assertRes(t, "fn f(x: Str, y) { x + y }\nf('a', 'b')", NewString("ab"))
+	assertInt(t, "type Foo(a)\nfn f(x: Foo) { x.a }\nf(Foo(3))", 3)
+	assertInt(t, "fn f(x: Int) { fn g() { x } \n g() }\nf(4)", 4)
+	assertRuntimeError(t, "fn f(x: Int) { x }\nf('a')")
+	assertRuntimeError(t, "fn f(x, y: Str) { x }\nf(1, 2)")
+	assertRuntimeError(t, "f = (x: Int) => x\nf(())")
+
+	main, err := parseMain("fn foo(bar: Int) { bar }\nfoo('a')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	function, err := Compile(main)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewVm().Interpret(function)
+	if err == nil {
+		t.Fatal("Expected type error")
+	}
+	for _, part := range []string{"'foo'", "'bar'", "Int", "Str"} {
+		if !strings.Contains(err.Error(), part) {
+			t.Errorf("Expected type error to mention %s, got: %s", part, err)
+		}
+	}
+}
+
+func TestParamTypeCheckDisabled(t *testing.T) {
+	main, err := parseMain("fn f(x: Int) { x }\nf('a')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	function, err := CompileWithOptions(main, CompileOptions{TypeChecks: false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := NewVm().Interpret(function)
+	if err != nil {
+		t.Fatalf("Expected no error with type checks disabled, got: %s", err)
+	}
+	if !testEqual(v, NewString("a")) {
+		t.Errorf("Expected \"a\", got %s", v)
+	}
+}
+
+func TestReturnTypeCheck(t *testing.T) {
+	assertRes(t, "fn f(x: Int) -> Str { str(x) }\nf(1)", NewString("1"))
+	assertInt(t, "fn f(x) -> Int { if x { return 1 } \n 2 }\nf(true)", 1)
+	assertInt(t, "fn f(x) -> Int { if x { return 1 } \n 2 }\nf(false)", 2)
+	assertRes(t, "fn f() -> Nil { return }\nf()", Nil)
+	assertRes(t, "fn f() { return }\nf()", Nil)
+	assertRuntimeError(t, "fn f(x) -> Str { x }\nf(1)")
+	assertRuntimeError(t, "fn f(x) -> Str { return x }\nf(1)")
+	assertRuntimeError(t, "fn f() -> Int { return }\nf()")
+}
+
+func TestTypedAttributes(t *testing.T) {
+	assertInt(t, "type Coord(x: Int, y: Int)\nc = Coord(1, 2)\nc.x + c.y", 3)
+	assertRes(t, "type Named(name: Str, value)\nNamed('a', 1).name", NewString("a"))
+	assertRuntimeError(t, "type Coord(x: Int, y: Int)\nCoord(1, 'a')")
+	assertRuntimeError(t, "type Wrap(inner: Coord)\ntype Coord(x: Int, y: Int)\nWrap(1)")
+}
+
+func TestListMethods(t *testing.T) {
+	assertRes(t, "str([1, 2, 3].map((x) => x * 2))", NewString("list(2, 4, 6)"))
+	assertRes(t, "str([1, 2, 3, 4].filter((x) => x % 2 == 0))", NewString("list(2, 4)"))
+	assertInt(t, "[1, 2, 3].fold(0, (acc, x) => acc + x)", 6)
+	assertRes(t, "str([3, 1, 2].sort())", NewString("list(1, 2, 3)"))
+	assertRes(t, "str(['b', 'c', 'a'].sort())", NewString(`list("a", "b", "c")`))
+	assertRes(t, "str(['ccc', 'a', 'bb'].sort_by((s) => len(s)))", NewString(`list("a", "bb", "ccc")`))
+	assertRes(t, "str([1, 3, 2].sort_with((a, b) => b < a))", NewString("list(3, 2, 1)"))
+	assertRes(t, "str([1, 2, 3].reverse())", NewString("list(3, 2, 1)"))
+	assertTrue(t, "[1, 2, 3].contains(2)")
+	assertFalse(t, "['a'].contains('b')")
+	assertInt(t, "['a', 'b'].index('b')", 1)
+	assertInt(t, "['a', 'b'].index('c')", -1)
+	assertRes(t, "str([1, 2, 3].zip(['a', 'b']))", NewString(`list(list(1, "a"), list(2, "b"))`))
+	assertRes(t, "str(['a', 'b'].enumerate())", NewString(`list(list(0, "a"), list(1, "b"))`))
+	assertRes(t, "str(List.map([1], (x) => x + 1))", NewString("list(2)"))
+	assertInt(t, "fn f(n) { [1, 2].fold(0, (acc, x) => acc + x + n) }\nf(10)", 23)
+	assertInt(t, "fn double(x) { return x * 2 }\n[1, 2].map(double)[1]", 4)
+	assertRes(t, `
+	fn catch(x) {
+		y = 0
+		try {
+			do yield(x)
+		} handle {
+			yield(v) -> { y = v + 1 }
+		}
+		y
+	}
+	str([1, 2].map(catch))
+	`, NewString("list(2, 3)"))
+	assertRuntimeError(t, "[1, 'a'].sort()")
+	assertRuntimeError(t, "[1, 2].filter((x) => x)")
+	assertRuntimeError(t, "[1, 2].map(3)")
+	assertRuntimeError(t, "List.map(1, (x) => x)")
+}
+
+func TestStringMethods(t *testing.T) {
+	assertRes(t, "str('a,b,c'.split(','))", NewString(`list("a", "b", "c")`))
+	assertRes(t, "','.join(['a', 'b', 'c'])", NewString("a,b,c"))
+	assertRes(t, "str(' a  b\n'.split())", NewString(`list("a", "b")`))
+	assertRes(t, "'  a b \n'.trim()", NewString("a b"))
+	assertRes(t, "'aXbX'.replace('X', 'y')", NewString("ayby"))
+	assertInt(t, "'åäö'.find('ö')", 2)
+	assertInt(t, "'abc'.find('x')", -1)
+	assertRes(t, "'abc'.upper()", NewString("ABC"))
+	assertRes(t, "'ABC'.lower()", NewString("abc"))
+	assertTrue(t, "'abc'.starts_with('ab')")
+	assertFalse(t, "'abc'.ends_with('ab')")
+	assertRes(t, "str('åb'.chars())", NewString(`list("å", "b")`))
+	assertRes(t, "'ab'.repeat(3)", NewString("ababab"))
+	assertRuntimeError(t, "','.join([1, 2])")
+	assertRuntimeError(t, "'a'.repeat('b')")
+}
+
+func TestMapMethods(t *testing.T) {
+	assertRes(t, "str({'b': 2, 'a': 1}.keys())", NewString(`list("a", "b")`))
+	assertRes(t, "str({'b': 2, 'a': 1}.values())", NewString("list(1, 2)"))
+	assertTrue(t, "{'a': 1}.has('a')")
+	assertFalse(t, "{'a': 1}.has('b')")
+	assertFalse(t, "m = {'a': 1}\nm.delete('a')\nm.has('a')")
+	assertInt(t, "{'a': 1}.get('a', 0)", 1)
+	assertInt(t, "{'a': 1}.get('b', 0)", 0)
+	assertRes(t, "{'a': 1}.get('b')", Nil)
+	assertTrue(t, "{'a': 1} == {'a': 1}")
+	assertFalse(t, "{'a': 1} == {'a': 2}")
+}
+
+func TestCallFromGo(t *testing.T) {
+	main, err := parseMain("fn add(a, b) { a + b }\ntype Pair(a, b)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	function, err := Compile(main)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := NewVm()
+	if _, err := vm.Interpret(function); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := vm.Call(vm.globals["add"], NewInt(1), NewInt(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !testEqual(res, NewInt(3)) {
+		t.Errorf("expected 3, got %s", res)
+	}
+
+	res, err = vm.Call(vm.globals["len"], NewString("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !testEqual(res, NewInt(3)) {
+		t.Errorf("expected 3, got %s", res)
+	}
+
+	res, err = vm.Call(vm.globals["Pair"], NewInt(1), NewInt(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Type().Name != "Pair" {
+		t.Errorf("expected Pair, got %s", res)
+	}
+
+	if _, err := vm.Call(NewInt(1)); err == nil {
+		t.Error("expected error when calling an int")
+	}
+	if _, err := vm.Call(vm.globals["add"], NewInt(1), NewString("a")); err == nil {
+		t.Error("expected error from add")
+	}
+}
+
+// Calls f from go code on each item of a list, collecting the results
+func testEach(vm *VM, args []Value) (Value, error) {
+	lst := args[0].(*ListValue)
+	res := make([]Value, lst.Len())
+	for i := range res {
+		item, _ := lst.Get(i)
+		v, err := vm.Call(args[1], item)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = v
+	}
+	list := ListNil()
+	for i := len(res) - 1; i >= 0; i-- {
+		list = ListCons(res[i], list)
+	}
+	return list, nil
+}
+
+// Run prog in a vm with the builtin each(lst, f), which calls f from go code
+func runEach(t *testing.T, prog string) (Value, error) {
+	t.Helper()
+	main, err := parseMain(prog)
+	if err != nil {
+		t.Fatalf("Error parsing `%s`: %s", prog, err)
+	}
+	function, err := Compile(main)
+	if err != nil {
+		t.Fatalf("Error compiling `%s`: %s", prog, err)
+	}
+	vm := NewVm()
+	vm.globals["each"] = NewBuiltin("each", 2, NativeFunction(testEach))
+	return vm.Interpret(function)
+}
+
+func assertEach(t *testing.T, prog string, res Value) {
+	t.Helper()
+	v, err := runEach(t, prog)
+	if err != nil {
+		t.Fatalf("Error running `%s`: %s", prog, err)
+	}
+	if !testEqual(res, v) {
+		t.Errorf("Incorrect result on running `%s`, expected %s, got %s", prog, res, v)
+	}
+}
+
+func assertEachError(t *testing.T, prog string) {
+	t.Helper()
+	if _, err := runEach(t, prog); err == nil {
+		t.Errorf("Expected error when running `%s`", prog)
+	}
+}
+
+func TestEffectsAcrossGoCalls(t *testing.T) {
+	// Handler finishes without resuming
+	assertEach(t, `
+	fn check(x) {
+		if x == 2 {
+			do stop(x)
+		}
+		x
+	}
+	fn f() {
+		try {
+			each([1, 2, 3], check)
+		} handle {
+			stop(x) -> { x * 10 }
+		}
+	}
+	f() + 1
+	`, NewInt(21))
+
+	// Handler resumes into the go call
+	assertEach(t, `
+	fn check(x) {
+		do double(x)
+	}
+	fn f() {
+		try {
+			each([1, 2], check)
+		} handle {
+			double(x) @ k -> { resume k x * 2 }
+		}
+	}
+	str(f())
+	`, NewString("list(2, 4)"))
+
+	// Unwind through nested go calls
+	assertEach(t, `
+	fn check(x) {
+		do stop(x)
+	}
+	fn inner(lst) {
+		each(lst, check)
+	}
+	fn f() {
+		try {
+			each([[1], [2]], inner)
+		} handle {
+			stop(x) -> { x }
+		}
+	}
+	f()
+	`, NewInt(1))
+
+	// Return from the function of the handler
+	assertEach(t, `
+	fn check(x) {
+		do stop(x)
+	}
+	fn f() {
+		try {
+			each([5], check)
+		} handle {
+			stop(x) -> { return x }
+		}
+		0
+	}
+	f()
+	`, NewInt(5))
+
+	// Continuations can't be resumed after the go call has returned
+	assertEachError(t, `
+	fn check(x) {
+		do grab(x)
+	}
+	fn f() {
+		k2 = ()
+		try {
+			each([1], check)
+		} handle {
+			grab(x) @ k -> { k2 = k }
+		}
+		resume k2 1
+	}
+	f()
+	`)
+}
+
+func runWithGlobals(t *testing.T, prog string, globals map[string]Value) (Value, error) {
+	t.Helper()
+	main, err := parseMain(prog)
+	if err != nil {
+		t.Fatalf("Error parsing `%s`: %s", prog, err)
+	}
+	function, err := Compile(main)
+	if err != nil {
+		t.Fatalf("Error compiling `%s`: %s", prog, err)
+	}
+	vm := NewVm()
+	for name, v := range globals {
+		vm.globals[name] = v
+	}
+	return vm.Interpret(function)
+}
+
+func TestBuiltinFromFunc(t *testing.T) {
+	globals := map[string]Value{
+		"pad": mustBuiltinFromFunc("pad", func(s string, n int) (string, error) {
+			if n < 0 {
+				return "", fmt.Errorf("negative padding")
+			}
+			return strings.Repeat(" ", n) + s, nil
+		}),
+		"sum": mustBuiltinFromFunc("sum", func(start int, nums ...int) int {
+			for _, n := range nums {
+				start += n
+			}
+			return start
+		}),
+		"firsts": mustBuiltinFromFunc("firsts", func(words []string) []string {
+			res := []string{}
+			for _, w := range words {
+				res = append(res, w[:1])
+			}
+			return res
+		}),
+		"ident":   mustBuiltinFromFunc("ident", func(v Value) Value { return v }),
+		"nothing": mustBuiltinFromFunc("nothing", func() {}),
+		"total": mustBuiltinFromFunc("total", func(counts map[string]int64) int64 {
+			var res int64
+			for _, n := range counts {
+				res += n
+			}
+			return res
+		}),
+	}
+	tests := []struct {
+		prog     string
+		expected Value
+	}{
+		{"pad('a', 2)", NewString("  a")},
+		{"sum(1)", NewInt(1)},
+		{"sum(1, 2, 3)", NewInt(6)},
+		{"str(firsts(['ab', 'cd']))", NewString(`list("a", "c")`)},
+		{"ident('x')", NewString("x")},
+		{"nothing()", Nil},
+		{"total({'a': 1, 'b': 2})", NewInt(3)},
+	}
+	for _, test := range tests {
+		v, err := runWithGlobals(t, test.prog, globals)
+		if err != nil {
+			t.Errorf("Error running `%s`: %s", test.prog, err)
+		} else if !testEqual(v, test.expected) {
+			t.Errorf("Incorrect result on running `%s`, expected %s, got %s", test.prog, test.expected, v)
+		}
+	}
+
+	errors := []string{
+		"pad('a', -1)",
+		"pad(1, 2)",
+		"pad('a')",
+		"sum()",
+		"sum(1, 'a')",
+		"firsts([1])",
+		"total({'a': 'x'})",
+	}
+	for _, prog := range errors {
+		_, err := runWithGlobals(t, prog, globals)
+		if _, ok := err.(*RuntimeError); !ok {
+			t.Errorf("Expected runtime error running `%s`, got %v", prog, err)
+		}
+	}
+
+	if _, err := NewBuiltinFromFunc("f", func(x float64) {}); err == nil {
+		t.Error("Expected error for unsupported parameter type")
+	}
+	if _, err := NewBuiltinFromFunc("f", func() (int, int) { return 1, 2 }); err == nil {
+		t.Error("Expected error for multiple results")
+	}
+	if _, err := NewBuiltinFromFunc("f", 1); err == nil {
+		t.Error("Expected error for non function")
+	}
+}
+
+func TestBuiltinErrors(t *testing.T) {
+	assertRuntimeError(t, "atoi('x')")
+	assertRuntimeError(t, "ord('ab')")
+	assertRuntimeError(t, "len(1)")
+	assertRuntimeError(t, "len('a', 'b')")
+	assertRuntimeError(t, "assert(false)")
+	assertRuntimeError(t, "assert(false, 'message')")
+	assertRuntimeError(t, "readlines('/nonexistent/file')")
+	assertRes(t, "assert(true)", Nil)
+	assertRes(t, "println('a', 1, [2])", Nil)
+}
+
+func TestMethodsArePerVm(t *testing.T) {
+	run(t, `
+	fn (lst: List) second() {
+		lst[1]
+	}
+	fn (lst: List) reverse() {
+		"overridden"
+	}
+	assert([1, 2].second() == 2, "second")
+	assert([1, 2].reverse() == "overridden", "reverse")
+	`)
+	assertRuntimeError(t, "[1, 2].second()")
+	assertRes(t, "str([1, 2].reverse())", NewString("list(2, 1)"))
+}
+
+func TestConcurrentVms(t *testing.T) {
+	main, err := parseMain(`
+	fn (n: Int) next(step) {
+		n + step
+	}
+	type Counter(n: Int)
+	fn (c: Counter) bump(step) {
+		Counter(c.n.next(step))
+	}
+	fn loop(c, step) {
+		i = 0
+		for i < 100 {
+			c = c.bump(step)
+			i = i + 1
+		}
+		c.n
+	}
+	loop(Counter(0), 1)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	function, err := Compile(main)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errors := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := NewVm().Interpret(function)
+			if err != nil {
+				errors <- err
+			} else if !testEqual(v, NewInt(100)) {
+				errors <- fmt.Errorf("expected 100, got %s", v)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errors)
+	for err := range errors {
+		t.Error(err)
+	}
+}
+
+func TestRuntimeErrorsInsteadOfPanics(t *testing.T) {
+	tests := []string{
+		"f = 1\nf()",
+		"type Foo(a)\nFoo(1, 2)",
+		"x = 1\ndo missing(1)",
+		"x = 1\nresume x 1",
+		"x = 1\natoi('abc')",
+		"x = 1\nreadlines('/nonexistent/file')",
+		"x = 1\nif 1 { 2 }",
+		"m = {}\nm[1] = 2",
+		"x = 1\n1 / 0",
+		"x = 1\n1 % 0",
+		"x = 1\n'abc'[3]",
+		"x = 1\n'abc'['a':]",
+		"x = 1\n[1, 2][0:1:2]",
+		"x = 1\n1[0:1]",
+		"x = 1\n-'a'",
+	}
+	for _, prog := range tests {
+		main, err := parseMain(prog)
+		if err != nil {
+			t.Fatalf("Error parsing `%s`: %s", prog, err)
+		}
+		function, err := Compile(main)
+		if err != nil {
+			t.Fatalf("Error compiling `%s`: %s", prog, err)
+		}
+		_, err = NewVm().Interpret(function)
+		rtErr, ok := err.(*RuntimeError)
+		if !ok {
+			t.Errorf("Expected runtime error running `%s`, got %v", prog, err)
+			continue
+		}
+		if rtErr.Line != 2 {
+			t.Errorf("Expected error on line 2 running `%s`, got %s", prog, err)
+		}
+	}
+
+	// Unsupported constructs are compile errors
+	main, err := parseMain("{1: 2}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Compile(main); err == nil {
+		t.Error("Expected compile error for non string map key")
+	}
+}
+
+func TestStringIndexing(t *testing.T) {
+	assertRes(t, "'abc'[-1]", NewString("c"))
+	assertRes(t, "'åäö'[-3]", NewString("å"))
+	assertRes(t, "'abc'[1:10]", NewString("bc"))
+	assertRes(t, "'abc'[-2:]", NewString("bc"))
+	assertRes(t, "'abc'[2:1]", NewString(""))
+}
+
+func TestRaise(t *testing.T) {
+	assertRes(t, `
+	fn foo() {
+		try {
+			raise("boom")
+			1
+		} handle {
+			exn(e) -> { "caught " + e.msg() }
+		}
+	}
+	foo()`, NewString("caught boom"))
+
+	// Runtime errors are raised as exceptions, also in nested calls
+	assertRes(t, `
+	fn div(a, b) { a / b }
+	fn foo() {
+		try {
+			1 + div(1, 0)
+		} handle {
+			exn(e) -> { e.msg() }
+		}
+	}
+	foo()`, NewString("Division by zero"))
+
+	// Undefined names are exceptions too, and run finally blocks
+	assertRes(t, `
+	fn foo(log) {
+		res = try {
+			try { undefined_name } finally { log["ran"] = 1 }
+		} handle {
+			exn(e) -> { e.msg() }
+		}
+		[res, log.get("ran")]
+	}
+	str(foo({}))`, NewString(`list("Not defined: undefined_name", 1)`))
+
+	// The innermost handler catches the exception
+	assertRes(t, `
+	fn foo() {
+		try {
+			try { raise("a") } handle { exn(e) -> { raise(e.msg() + "b") } }
+		} handle {
+			exn(e) -> { e.msg() }
+		}
+	}
+	foo()`, NewString("ab"))
+
+	// Exceptions pass through go code
+	assertRes(t, `
+	fn check(x) { if x == 2 { raise("two") } else { x } }
+	fn foo() {
+		try { [1, 2, 3].map(check) } handle { exn(e) -> { e.msg() } }
+	}
+	foo()`, NewString("two"))
+
+	// do exn(x) is the same as raise(x)
+	assertRes(t, `try { do exn("x") } handle { exn(e) -> { e.msg() } }`, NewString("x"))
+
+	_, err := runWithGlobals(t, `
+	try { raise("x") } handle { exn(e) @ k -> { resume k 1 } }`, nil)
+	if err == nil || !strings.Contains(err.Error(), "Exceptions can't be resumed") {
+		t.Errorf("Expected error resuming exception, got %v", err)
+	}
+
+	_, err = runWithGlobals(t, "x = 1\nraise('uncaught')", nil)
+	rtErr, ok := err.(*RuntimeError)
+	if !ok || rtErr.Msg != "uncaught" || rtErr.Line != 2 || rtErr.Exn == nil {
+		t.Errorf("Expected uncaught exception on line 2, got %v", err)
+	}
+}
+
+func TestFinally(t *testing.T) {
+	// Normal exit
+	assertRes(t, `
+	fn foo(log) {
+		x = try { 1 } finally { log["finally"] = 2 }
+		x + log["finally"]
+	}
+	foo({})`, NewInt(3))
+
+	// Exceptions, both caught and uncaught in the function
+	assertRes(t, `
+	fn inner(log) {
+		try { raise("x") } finally { log["a"] = 1 }
+	}
+	fn foo(log) {
+		try {
+			try { inner(log) } handle { exn(e) -> { log["b"] = 2 } } finally { log["c"] = 3 }
+		} finally {
+			log["d"] = 4
+		}
+		str(log.values())
+	}
+	foo({})`, NewString("list(1, 2, 3, 4)"))
+
+	// Dropped continuations
+	assertRes(t, `
+	fn inner(log) {
+		try { do ask() } finally { log["inner"] = 1 }
+	}
+	fn foo(log) {
+		res = try { inner(log) } handle { ask() -> { "dropped" } }
+		res + " " + str(log.get("inner"))
+	}
+	foo({})`, NewString("dropped 1"))
+
+	// Resumed continuations run finally when the block ends
+	assertRes(t, `
+	fn foo(log) {
+		res = try {
+			try { 1 + do ask() } finally { log["inner"] = 1 }
+		} handle {
+			ask() @ k -> { resume k 41 }
+		}
+		[res, log.get("inner")] == [42, 1]
+	}
+	foo({})`, NewBool(true))
+
+	// Finally blocks run for uncaught exceptions
+	log := NewMap()
+	_, err := runWithGlobals(t, `
+	fn foo() {
+		try { raise("x") } finally { log["ran"] = true }
+	}
+	foo()`, map[string]Value{"log": log})
+	if err == nil {
+		t.Error("Expected uncaught exception")
+	}
+	if _, ok := log.Map["ran"]; !ok {
+		t.Error("Expected finally block to run")
+	}
+}
+
+func TestStackTrace(t *testing.T) {
+	prog := "fn div(a, b) {\n  a / b\n}\nfn outer(x) {\n  [x].map((y) => div(y, 0) + 1)\n}\nouter(1)"
+	main, err := parseMain(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := DefaultCompileOptions
+	options.Source = NewSource("test.wosh", prog)
+	function, err := CompileWithOptions(main, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewVm().Interpret(function)
+	rtErr, ok := err.(*RuntimeError)
+	if !ok {
+		t.Fatalf("Expected runtime error, got %v", err)
+	}
+
+	expected := []struct {
+		function  string
+		line, col int
+	}{
+		{"div", 2, 3},
+		{"__anon__", 5, 18},
+		{"outer", 5, 3},
+		{"main", 7, 1},
+	}
+	if len(rtErr.Trace) != len(expected) {
+		t.Fatalf("Expected trace %v, got %v", expected, rtErr.Trace)
+	}
+	for i, entry := range expected {
+		e := rtErr.Trace[i]
+		if e.Function != entry.function || e.Line() != entry.line || e.Col() != entry.col || e.File != options.Source {
+			t.Errorf("Expected entry %v, got %s:%d:%d in %s", entry, e.FileName(), e.Line(), e.Col(), e.Function)
+		}
+	}
+	if rtErr.Line != 2 || rtErr.Col != 3 {
+		t.Errorf("Expected error at 2:3, got %d:%d", rtErr.Line, rtErr.Col)
+	}
+
+	traceback := rtErr.Traceback()
+	for _, s := range []string{
+		"File \"test.wosh\", line 2:3, in div\n      a / b\n      ^^^^^\n",
+		"File \"test.wosh\", line 5:18, in __anon__\n      [x].map((y) => div(y, 0) + 1)\n                     ^^^^^^^^^\n",
+		"File \"test.wosh\", line 7:1, in main\n    outer(1)\n    ^^^^^^^^\n",
+		"Runtime Error on line 2: Division by zero",
+	} {
+		if !strings.Contains(traceback, s) {
+			t.Errorf("Expected %q in traceback:\n%s", s, traceback)
+		}
+	}
+}
+
+func TestStackTraceFiles(t *testing.T) {
+	// A program joined from two files shares its top level variables and
+	// keeps the file of each expression
+	files := []*Source{
+		NewSource("a.wosh", "x = 2\nfn div(a) {\n  a / 0\n}"),
+		NewSource("b.wosh", "y = x + 1\nif y < 0 { do ask() }\ndiv(y)"),
+	}
+	block := &ast.BlockExpr{}
+	options := DefaultCompileOptions
+	for _, file := range files {
+		exprs, _, err := parser.NewParser(strings.Join(file.Lines, "\n")).Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		block.Children = append(block.Children, exprs.Children...)
+		for range exprs.Children {
+			options.ExprSources = append(options.ExprSources, file)
+		}
+	}
+	var warnings []*Warning
+	options.Warn = func(w *Warning) { warnings = append(warnings, w) }
+	function, err := CompileProgram(block, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 || warnings[0].Source != files[1] || warnings[0].Area.Start.Line != 1 {
+		t.Errorf("Expected a warning on line 2 of b.wosh, got %v", warnings)
+	}
+	_, err = NewVm().Interpret(function)
+	rtErr, ok := err.(*RuntimeError)
+	if !ok {
+		t.Fatalf("Expected runtime error, got %v", err)
+	}
+	if len(rtErr.Trace) != 2 {
+		t.Fatalf("Expected two frames, got %v", rtErr.Trace)
+	}
+	if e := rtErr.Trace[0]; e.File != files[0] || e.Line() != 3 || e.Function != "div" {
+		t.Errorf("Expected div at a.wosh:3, got %s:%d in %s", e.FileName(), e.Line(), e.Function)
+	}
+	if e := rtErr.Trace[1]; e.File != files[1] || e.Line() != 3 || e.Function != "main" {
+		t.Errorf("Expected main at b.wosh:3, got %s:%d in %s", e.FileName(), e.Line(), e.Function)
+	}
+}
+
+func TestExceptionTrace(t *testing.T) {
+	assertRes(t, `
+	fn fail() { raise("x") }
+	fn foo() {
+		try { fail() } handle { exn(e) -> { e.trace() } }
+	}
+	foo()`, NewString("  unknown:6 - main\n  unknown:4 - foo\n  unknown:2 - fail"))
+}
+
+func TestLargePrograms(t *testing.T) {
+	// More than 256 locals, constants and names in one function
+	var b strings.Builder
+	b.WriteString("fn f() {\n")
+	for i := 0; i < 300; i++ {
+		fmt.Fprintf(&b, "x%d = '%d'\n", i, i)
+	}
+	b.WriteString("g = () => x299\n")
+	b.WriteString("g() + x0 + x1\n}\n")
+	for i := 0; i < 300; i++ {
+		fmt.Fprintf(&b, "fn g%d() { %d }\n", i, i)
+	}
+	b.WriteString("str(g299()) + f()")
+	if res := run(t, b.String()); !testEqual(res, NewString("29929901")) {
+		t.Errorf("Expected 29929901, got %s", res)
+	}
+
+	// List and map literals with more than 255 elements
+	elems := []string{}
+	entries := []string{}
+	for i := 0; i < 1000; i++ {
+		elems = append(elems, fmt.Sprint(i))
+		entries = append(entries, fmt.Sprintf("'k%d': %d", i, i))
+	}
+	assertInt(t, "len(["+strings.Join(elems, ", ")+"])", 1000)
+	assertInt(t, "{"+strings.Join(entries, ", ")+"}['k999']", 999)
+
+	// Jumps longer than 64K bytes
+	b.Reset()
+	b.WriteString("x = 0\nif x == 0 {\n")
+	for i := 0; i < 20000; i++ {
+		b.WriteString("x = x + 1\n")
+	}
+	b.WriteString("} else { x = -1 }\nx")
+	assertInt(t, b.String(), 20000)
+}
+
+func TestStackOverflow(t *testing.T) {
+	// Deep recursion is caught as an exception
+	assertRes(t, `
+	fn f(n) { f(n + 1) + 1 }
+	fn g() {
+		try { f(0) } handle { exn(e) -> { e.msg() } }
+	}
+	g()`, NewString("Stack overflow"))
+
+	// Recursion through methods too
+	assertRes(t, `
+	fn (x: Int) down() { (x - 1).down() }
+	try { 1.down() } handle { exn(e) -> { e.msg() } }
+	`, NewString("Stack overflow"))
+
+	// Recursion below the limit is fine
+	assertInt(t, `
+	fn sum(n) { if n == 0 { 0 } else { n + sum(n - 1) } }
+	sum(1000)`, 500500)
+
+	// The traceback is truncated
+	main, err := parseMain("fn f(n) { 1 + f(n + 1) }\nf(0)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	function, err := Compile(main)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewVm().Interpret(function)
+	rtErr, ok := err.(*RuntimeError)
+	if !ok || rtErr.Msg != "Stack overflow" {
+		t.Fatalf("Expected stack overflow, got %v", err)
+	}
+	if len(rtErr.Trace) != MAX_TRACE || rtErr.Omitted != FRAMES_MAX-MAX_TRACE {
+		t.Errorf("Expected %d frames with %d omitted, got %d with %d omitted", MAX_TRACE, FRAMES_MAX-MAX_TRACE, len(rtErr.Trace), rtErr.Omitted)
+	}
+	if last := rtErr.Trace[len(rtErr.Trace)-1]; last.Function != "main" {
+		t.Errorf("Expected main as outermost frame, got %s", last.Function)
+	}
+	if !strings.Contains(rtErr.Traceback(), fmt.Sprintf("... %d more frames ...", rtErr.Omitted)) {
+		t.Errorf("Expected omitted frames in traceback:\n%s", rtErr.Traceback())
+	}
+}
+
+func TestLimits(t *testing.T) {
+	tests := []struct {
+		limits Limits
+		prog   string
+	}{
+		{Limits{MaxCallDepth: 10}, "fn f(n) { if n == 0 { 0 } else { 1 + f(n - 1) } }\nf(10)"},
+		{Limits{MaxStackSize: 10}, "[1, 2, 3, 4, 5, 6, 7, 8, 9, 10]"},
+		{Limits{MaxStackSize: 10}, "fn f() { a = 1\nb = 2\nc = 3\nd = 4\ne = 5\nf = 6\ng = 7\nh = 8\ni = 9\nj = 10 }\nf()"},
+	}
+	for _, test := range tests {
+		main, err := parseMain(test.prog)
+		if err != nil {
+			t.Fatal(err)
+		}
+		function, err := Compile(main)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vm := NewVm()
+		vm.SetLimits(test.limits)
+		_, err = vm.Interpret(function)
+		if rtErr, ok := err.(*RuntimeError); !ok || rtErr.Msg != "Stack overflow" {
+			t.Errorf("Expected stack overflow running `%s` with %+v, got %v", test.prog, test.limits, err)
+		}
+		if _, err := NewVm().Interpret(function); err != nil {
+			t.Errorf("Unexpected error running `%s` without limits: %s", test.prog, err)
+		}
+	}
+}
+
+func TestTailCalls(t *testing.T) {
+	// Tail recursion deeper than the call depth limit
+	assertInt(t, `
+	fn loop(n, acc) {
+		if n == 0 { acc } else { loop(n - 1, acc + 1) }
+	}
+	loop(5000, 0)`, 5000)
+
+	assertInt(t, `
+	fn even(n) { if n == 0 { 1 } else if n == 1 { 0 } else { return odd(n - 1) } }
+	fn odd(n) { (even(n - 1)) }
+	even(5000)`, 1)
+
+	// Captured variables of reused frames are kept by their closures
+	assertRes(t, `
+	fn collect(n, acc) {
+		if n == 0 { acc } else {
+			x = n
+			fn get() { x }
+			collect(n - 1, acc + [get])
+		}
+	}
+	str(collect(3, []).map((f) => f()))`, NewString("list(3, 2, 1)"))
+
+	// Frames with handlers are not reused
+	assertInt(t, `
+	fn loop(n) { if n == 0 { do eff(1) } else { loop(n - 1) } }
+	fn f() {
+		try { return loop(5000) } handle { eff(x) @ k -> { resume k x + 41 } }
+	}
+	f()`, 42)
+
+	// Tail calls of builtins and functions with return types
+	assertInt(t, `
+	fn f(s) { len(s) }
+	fn g(n) -> Int { if n == 0 { 0 } else { g(n - 1) } }
+	f("abc") + g(10)`, 3)
+}
+
+func TestCallArity(t *testing.T) {
+	tests := []struct {
+		prog string
+		msg  string
+	}{
+		{"fn f(a, b) { a }\nf(1)", "Calling function 'f' with 1 arguments, expected 2"},
+		{"fn f(a) { a }\nf(1, 2)", "Calling function 'f' with 2 arguments, expected 1"},
+		{"x = 1\n[1, 2].fold(0, (x) => x)", "Calling function '__anon__' with 2 arguments, expected 1"},
+		{"x = 1\n[1, 2].map((a, b) => a)", "Calling function '__anon__' with 1 arguments, expected 2"},
+		{"fn (lst: List) second(i) { lst[i] }\n[1, 2].second()", "Calling method 'second' with 0 arguments, expected 1"},
+		// Tail calls reuse the frame of the caller
+		{"fn f(a, b) { a }\nfn g() { f(1) }\ng()", "Calling function 'f' with 1 arguments, expected 2"},
+		{"fn f(a) { a }\nfn g() { f(1, 2) }\ng()", "Calling function 'f' with 2 arguments, expected 1"},
+	}
+	for _, test := range tests {
+		_, err := runWithGlobals(t, test.prog, nil)
+		rtErr, ok := err.(*RuntimeError)
+		if !ok || !strings.Contains(err.Error(), test.msg) {
+			t.Errorf("Expected error '%s' running `%s`, got %v", test.msg, test.prog, err)
+			continue
+		}
+		if rtErr.Line != 2 {
+			t.Errorf("Expected error on line 2 running `%s`, got %d", test.prog, rtErr.Line)
+		}
+	}
+
+	// The error is an exception like other runtime errors
+	assertRes(t, `
+	fn f(a, b) { a }
+	try { f(1) } handle { exn(e) -> e.msg() }`, NewString("Calling function 'f' with 1 arguments, expected 2"))
+
+	// Calls from go code are checked too
+	main, err := parseMain("fn f(a, b) { a }")
+	if err != nil {
+		t.Fatal(err)
+	}
+	function, err := Compile(main)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := NewVm()
+	if _, err := vm.Interpret(function); err != nil {
+		t.Fatal(err)
+	}
+	f, _ := vm.GetGlobal("f")
+	if _, err := vm.Call(f, NewInt(1)); err == nil || !strings.Contains(err.Error(), "with 1 arguments, expected 2") {
+		t.Errorf("Expected arity error, got %v", err)
+	}
+}
+
+func TestRunLimits(t *testing.T) {
+	compile := func(prog string) *FunctionValue {
+		main, err := parseMain(prog)
+		if err != nil {
+			t.Fatal(err)
+		}
+		function, err := Compile(main)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return function
+	}
+	loop := compile("for true { 1 }")
+	caught := compile("try { for true { 1 } } handle { exn(e) -> { 1 } }")
+	nested := compile("fn spin(x) { for true { 1 } }\ntry { [1].map(spin) } handle { exn(e) -> { e.msg() } }")
+	doubling := compile("s = 'ab'\nfor true { s = s + s }")
+	repeat := compile("'a'.repeat(1000000000)")
+	output := compile("exec('head', '-c', '100000', '/dev/zero')")
+
+	tests := []struct {
+		limits   Limits
+		function *FunctionValue
+		msg      string
+	}{
+		{Limits{MaxInstructions: 10000}, loop, "Instruction limit of 10000 exceeded"},
+		{Limits{MaxInstructions: 10000}, caught, "Instruction limit of 10000 exceeded"},
+		{Limits{MaxInstructions: 10000}, nested, "Instruction limit of 10000 exceeded"},
+		{Limits{Timeout: 10 * time.Millisecond}, loop, "Timeout of 10ms exceeded"},
+		{Limits{MaxAllocations: 1000}, doubling, "Allocation limit of 1000 exceeded"},
+		// Builtins check the limit before they allocate
+		{Limits{MaxAllocations: 1000}, repeat, "Allocation limit of 1000 exceeded"},
+		{Limits{MaxAllocations: 1000}, output, "Allocation limit of 1000 exceeded"},
+	}
+	for _, test := range tests {
+		vm := NewVm()
+		vm.SetLimits(test.limits)
+		_, err := vm.Interpret(test.function)
+		if _, ok := err.(*LimitError); !ok || err.Error() != test.msg {
+			t.Errorf("Expected '%s' with %+v, got %v", test.msg, test.limits, err)
+		}
+	}
+
+	// Tail calls that reuse their frame don't allocate, even with large arguments
+	vm := NewVm()
+	vm.SetLimits(Limits{MaxAllocations: 200000})
+	res, err := vm.Interpret(compile(`
+	fn spin(n, xs) { if n == 0 { len(xs) } else { spin(n - 1, xs) } }
+	spin(1000, (0..<1000).list())`))
+	if err != nil || res.String() != "1000" {
+		t.Errorf("Expected 1000 from a tail recursive loop, got %v, %v", res, err)
+	}
+
+	// The instruction limit is exact, 1 + 2 runs in 4 instructions
+	vm = NewVm()
+	vm.SetLimits(Limits{MaxInstructions: 4})
+	if _, err := vm.Interpret(compile("1 + 2")); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	vm.SetLimits(Limits{MaxInstructions: 3})
+	if _, err := vm.Interpret(compile("1 + 2")); err == nil {
+		t.Error("Expected instruction limit error")
+	}
+
+	// Cancellation through the context, also in calls from go code
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	_, err = NewVm().InterpretContext(ctx, loop)
+	if _, ok := err.(*LimitError); !ok || !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected cancellation, got %v", err)
+	}
+	vm = NewVm()
+	if _, err := vm.Interpret(compile("fn f() { for true { 1 } }")); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = vm.CallContext(ctx, vm.globals["f"])
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestSandbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wosh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	allowed := filepath.Join(dir, "a.txt")
+	policy := &sandbox.Policy{
+		Read:  sandbox.Paths{Allow: []string{dir}},
+		Write: sandbox.Paths{Allow: []string{dir}},
+		Env:   []string{"WOSH_TEST"},
+	}
+	os.Setenv("WOSH_TEST", "x")
+	defer os.Unsetenv("WOSH_TEST")
+
+	tests := []struct {
+		prog     string
+		expected Value
+	}{
+		{fmt.Sprintf("writefile('%s', 'a\\nb')\nreadlines('%s')[1]", allowed, allowed), NewString("b")},
+		{"getenv('WOSH_TEST')", NewString("x")},
+		{"try { readlines('/etc/passwd') } handle { exn(e) -> { e.msg() } }", NewString("readlines: Permission denied: read '/etc/passwd'")},
+		{"try { writefile('/tmp/x', '') } handle { exn(e) -> { e.msg() } }", NewString("writefile: Permission denied: write '/tmp/x'")},
+		{"try { getenv('HOME') } handle { exn(e) -> { e.msg() } }", NewString("getenv: Permission denied: getenv 'HOME'")},
+		{"try { exec('echo', 'hi') } handle { exn(e) -> { e.msg() } }", NewString("exec: Permission denied: run 'echo'")},
+	}
+	for _, test := range tests {
+		main, err := parseMain(test.prog)
+		if err != nil {
+			t.Fatal(err)
+		}
+		function, err := Compile(main)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vm := NewVm()
+		vm.SetSandbox(policy)
+		res, err := vm.Interpret(function)
+		if err != nil {
+			t.Errorf("Error running `%s`: %s", test.prog, err)
+		} else if !testEqual(res, test.expected) {
+			t.Errorf("Expected %s from `%s`, got %s", test.expected, test.prog, res)
+		}
+	}
+
+	// Commands only see the allowed environment variables
+	os.Setenv("WOSH_SECRET", "y")
+	defer os.Unsetenv("WOSH_SECRET")
+	main, err := parseMain("exec('sh', '-c', 'echo $WOSH_TEST$WOSH_SECRET')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	function, err := Compile(main)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := NewVm()
+	vm.SetSandbox(&sandbox.Policy{Commands: []string{"sh"}, Env: []string{"WOSH_TEST"}, Network: true})
+	res, err := vm.Interpret(function)
+	if err != nil {
+		t.Fatal(err)
+	} else if !testEqual(res, NewString("x\n")) {
+		t.Errorf("Expected only WOSH_TEST in the environment of commands, got %s", res)
+	}
+
+	// Without a sandbox everything is allowed
+	assertRes(t, "exec('echo', 'hi')", NewString("hi\n"))
+}
+
+func TestMultiShotContinuations(t *testing.T) {
+	// Backtracking over all choices, resuming each continuation twice
+	assertRes(t, `
+	fn pick(a, b) {
+		x = b
+		if do choose() { x = a }
+		x
+	}
+	fn all() {
+		ks = []
+		results = []
+		i = 0
+		r = try {
+			[pick(1, 2), pick(3, 4)]
+		} handle {
+			choose() @ k -> {
+				ks = ks + [k]
+				resume k true
+			}
+		}
+		results = results + [r]
+		if i < len(ks) {
+			i = i + 1
+			k = ks[i - 1]
+			resume k false
+		}
+		str(results)
+	}
+	all()`, NewString("list(list(1, 3), list(2, 3), list(1, 4), list(2, 4))"))
+
+	// Effects performed in the try block itself
+	assertRes(t, `
+	fn all() {
+		k2 = ()
+		results = []
+		r = try {
+			[1, do choose(10, 20)]
+		} handle {
+			choose(a, b) @ k -> {
+				k2 = k
+				resume k a
+			}
+		}
+		results = results + [r]
+		if len(results) < 2 { resume k2 20 }
+		str(results)
+	}
+	all()`, NewString("list(list(1, 10), list(1, 20))"))
+
+	// Handler state is shared between the resumptions
+	assertInt(t, `
+	fn count() {
+		n = 0
+		k2 = ()
+		try {
+			do tick()
+			n
+		} handle {
+			tick() @ k -> {
+				k2 = k
+				resume k
+			}
+		}
+		n = n + 1
+		if n < 3 { resume k2 }
+		n
+	}
+	count()`, 3)
+
+	// Resuming after the handler has aborted the try block
+	assertRes(t, `
+	fn g(log) {
+		try { do choose() } finally { log["n"] = log.get("n", 0) + 1 }
+	}
+	fn f(log) {
+		k2 = ()
+		r = try { g(log) } handle {
+			choose() @ k -> {
+				k2 = k
+				0
+			}
+		}
+		if r == 0 { resume k2 5 }
+		str([r, log.get("n")])
+	}
+	f({})`, NewString("list(5, 2)"))
+
+	// Continuations captured in a call from go code are one-shot
+	_, err := runWithGlobals(t, `
+	fn check(x) {
+		do grab(1)
+		do grab(2)
+	}
+	fn f() {
+		first = ()
+		try { [1].map(check) } handle {
+			grab(x) @ k -> {
+				if x == 1 { first = k }
+				resume first x
+			}
+		}
+	}
+	f()`, nil)
+	if err == nil || !strings.Contains(err.Error(), "can only be resumed once") {
+		t.Errorf("Expected error resuming one-shot continuation twice, got %v", err)
+	}
+}
+
+func TestDeepHandlers(t *testing.T) {
+	// State
+	assertRes(t, `
+	fn counter() {
+		do put(do get() + 1)
+		do put(do get() + 1)
+		do get() * 10
+	}
+	fn run_state(init, f) {
+		state = init
+		try { f() } handle {
+			get() @ k -> { resume k state }
+			put(x) @ k -> {
+				state = x
+				resume k
+			}
+			return(x) -> [x, state]
+		}
+	}
+	str(run_state(5, counter))`, NewString("list(70, 7)"))
+
+	// Reader
+	assertInt(t, `
+	fn f() { do ask() + do ask() }
+	try { f() } handle { ask() @ k -> { resume k 21 } }`, 42)
+
+	// Writer
+	assertRes(t, `
+	fn f() {
+		do tell("a")
+		do tell("b")
+		1
+	}
+	fn run_writer() {
+		out = []
+		try { f() } handle {
+			tell(x) @ k -> {
+				out = out + [x]
+				resume k
+			}
+			return(x) -> [x, out]
+		}
+	}
+	str(run_writer())`, NewString("list(1, list(\"a\", \"b\"))"))
+
+	// The return clause doesn't get the values of handlers
+	assertInt(t, `try { 2 } handle { return(x) -> x * 100 }`, 200)
+	assertInt(t, `
+	try {
+		do stop(1)
+		2
+	} handle {
+		stop(x) -> x
+		return(x) -> x * 100
+	}`, 1)
+
+	// Handlers run outside their try block, so the effects they perform go
+	// to outer handlers
+	assertInt(t, `
+	fn f() { do log("a") + 1 }
+	try {
+		try { f() } handle {
+			log(msg) @ k -> { resume k do log("inner: " + msg) }
+		}
+	} handle {
+		log(msg) @ k -> { resume k len(msg) }
+	}`, 9)
+	assertRes(t, `
+	try {
+		try { do ask() } handle {
+			ask() -> { raise("in handler") }
+			exn(e) -> { "inner" }
+		}
+	} handle {
+		exn(e) -> { "outer" }
+	}`, NewString("outer"))
+
+	// The return clause runs outside the handlers too
+	assertInt(t, `
+	try {
+		try { 1 } handle {
+			eff() @ k -> { resume k 10 }
+			return(x) -> x + do eff()
+		}
+	} handle {
+		eff() @ k -> { resume k 100 }
+	}`, 101)
+}
+
+func TestEffectDeclarations(t *testing.T) {
+	assertInt(t, `
+	effect ask() -> Int
+	effect log(msg: Str) -> Nil
+	fn f() {
+		do log("asking")
+		do ask() + 1
+	}
+	try { f() } handle {
+		ask() @ k -> { resume k 41 }
+		log(msg) @ k -> { resume k }
+	}`, 42)
+
+	tests := []struct {
+		prog string
+		msg  string
+	}{
+		{`
+		effect log(msg: Str)
+		x = 1
+		try { do log(x) } handle { log(msg) @ k -> { resume k } }`,
+			"Unexpected type in effect 'log': parameter 'msg' expected Str, got Int"},
+		{`
+		effect ask() -> Int
+		try { do ask() } handle { ask() @ k -> { resume k "a" } }`,
+			"Unexpected type in effect 'ask': resumed with Str, expected Int"},
+		{`
+		effect log(msg: Foo)
+		try { do log(1) } handle { log(msg) @ k -> { resume k } }`,
+			"Type annotation 'Foo' of parameter 'msg' is not a type"},
+	}
+	for _, test := range tests {
+		_, err := runWithGlobals(t, test.prog, nil)
+		if err == nil || !strings.Contains(err.Error(), test.msg) {
+			t.Errorf("Expected error '%s', got %v", test.msg, err)
+		}
+	}
+
+	// Declarations apply to later programs in the same vm
+	vm := NewVm()
+	for i, prog := range []string{"effect log(msg)", "try { do log(1, 2) } handle { log(a, b) -> 1 }"} {
+		main, err := parseMain(prog)
+		if err != nil {
+			t.Fatalf("Parse error: %s", err)
+		}
+		function, err := Compile(main)
+		if err != nil {
+			t.Fatalf("Compile error: %s", err)
+		}
+		_, err = vm.Interpret(function)
+		if i == 1 && (err == nil || !strings.Contains(err.Error(), "Performing effect 'log' with 2 arguments, expected 1")) {
+			t.Errorf("Expected arity error, got %v", err)
+		}
+	}
+
+	// Without type checks only the arity is checked
+	main, _ := parseMain(`
+	effect ask() -> Int
+	try { do ask() } handle { ask() @ k -> { resume k "a" } }`)
+	function, err := CompileWithOptions(main, CompileOptions{TypeChecks: false})
+	if err != nil {
+		t.Fatalf("Compile error: %s", err)
+	}
+	res, err := NewVm().Interpret(function)
+	if err != nil || !testEqual(res, NewString("a")) {
+		t.Errorf("Expected \"a\", got %v, %v", res, err)
+	}
+}
+
+func TestHostEffectHandlers(t *testing.T) {
+	runVm := func(vm *VM, prog string) (Value, error) {
+		t.Helper()
+		main, err := parseMain(prog)
+		if err != nil {
+			t.Fatalf("Parse error: %s", err)
+		}
+		function, err := Compile(main)
+		if err != nil {
+			t.Fatalf("Compile error: %s", err)
+		}
+		return vm.Interpret(function)
+	}
+
+	vm := NewVm()
+	vm.HandleEffect("double", mustBuiltinFromFunc("double", func(x int) int { return 2 * x }))
+	res, err := runVm(vm, `
+	fn f(x) { do double(x) + 1 }
+	a = f(20)
+	b = try { f(20) } handle { double(x) @ k -> { resume k x } }
+	[a, b]`)
+	if err != nil || res.String() != "list(41, 21)" {
+		t.Errorf("Expected [41, 21], got %v, %v", res, err)
+	}
+
+	_, err = runVm(vm, "do double(1, 2)")
+	if err == nil || !strings.Contains(err.Error(), "Calling builtin function 'double' with 2 arguments") {
+		t.Errorf("Expected arity error, got %v", err)
+	}
+	_, err = runVm(vm, "effect double(x) -> Str\ndo double(1)")
+	if err == nil || !strings.Contains(err.Error(), "resumed with Int, expected Str") {
+		t.Errorf("Expected type error, got %v", err)
+	}
+
+	vm.HandleEffect("double", nil)
+	if _, err = runVm(vm, "do double(1)"); err == nil {
+		t.Error("Expected missing handler error after removing the handler")
+	}
+
+	// Default effects
+	out := &strings.Builder{}
+	vm = NewVm()
+	vm.HandleDefaultEffects(strings.NewReader("first\r\nsecond"), out)
+	res, err = runVm(vm, `
+	do log("read", do read_line(), 1)
+	do log(do read_line())
+	r = do random(3)
+	[do read_line(), r >= 0 && r < 3, do now() > 0]`)
+	if err != nil || res.String() != "list((), true, true)" {
+		t.Errorf("Unexpected result %v, %v", res, err)
+	}
+	if out.String() != "read first 1\nsecond\n" {
+		t.Errorf("Unexpected log output %q", out.String())
+	}
+
+	// Mocking the default effects
+	res, err = runVm(vm, `
+	fn greet() { do log("hello " + do read_line()) }
+	logged = []
+	try { greet() } handle {
+		read_line() @ k -> { resume k "test" }
+		log(msg) @ k -> {
+			logged = logged + [msg]
+			resume k
+		}
+	}
+	logged`)
+	if err != nil || res.String() != `list("hello test")` {
+		t.Errorf("Unexpected result %v, %v", res, err)
+	}
+
+	// Exit can't be caught
+	_, err = runVm(vm, `
+	try { [1].map((x) => do exit(3)) } handle { exn(e) -> 0 }
+	1`)
+	if exit, ok := err.(*ExitError); !ok || exit.Code != 3 {
+		t.Errorf("Expected exit error with code 3, got %v", err)
+	}
+}
+
+func TestForIn(t *testing.T) {
+	assertRes(t, "s = 0\nfor x in [1, 2, 3] { s = s + x }\ns", NewInt(6))
+	assertRes(t, "s = ''\nfor c in 'abc' { s = c + s }\ns", NewString("cba"))
+	assertRes(t, "s = ''\nfor kv in {'b': 2, 'a': 1} { s = s + kv[0] + str(kv[1]) }\ns", NewString("a1b2"))
+	assertRes(t, "for x in [] { raise('empty') }", Nil)
+	assertRes(t, "for x in [1, 2] { x }\nx", NewInt(2))
+
+	// Nested loops and loops in functions
+	assertRes(t, `
+	fn pairs(xs, ys) {
+		res = []
+		for x in xs {
+			for y in ys {
+				res = res + [x * y]
+			}
+		}
+		res
+	}
+	str(pairs([1, 2], [3, 4]))`, NewString("list(3, 4, 6, 8)"))
+
+	// Returning from inside a loop
+	assertRes(t, `
+	fn first_even(xs) {
+		for x in xs {
+			if x % 2 == 0 { return x }
+		}
+		-1
+	}
+	str([first_even([1, 4, 6]), first_even([1])])`, NewString("list(4, -1)"))
+
+	// Custom values are iterated over what their iter method returns
+	assertRes(t, `
+	type Pair(a, b)
+	fn (p: Pair) iter() { [p.a, p.b] }
+	s = 0
+	for x in Pair(1, 2) { s = s + x }
+	s`, NewInt(3))
+
+	_, err := runWithGlobals(t, "for x in 1 { x }", nil)
+	if err == nil || !strings.Contains(err.Error(), "Can't iterate over Int") {
+		t.Errorf("Expected iteration error, got %v", err)
+	}
+}
+
+func TestBreakContinue(t *testing.T) {
+	assertRes(t, "s = 0\nfor [k, v] in items({'a': 1, 'bb': 2}) { s = s + len(k) * v }\ns", NewInt(5))
+	assertRes(t, "s = 0\nfor [a, [b, c]] in [[1, [2, 3]], [4, [5, 6]]] { s = s + a * b * c }\ns", NewInt(126))
+	assertRes(t, "for x in [1, 2, 3] { if x == 2 { break x * 10 } }", NewInt(20))
+	assertRes(t, "for x in [1, 2, 3] { if x == 2 { break } }", Nil)
+	assertRes(t, "for x in [1, 2, 3] { x }", Nil)
+	assertRes(t, "s = 0\nfor x in [1, 2, 3, 4] { if x % 2 == 0 { continue }\ns = s + x }\ns", NewInt(4))
+
+	// While loops
+	assertRes(t, "i = 0\nfor true { i = i + 1\nif i == 5 { break i } }", NewInt(5))
+	assertRes(t, `
+	i = 0
+	s = 0
+	for i < 5 {
+		i = i + 1
+		if i == 3 { continue }
+		s = s + i
+	}
+	s`, NewInt(12))
+
+	// Only the innermost loop is exited
+	assertRes(t, `
+	fn pairs(n) {
+		res = []
+		for x in [1, 2, 3] {
+			for y in [1, 2, 3] {
+				if y > x { break }
+				if y == 2 { continue }
+				res = res + [x * 10 + y]
+			}
+			if x == n { break }
+		}
+		res
+	}
+	str(pairs(2))`, NewString("list(11, 21)"))
+
+	// Breaking out of the middle of an expression and out of try blocks
+	assertRes(t, "str([1, for x in [2] { 3 + (break x) }, 4])", NewString("list(1, 2, 4)"))
+	assertRes(t, `
+	fn f() {
+		log = []
+		for x in [1, 2, 3] {
+			try {
+				if x == 2 { continue }
+				if x == 3 { break }
+				log = log + [x]
+			} finally {
+				log = log + ["f" + str(x)]
+			}
+		}
+		try { raise("after") } handle { exn(e) -> log = log + [e.msg()] }
+		log
+	}
+	str(f())`, NewString(`list(1, "f1", "f2", "f3", "after")`))
+
+	// Generators are left suspended by break
+	assertRes(t, `
+	fn count() {
+		generator(() => {
+			i = 0
+			for true {
+				do yield(i)
+				i = i + 1
+			}
+		})
+	}
+	for x in count() { if x == 3 { break x } }`, NewInt(3))
+
+	_, err := runWithGlobals(t, "for [a, b] in [[1]] { a }", nil)
+	if err == nil || !strings.Contains(err.Error(), "destructure") {
+		t.Errorf("Expected destructuring error, got %v", err)
+	}
+
+	tests := []struct {
+		prog string
+		msg  string
+	}{
+		{"break", "'break' outside of a loop"},
+		{"for x in [1] { f = () => { continue } }", "'continue' outside of a loop"},
+	}
+	for _, test := range tests {
+		main, err := parseMain(test.prog)
+		if err != nil {
+			t.Fatalf("Error parsing `%s`: %s", test.prog, err)
+		}
+		_, err = Compile(main)
+		if err == nil || !strings.Contains(err.Error(), test.msg) {
+			t.Errorf("Expected compile error '%s', got %v", test.msg, err)
+		}
+	}
+}
+
+func TestGenerators(t *testing.T) {
+	count := `
+	fn count(n) {
+		generator(() => {
+			i = 0
+			for i < n {
+				do yield(i)
+				i = i + 1
+			}
+		})
+	}
+	`
+	assertRes(t, count+"s = 0\nfor x in count(4) { s = s + x }\ns", NewInt(6))
+	assertRes(t, count+"str(count(3).list())", NewString("list(0, 1, 2)"))
+	assertRes(t, count+"it = count(2)\nstr([it.next(), it.done(), it.next(), it.done(), it.next()])", NewString("list(0, false, 1, true, ())"))
+	assertRes(t, count+"it = count(3)\nit.next()\nstr(iter(it).list())", NewString("list(1, 2)"))
+
+	// Generators are lazy
+	assertRes(t, `
+	fn naturals() {
+		generator(() => {
+			i = 0
+			for true {
+				do yield(i)
+				i = i + 1
+			}
+		})
+	}
+	s = 0
+	it = naturals()
+	for x in it {
+		s = s + x
+		if x == 10 { return s }
+	}`, NewInt(55))
+
+	// Other effects are handled where the generator is consumed
+	assertRes(t, `
+	g = generator(() => {
+		do yield(do ask())
+		do yield(do ask() + 1)
+	})
+	n = 10
+	str(try { g.list() } handle {
+		ask() @ k -> {
+			n = n + 10
+			resume k n
+		}
+	})`, NewString("list(20, 31)"))
+
+	// Exceptions in the generator propagate to the consumer
+	assertRes(t, `
+	g = generator(() => {
+		do yield(1)
+		raise("boom")
+	})
+	res = []
+	try {
+		for x in g { res = res + [x] }
+	} handle {
+		exn(e) -> { res = res + [e.msg()] }
+	}
+	str(res)`, NewString(`list(1, "boom")`))
+
+	// A generator that yields from nested calls
+	assertRes(t, `
+	type Tree(left, value, right)
+	fn walk(tree) {
+		if typeof(tree) == Tree {
+			walk(tree.left)
+			do yield(tree.value)
+			walk(tree.right)
+		}
+	}
+	fn values(tree) { generator(() => walk(tree)) }
+	str(values(Tree(Tree((), 1, ()), 2, Tree((), 3, Tree((), 4, ())))).list())`, NewString("list(1, 2, 3, 4)"))
+
+	tests := []struct {
+		prog string
+		msg  string
+	}{
+		{"generator(() => { [1].map((x) => do yield(x)) }).list()", "Can't yield from a call from go code inside a generator"},
+		{"fn f() {\n  g = ()\n  g = generator(() => { g.next() })\n  g.next()\n}\nf()", "Generator is already running"},
+		{"generator((x) => x)", "expected a function without parameters"},
+		{"generator(1)", "generator expected Closure argument, got Int"},
+	}
+	for _, test := range tests {
+		_, err := runWithGlobals(t, test.prog, nil)
+		if err == nil || !strings.Contains(err.Error(), test.msg) {
+			t.Errorf("Expected error '%s', got %v", test.msg, err)
+		}
+	}
+}
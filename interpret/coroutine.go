@@ -0,0 +1,148 @@
+package interpret
+
+import "fmt"
+
+// A function that can be suspended and resumed later, which generators and
+// tasks are built on. Its frame has a handler of the effect that suspends it,
+// which is handled in go.
+type coroutine struct {
+	fn     *ClosureValue
+	effect string
+
+	// Set for tasks, which run without a caller. Effects they don't handle
+	// go to the host handlers, and exceptions end the task.
+	detached bool
+
+	base    *CallFrame // frame of fn, nil until the coroutine is started
+	frame   *CallFrame // frame that suspended it, nil if it isn't suspended
+	running bool
+
+	task *TaskValue // the task that runs the coroutine, if any
+}
+
+func (vm *VM) newCoroutine(name string, fn Value, effect string) (*coroutine, error) {
+	closure, ok := fn.(*ClosureValue)
+	if !ok {
+		return nil, vm.argError(name, fn, ClosureType.Name)
+	}
+	if closure.Function.Arity != 0 {
+		return nil, fmt.Errorf("expected a function without parameters, got %d parameters", closure.Function.Arity)
+	}
+	return &coroutine{fn: closure, effect: effect}, nil
+}
+
+// Name of what the coroutine runs, for errors
+func (co *coroutine) kind() string {
+	if co.task != nil {
+		return "Task"
+	}
+	return "Generator"
+}
+
+// Run the coroutine until it suspends itself or returns. The function runs
+// in a nested dispatch loop like a call from go code. Suspending exits the
+// loop, and resuming moves the suspended frames into a new loop called from
+// the current frame, so that the effects it performs are handled by the code
+// that resumes it. The suspended frame gets value as the result of the
+// instruction that suspended it, or the runtime error raise if it's set.
+// Returns the value it was suspended with, or the returned value and false.
+func (vm *VM) resumeCoroutine(co *coroutine, value Value, raise *RuntimeError) (Value, bool, error) {
+	if co.running {
+		return nil, false, vm.currentFrame.runtimeError(fmt.Sprintf("%s is already running", co.kind()))
+	}
+	frame := vm.currentFrame
+	outer := vm.level
+	vm.level = &runLevel{depth: outer.depth + 1}
+	co.running = true
+	defer func() {
+		co.running = false
+		vm.level.done = true
+		vm.level = outer
+		if co.detached {
+			vm.currentFrame = frame
+		}
+	}()
+
+	caller := frame
+	if co.detached {
+		caller = nil
+	}
+	if co.base == nil {
+		frame.pushStack(co.fn)
+		if err := vm.opCall(0); err != nil {
+			return nil, false, err
+		}
+		co.base = vm.currentFrame
+		co.base.hostCall = true
+		co.base.pushHandler(Handler{effect: co.effect, frame: co.base, coroutine: co})
+		if co.detached {
+			co.base.returnFrame = nil
+			co.base.depth = 1
+		}
+	} else {
+		depth := 1
+		if caller != nil {
+			depth = caller.depth + 1
+		}
+		delta := depth - co.base.depth
+		for f := co.frame; ; f = f.returnFrame {
+			f.level = vm.level
+			f.depth += delta
+			if f == co.base {
+				break
+			}
+		}
+		co.base.returnFrame = caller
+		vm.currentFrame = co.frame
+		co.frame = nil
+		if raise != nil {
+			if err := vm.throw(raise); err != nil {
+				if _, ok := err.(*unwindError); !ok {
+					vm.currentFrame = frame
+				}
+				return nil, false, err
+			}
+		} else {
+			vm.currentFrame.pushStack(value)
+		}
+	}
+
+	res, err := vm.run()
+	if err != nil {
+		if _, ok := err.(*unwindError); !ok {
+			vm.currentFrame = frame
+		}
+		return nil, false, err
+	}
+	if co.frame == nil {
+		// The function returned
+		return res, false, nil
+	}
+	return res, true, nil
+}
+
+// Suspend the coroutine from the current frame, returning value from its
+// resume. The returned error exits the dispatch loop of the coroutine.
+func (vm *VM) suspend(co *coroutine, value Value) error {
+	frame := vm.currentFrame
+	if frame.level != co.base.level {
+		return frame.runtimeError("Can't suspend a coroutine from a call from go code inside it")
+	}
+	co.frame = frame
+	vm.currentFrame = co.base.returnFrame
+	return &unwindError{co.base.level, value}
+}
+
+// The coroutine of the innermost go handler of effect, if the current frame
+// can suspend it
+func (vm *VM) findCoroutine(effect string) *coroutine {
+	for frame := vm.currentFrame; frame != nil; frame = frame.returnFrame {
+		if h := frame.findHandler(effect); h != nil {
+			if h.coroutine == nil || h.coroutine.base.level != vm.currentFrame.level {
+				return nil
+			}
+			return h.coroutine
+		}
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+package interpret
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/rymdhund/wosh/ast"
+	"github.com/rymdhund/wosh/lexer"
+)
+
+// A problem found by the static checks that doesn't stop a program from
+// compiling
+type Warning struct {
+	Msg  string
+	Area lexer.Area
+
+	// The file of the area, might be nil
+	Source *Source
+}
+
+// The warning with the line and column counting from 1, like runtime errors
+func (w *Warning) String() string {
+	return fmt.Sprintf("Warning on line %d:%d: %s", w.Area.Start.Line+1, w.Area.Start.Col+1, w.Msg)
+}
+
+// Static checks of the effects of a program. A do expression must match the
+// declaration of its effect, if there is one. The effects that a function
+// might perform without handling them are inferred from its do expressions
+// and its calls of named functions, and a warning is given for each effect
+// that might not be handled at the top level of the program or by the host.
+type effectChecker struct {
+	options   CompileOptions
+	effects   map[string]*ast.EffectDefExpr
+	functions map[string][]*ast.FuncDefExpr
+	dos       []*ast.DoExpr
+
+	// Effects that might be performed by calling each function
+	performs map[*ast.FuncDefExpr]map[string]bool
+}
+
+func checkEffects(block *ast.BlockExpr, options CompileOptions) ([]*Warning, error) {
+	c := &effectChecker{
+		options:   options,
+		effects:   map[string]*ast.EffectDefExpr{},
+		functions: map[string][]*ast.FuncDefExpr{},
+		performs:  map[*ast.FuncDefExpr]map[string]bool{},
+	}
+	if err := c.collect(block); err != nil {
+		return nil, err
+	}
+	for _, do := range c.dos {
+		if err := c.checkDo(do); err != nil {
+			return nil, err
+		}
+	}
+
+	// Functions can be recursive, so repeat until no function gets more effects
+	for changed := true; changed; {
+		changed = false
+		for _, fns := range c.functions {
+			for _, fn := range fns {
+				effects := map[string]bool{}
+				c.walk(fn.Body, localNames(fn.Body, fn.Params), func(effect string, site ast.Expr, callee string) {
+					effects[effect] = true
+				})
+				if len(effects) > len(c.performs[fn]) {
+					c.performs[fn] = effects
+					changed = true
+				}
+			}
+		}
+	}
+
+	hostEffects := map[string]bool{}
+	for _, effect := range options.HostEffects {
+		hostEffects[effect] = true
+	}
+	warnings := []*Warning{}
+	locals := localNames(block, nil)
+	for i, child := range block.Children {
+		source := options.Source
+		if options.ExprSources != nil {
+			source = options.ExprSources[i]
+		}
+		var found []*Warning
+		c.walk(child, locals, func(effect string, site ast.Expr, callee string) {
+			if hostEffects[effect] {
+				return
+			}
+			msg := fmt.Sprintf("Effect '%s' is not handled", effect)
+			if callee != "" {
+				msg = fmt.Sprintf("Effect '%s' performed by '%s' is not handled", effect, callee)
+			}
+			found = append(found, &Warning{msg, site.GetArea(), source})
+		})
+		// The expressions come in order, so only the warnings of each one need sorting
+		sort.SliceStable(found, func(i, j int) bool {
+			a, b := found[i].Area.Start, found[j].Area.Start
+			if a.Line != b.Line {
+				return a.Line < b.Line
+			}
+			if a.Col != b.Col {
+				return a.Col < b.Col
+			}
+			return found[i].Msg < found[j].Msg
+		})
+		warnings = append(warnings, found...)
+	}
+	return warnings, nil
+}
+
+// Find the effect declarations, named functions and do expressions
+func (c *effectChecker) collect(expr ast.Expr) error {
+	switch v := expr.(type) {
+	case *ast.EffectDefExpr:
+		name := v.Ident.Name
+		if name == EXN_EFFECT {
+			return codeError(v, fmt.Sprintf("Can't declare the built-in effect '%s'", EXN_EFFECT))
+		}
+		if _, ok := c.effects[name]; ok {
+			return codeError(v, fmt.Sprintf("Effect '%s' is already declared", name))
+		}
+		c.effects[name] = v
+	case *ast.FuncDefExpr:
+		if v.Ident != nil && v.ClassParam == nil {
+			c.functions[v.Ident.Name] = append(c.functions[v.Ident.Name], v)
+		}
+	case *ast.DoExpr:
+		c.dos = append(c.dos, v)
+	}
+	for _, child := range ast.Children(expr) {
+		if err := c.collect(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check the arguments of a do expression against the declaration of its
+// effect. Types are only checked when they are known without running the
+// program, the rest are checked at runtime.
+func (c *effectChecker) checkDo(do *ast.DoExpr) error {
+	effect, ok := c.effects[do.Ident.Name]
+	if !ok {
+		return nil
+	}
+	if len(do.Arguments) != len(effect.Params) {
+		return codeError(do, fmt.Sprintf(
+			"Performing effect '%s' with %d arguments, expected %d",
+			effect.Ident.Name,
+			len(do.Arguments),
+			len(effect.Params),
+		))
+	}
+	if !c.options.TypeChecks {
+		return nil
+	}
+	for i, param := range effect.Params {
+		typ := staticType(do.Arguments[i])
+		if param.Type == nil || typ == "" || typ == param.Type.Name {
+			continue
+		}
+		return codeError(do.Arguments[i], fmt.Sprintf(
+			"%s in effect '%s': parameter '%s' expected %s, got %s",
+			runtimeErrorText(TYPE_ERROR),
+			effect.Ident.Name,
+			param.Name.Name,
+			param.Type.Name,
+			typ,
+		))
+	}
+	return nil
+}
+
+// Call report with each effect that might be performed by expr without being
+// handled inside it. The site is the do expression or the call that performs
+// the effect, callee is the name of the called function for calls. Calls of
+// names in locals are not followed since they might not be the functions.
+func (c *effectChecker) walk(expr ast.Expr, locals map[string]bool, report func(effect string, site ast.Expr, callee string)) {
+	switch v := expr.(type) {
+	case *ast.DoExpr:
+		for _, arg := range v.Arguments {
+			c.walk(arg, locals, report)
+		}
+		if v.Ident.Name != EXN_EFFECT {
+			report(v.Ident.Name, v, "")
+		}
+		return
+	case *ast.CallExpr:
+		if ident, ok := v.Lhs.(*ast.Ident); ok && !locals[ident.Name] {
+			for _, fn := range c.functions[ident.Name] {
+				for effect := range c.performs[fn] {
+					report(effect, v, ident.Name)
+				}
+			}
+		}
+	case *ast.FuncDefExpr:
+		// The body is run when the function is called
+		return
+	case *ast.TryExpr:
+		handled := map[string]bool{}
+		for _, handler := range v.HandleBlock {
+			handled[handler.Pattern.Ident.Name] = true
+		}
+		c.walk(v.TryBlock, locals, func(effect string, site ast.Expr, callee string) {
+			if !handled[effect] {
+				report(effect, site, callee)
+			}
+		})
+		// Handlers run outside the try block
+		for _, child := range ast.Children(v)[1:] {
+			c.walk(child, locals, report)
+		}
+		return
+	}
+	for _, child := range ast.Children(expr) {
+		c.walk(child, locals, report)
+	}
+}
+
+// The parameters and assigned variables of a function body, not counting
+// those of nested functions
+func localNames(body *ast.BlockExpr, params []*ast.ParamExpr) map[string]bool {
+	locals := map[string]bool{}
+	for _, param := range params {
+		locals[param.Name.Name] = true
+	}
+	var find func(expr ast.Expr)
+	find = func(expr ast.Expr) {
+		switch v := expr.(type) {
+		case *ast.FuncDefExpr:
+			return
+		case *ast.AssignExpr:
+			if ident, ok := v.Left.(*ast.Ident); ok {
+				locals[ident.Name] = true
+			}
+		case *ast.ForInExpr:
+			addPatternNames(locals, v.Var)
+		}
+		for _, child := range ast.Children(expr) {
+			find(child)
+		}
+	}
+	find(body)
+	return locals
+}
+
+// Add the identifiers that a destructuring assignment to pattern assigns
+func addPatternNames(names map[string]bool, pattern ast.Expr) {
+	switch v := pattern.(type) {
+	case *ast.Ident:
+		names[v.Name] = true
+	case *ast.ListExpr:
+		for _, elem := range v.Elems {
+			addPatternNames(names, elem)
+		}
+	}
+}
+
+// The name of the type of expr if it's known without running the program,
+// otherwise ""
+func staticType(expr ast.Expr) string {
+	switch v := expr.(type) {
+	case *ast.BasicLit:
+		switch v.Kind {
+		case lexer.INT:
+			return IntType.Name
+		case lexer.STRING:
+			return StringType.Name
+		case lexer.BOOL:
+			return BoolType.Name
+		case lexer.UNIT:
+			return NilType.Name
+		}
+	case *ast.ListExpr:
+		return ListType.Name
+	case *ast.MapExpr:
+		return MapType.Name
+	case *ast.ParenthExpr:
+		return staticType(v.Inside)
+	}
+	return ""
+}
@@ -0,0 +1,107 @@
+package interpret
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/rymdhund/wosh/parser"
+)
+
+func compileWarnings(t *testing.T, prog string) ([]string, error) {
+	t.Helper()
+	block, _, err := parser.NewParser(prog).Parse()
+	if err != nil {
+		t.Fatalf("Error parsing `%s`: %s", prog, err)
+	}
+	warnings := []string{}
+	options := DefaultCompileOptions
+	options.HostEffects = []string{"now"}
+	options.Warn = func(w *Warning) {
+		warnings = append(warnings, w.Msg)
+	}
+	_, err = CompileProgram(block, options)
+	return warnings, err
+}
+
+func TestEffectDeclarationErrors(t *testing.T) {
+	tests := []struct {
+		prog string
+		msg  string
+	}{
+		{"effect log(msg: Str)\ntry { do log(1, 2) } handle { log(a, b) -> 1 }", "Performing effect 'log' with 2 arguments, expected 1"},
+		{"effect log(msg: Str)\ntry { do log(1) } handle { log(a) -> 1 }", "Unexpected type in effect 'log': parameter 'msg' expected Str, got Int"},
+		{"effect log(msg: List)\ntry { do log({}) } handle { log(a) -> 1 }", "parameter 'msg' expected List, got Map"},
+		{"effect log(msg)\neffect log(msg)", "Effect 'log' is already declared"},
+		{"effect exn(e)", "Can't declare the built-in effect 'exn'"},
+	}
+	for _, test := range tests {
+		_, err := compileWarnings(t, test.prog)
+		if err == nil || !strings.Contains(err.Error(), test.msg) {
+			t.Errorf("Expected error '%s' compiling `%s`, got %v", test.msg, test.prog, err)
+		}
+	}
+
+	// Arguments with types that aren't known are checked at runtime
+	if _, err := compileWarnings(t, "effect log(msg: Str)\nx = 1\ntry { do log(x) } handle { log(a) -> 1 }"); err != nil {
+		t.Errorf("Unexpected error %s", err)
+	}
+}
+
+func TestUnhandledEffectWarnings(t *testing.T) {
+	tests := []struct {
+		prog     string
+		warnings []string
+	}{
+		{"do log(1)", []string{"Effect 'log' is not handled"}},
+		{"try { do log(1) } handle { log(x) -> 1 }", []string{}},
+		{"try { do log(1) } handle { other(x) -> 1 }", []string{"Effect 'log' is not handled"}},
+
+		// Exceptions are reported when they are raised
+		{"do exn('x')", []string{}},
+
+		// Across calls
+		{`
+		fn f() { do log(1) }
+		fn g() { f() }
+		g()`, []string{"Effect 'log' performed by 'g' is not handled"}},
+		{`
+		fn f() { do log(1) }
+		fn g() { try { f() } handle { log(x) -> 1 } }
+		g()`, []string{}},
+		{`
+		fn f(n) {
+			if n == 0 { do done(1) } else { g(n - 1) }
+		}
+		fn g(n) { f(n) }
+		f(3)`, []string{"Effect 'done' performed by 'f' is not handled"}},
+
+		// Handlers run outside their try block
+		{`
+		try { do log(1) } handle {
+			log(x) @ k -> { resume k do log(x) }
+		}`, []string{"Effect 'log' is not handled"}},
+		{`
+		try { 1 } handle { return(x) -> do log(x) }`, []string{"Effect 'log' is not handled"}},
+
+		// Functions that are only defined or passed around can't be inferred
+		{"fn f() { do log(1) }\ng = (x) => do log(x)", []string{}},
+		{"fn f() { do log(1) }\nfn g(f) { f() }\ng((x) => 1)", []string{}},
+
+		// Loop variables are locals too
+		{"fn f() { do log(1) }\ng = () => 1\nfor f in [g] { f() }", []string{}},
+		{"fn f() { do log(1) }\ng = () => 1\nfor [x, f] in [[1, g]] { f() }", []string{}},
+
+		// Effects with go handlers are handled by the host
+		{"do now()\ndo log(1)", []string{"Effect 'log' is not handled"}},
+	}
+	for _, test := range tests {
+		warnings, err := compileWarnings(t, test.prog)
+		if err != nil {
+			t.Errorf("Error compiling `%s`: %s", test.prog, err)
+			continue
+		}
+		if strings.Join(warnings, "\n") != strings.Join(test.warnings, "\n") {
+			t.Errorf("Expected warnings %v for `%s`, got %v", test.warnings, test.prog, warnings)
+		}
+	}
+}
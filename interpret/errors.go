@@ -1,5 +1,92 @@
 package interpret
 
+import (
+	"fmt"
+	"strings"
+)
+
+type RuntimeError struct {
+	Line  int // counting from 1
+	Col   int // counting from 1
+	Msg   string
+	Exn   *ExnValue    // the exception passed to exn handlers
+	Trace []StackEntry // the frames active when the error was raised, innermost first
+
+	// Number of frames left out between the innermost and the outermost half
+	// of Trace
+	Omitted int
+}
+
+func (e *RuntimeError) Error() string {
+	return fmt.Sprintf("Runtime Error on line %d: %s", e.Line, e.Msg)
+}
+
+// The error with a stack trace and the source line of each frame
+func (e *RuntimeError) Traceback() string {
+	s := "Traceback (most recent call last):\n"
+	for i := len(e.Trace) - 1; i >= 0; i-- {
+		s += e.Trace[i].Show()
+		if e.Omitted > 0 && i == len(e.Trace)/2 {
+			s += fmt.Sprintf("  ... %d more frames ...\n", e.Omitted)
+		}
+	}
+	return s + e.Error()
+}
+
+// A source file that code is compiled from
+type Source struct {
+	Name  string
+	Lines []string
+}
+
+func NewSource(name string, content string) *Source {
+	return &Source{name, strings.Split(content, "\n")}
+}
+
+// Source line counting from 1, or "" if it's unknown
+func (s *Source) Line(line int) string {
+	if s == nil || line < 1 || line > len(s.Lines) {
+		return ""
+	}
+	return s.Lines[line-1]
+}
+
+type StackEntry struct {
+	Function string
+	SourcePos
+}
+
+func (e StackEntry) FileName() string {
+	if e.File == nil {
+		return "unknown"
+	}
+	return e.File.Name
+}
+
+// Show the entry with its code underlined, like ast.CodeError.ShowError
+func (e StackEntry) Show() string {
+	s := fmt.Sprintf("  File \"%s\", line %d:%d, in %s\n", e.FileName(), e.Line(), e.Col(), e.Function)
+	line := strings.TrimRight(e.File.Line(e.Line()), "\r")
+	start := e.Area.Start.Col
+	end := e.Area.End.Col
+	if !e.Area.IsSingleLine() || end > len(line) {
+		end = len(line)
+	}
+	if start >= end {
+		return s
+	}
+	// Keep tabs in the indentation so that the marker lines up
+	indent := strings.Map(func(r rune) rune {
+		if r == '\t' {
+			return r
+		}
+		return ' '
+	}, line[:start])
+	s += fmt.Sprintf("    %s\n", line)
+	s += fmt.Sprintf("    %s%s\n", indent, strings.Repeat("^", end-start))
+	return s
+}
+
 // Runtime errors
 const (
 	NO_ERROR = iota
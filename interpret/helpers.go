@@ -65,7 +65,27 @@ func builtinEq(a, b Value) *BoolValue {
 		} else {
 			return NewBool(t.typ == t2.typ)
 		}
+	case *RangeValue:
+		r2, ok := b.(*RangeValue)
+		return NewBool(ok && t.Eq(r2))
 	default:
 		return nil
 	}
 }
+
+// Returns nil if we don't have less implementation for the types
+func builtinLess(a, b Value) *BoolValue {
+	switch l := a.(type) {
+	case *IntValue:
+		r, ok := b.(*IntValue)
+		if ok {
+			return NewBool(l.Val < r.Val)
+		}
+	case *StringValue:
+		r, ok := b.(*StringValue)
+		if ok {
+			return NewBool(l.Val < r.Val)
+		}
+	}
+	return nil
+}
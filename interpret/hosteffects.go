@@ -0,0 +1,72 @@
+package interpret
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// Returned from a run when the script performs the exit effect of the
+// default handlers. Like a limit error it can't be caught by wosh code, and
+// finally blocks are not run.
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("Exited with code %d", e.Code)
+}
+
+// Add go handlers of the effects that the top level of a program provides:
+//
+//	log(values...)  write the values to out on a line
+//	read_line()     a line from in without the line break, or () at the end
+//	now()           milliseconds since the unix epoch
+//	random(n)       a random Int from 0 up to, but not including, n
+//	exit(code)      stop the program with an *ExitError
+//
+// Since they are effects, scripts can handle them with try to override them,
+// which makes the I/O of a script easy to mock in tests.
+func (vm *VM) HandleDefaultEffects(in io.Reader, out io.Writer) {
+	reader := bufio.NewReader(in)
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	vm.HandleEffect("log", NewVariadicBuiltin("log", 0, VARIADIC, func(vm *VM, args []Value) (Value, error) {
+		parts := make([]string, len(args))
+		for i, arg := range args {
+			if s, ok := arg.(*StringValue); ok {
+				parts[i] = s.Val
+			} else {
+				parts[i] = arg.String()
+			}
+		}
+		_, err := fmt.Fprintln(out, strings.Join(parts, " "))
+		return Nil, err
+	}))
+	vm.HandleEffect("read_line", NewBuiltin("read_line", 0, func(vm *VM, args []Value) (Value, error) {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return Nil, nil
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		return NewString(strings.TrimSuffix(line, "\r")), nil
+	}))
+	vm.HandleEffect("now", NewBuiltin("now", 0, func(vm *VM, args []Value) (Value, error) {
+		return NewInt(int(time.Now().UnixNano() / int64(time.Millisecond))), nil
+	}))
+	vm.HandleEffect("random", mustBuiltinFromFunc("random", func(n int) (int, error) {
+		if n <= 0 {
+			return 0, fmt.Errorf("expected a positive Int, got %d", n)
+		}
+		return rnd.Intn(n), nil
+	}))
+	vm.HandleEffect("exit", mustBuiltinFromFunc("exit", func(code int) error {
+		return &ExitError{code}
+	}))
+}
@@ -1,15 +1,24 @@
 package interpret
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 	"unicode/utf8"
+
+	"github.com/rymdhund/wosh/sandbox"
 )
 
-const FRAMES_MAX = 64
-const STACK_MAX = 256
+const FRAMES_MAX = 1024       // default max call depth
+const STACK_MAX = 1 << 16     // default max number of values on the stack of a frame
+const MAX_TRACE = 20          // frames kept in the traceback of a stack overflow
+const CHECK_INTERVAL = 1024   // instructions between checks of the run limits
+const INITIAL_STACK_SIZE = 16 // stack slots allocated for temporaries when a frame is created
 const DEBUG_TRACE = false
 
 type VM struct {
@@ -17,136 +26,425 @@ type VM struct {
 	frameCount   int // for debug purposes
 	currentFrame *CallFrame
 	globals      map[string]Value
+	level        *runLevel
+	limits       Limits
+	sandbox      *sandbox.Policy // nil if scripts may do anything
+
+	// State of the current run for checking the limits
+	ctx          context.Context
+	deadline     time.Time // zero if there is no timeout
+	instructions int       // instructions run before the current interval
+	interval     int       // instructions in the current interval
+	untilCheck   int       // instructions left of the current interval
+	allocations  int
+
+	// Methods defined in wosh, layered over the builtins of each type
+	methods map[*Type]FunctionMap
+
+	// Effects declared by the programs run in the vm
+	effects map[string]*EffectValue
+
+	// Go handlers of effects that no wosh handler handles
+	hostHandlers map[string]*BuiltinValue
+
+	// Tasks of the current run
+	scheduler *scheduler
+}
+
+// Limits on the resources used by a program. Exceeding the call depth or
+// stack size raises a stack overflow error, exceeding one of the limits of a
+// run stops it with a LimitError.
+type Limits struct {
+	MaxCallDepth int // number of nested calls, 0 means FRAMES_MAX
+	MaxStackSize int // number of values on the stack of a call, 0 means STACK_MAX
+
+	// Limits of a run of Interpret or Call from go code, 0 means no limit
+	MaxInstructions int
+	Timeout         time.Duration
+	MaxAllocations  int // values created by instructions, see allocationSize
+}
+
+// Returned when a run is stopped because it exceeded a limit or its context
+// is done. Unlike runtime errors it can't be caught by wosh code.
+type LimitError struct {
+	Msg string
+	Err error // the error of the context, if it's done
+}
+
+func (e *LimitError) Error() string {
+	return e.Msg
+}
+
+func (e *LimitError) Unwrap() error {
+	return e.Err
+}
+
+// A run level is one invocation of the dispatch loop. Calls from go code into
+// wosh code run in a nested level.
+type runLevel struct {
+	depth int
+	done  bool // set when the go call that started the level has returned
+}
+
+// Returned by a nested dispatch loop when control is transferred to a frame
+// that belongs to an outer level, like when an effect handler in an outer
+// frame finishes without resuming. Builtins must return it unchanged.
+type unwindError struct {
+	level  *runLevel // the level that should catch the error
+	result Value     // set if the level should return this value
+}
+
+func (e *unwindError) Error() string {
+	return "Unwinding a call from go code"
 }
 
 type CallFrame struct {
 	closure     *ClosureValue
 	ip          int
-	code        []Op // points to chunk code
-	stack       [STACK_MAX]Value
+	code        []Op       // points to chunk code
+	stack       []Value    // grows when needed
 	stackTop    int        // points to next unused element in stack
+	wide        bool       // the current instruction has an OP_WIDE prefix
 	returnFrame *CallFrame // which frame to return to
 	returnIp    int
 	//resumeFrame int // which frame to resume to
 
-	// Handlers for effects
+	// Handlers for effects and finally blocks
 	handlers []Handler
+
+	// Aborts waiting for the finally blocks running in this frame to end
+	aborts []pendingAbort
+
+	// Set on frames of closures called from go code. Returning from such a
+	// frame exits the nested dispatch loop instead of continuing in returnFrame
+	hostCall bool
+
+	// The run level the frame was created in
+	level *runLevel
+
+	// Number of frames up to the outermost one, counting this frame
+	depth int
 }
 
 type Handler struct {
 	effect string
 	//handler  *ClosureValue
 	//doneLine int // line to land at after handler returns
-	frame *CallFrame
-	ip    int // instruction pointer
+	frame    *CallFrame
+	ip       int  // instruction pointer
+	base     int  // number of handlers in the frame before the ones of this try
+	stackTop int  // stack size of the frame when the try started
+	finally  bool // ip points to a finally block instead of a handler
+
+	// Set on the handlers of generators and tasks, which are handled in go
+	coroutine *coroutine
+}
+
+// Name of the built-in effect that raised exceptions and runtime errors are
+// performed as. Its handlers get a continuation that can't be resumed.
+const EXN_EFFECT = "exn"
+
+// A transfer of control out of try blocks, like when an exception is caught.
+// The finally blocks of the aborted try blocks are run before continuing in
+// the target frame.
+type abort struct {
+	finallies []Handler // finally blocks left to run, innermost first
+
+	frame    *CallFrame
+	ip       int
+	base     int     // handlers of the frame from this index are dropped
+	stackTop int     // stack size of the frame before values are pushed
+	values   []Value // values to push on the stack of the frame
+	err      error   // returned instead of continuing in the frame if set
+}
+
+type pendingAbort struct {
+	base  int // number of handlers in the frame before the finally block
+	abort *abort
 }
 
-func builtinReadlines(file Value) Value {
-	filename := file.(*StringValue).Val
+func builtinReadlines(vm *VM, args []Value) (Value, error) {
+	filename, err := GetString(args[0])
+	if err != nil {
+		return nil, err
+	}
+	if err := vm.sandbox.CheckRead(filename); err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read file: %s", filename)
+	}
+	if err := vm.reserve(1 + int(info.Size())); err != nil {
+		return nil, err
+	}
 	content, err := ioutil.ReadFile(filename)
 	if err != nil {
-		panic(fmt.Sprintf("Can't read file: %s", filename))
+		return nil, fmt.Errorf("Can't read file: %s", filename)
+	}
+	lines := ListNil()
+	parts := strings.Split(strings.Trim(string(content), "\n"), "\n")
+	for i := len(parts) - 1; i >= 0; i-- {
+		lines = ListCons(NewString(parts[i]), lines)
 	}
-	lines := strings.Split(strings.Trim(string(content), "\n"), "\n")
+	return lines, nil
+}
 
-	list := ListNil()
-	for i := len(lines) - 1; i >= 0; i-- {
-		list = ListCons(NewString(lines[i]), list)
+func builtinWritefile(vm *VM, args []Value) (Value, error) {
+	filename, err := GetString(args[0])
+	if err != nil {
+		return nil, err
+	}
+	content, err := GetString(args[1])
+	if err != nil {
+		return nil, err
 	}
-	return list
+	if err := vm.sandbox.CheckWrite(filename); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		return nil, fmt.Errorf("Can't write file: %s", filename)
+	}
+	return Nil, nil
 }
 
-func builtinLen(v Value) Value {
-	switch x := v.(type) {
-	case *ListValue:
-		return NewInt(x.len)
-	case *MapValue:
-		return NewInt(len(x.Map))
-	case *StringValue:
-		return NewInt(utf8.RuneCountInString(x.Val))
-	default:
-		panic(fmt.Sprintf("%v does not support len()", v))
+func builtinGetenv(vm *VM, args []Value) (Value, error) {
+	name, err := GetString(args[0])
+	if err != nil {
+		return nil, err
 	}
+	if err := vm.sandbox.CheckEnv(name); err != nil {
+		return nil, err
+	}
+	return NewString(os.Getenv(name)), nil
 }
 
-func builtinStr(value Value) Value {
-	return NewString(value.String())
+// Run a command and return its output
+func builtinExec(vm *VM, args []Value) (Value, error) {
+	parts := make([]string, len(args))
+	for i, arg := range args {
+		s, err := GetString(arg)
+		if err != nil {
+			return nil, err
+		}
+		parts[i] = s
+	}
+	if err := vm.sandbox.CheckCommand(parts[0]); err != nil {
+		return nil, err
+	}
+	return vm.runCommand(parts[0], parts[1:])
 }
 
-func builtinPrintln(value Value) Value {
-	switch v := value.(type) {
+func builtinLen(vm *VM, args []Value) (Value, error) {
+	switch x := args[0].(type) {
+	case *ListValue:
+		return NewInt(x.len), nil
+	case *MapValue:
+		return NewInt(len(x.Map)), nil
 	case *StringValue:
-		println(v.Val)
+		return NewInt(utf8.RuneCountInString(x.Val)), nil
+	case *RangeValue:
+		return NewInt(x.Len()), nil
 	default:
-		println(value.String())
+		return nil, fmt.Errorf("%v does not support len()", x)
 	}
-	return Nil
 }
 
-func builtinAtoi(value Value) Value {
-	i, err := strconv.Atoi(value.(*StringValue).Val)
-	if err != nil {
-		panic(err)
+func builtinStr(vm *VM, args []Value) (Value, error) {
+	return NewString(args[0].String()), nil
+}
+
+func builtinPrintln(values ...Value) {
+	parts := make([]string, len(values))
+	for i, value := range values {
+		switch v := value.(type) {
+		case *StringValue:
+			parts[i] = v.Val
+		default:
+			parts[i] = value.String()
+		}
 	}
-	return NewInt(i)
+	println(strings.Join(parts, " "))
 }
 
-func builtinOrd(value Value) Value {
-	s := []rune(value.(*StringValue).Val)
-	if len(s) != 1 {
-		panic("Ord expected string of length 1")
+func builtinOrd(s string) (int, error) {
+	runes := []rune(s)
+	if len(runes) != 1 {
+		return 0, fmt.Errorf("Ord expected string of length 1")
 	}
-	return NewInt(int(s[0]))
+	return int(runes[0]), nil
 }
 
-func builtinAssert(value Value, message Value) Value {
-	if !value.(*BoolValue).Val {
-		panic(fmt.Sprintf("Assertion error: %s", message))
+func builtinAssert(vm *VM, args []Value) (Value, error) {
+	b, ok := args[0].(*BoolValue)
+	if !ok {
+		return nil, fmt.Errorf("expected Bool, got %s", args[0].Type().Name)
+	}
+	if !b.Val {
+		if len(args) > 1 {
+			return nil, fmt.Errorf("Assertion error: %s", args[1])
+		}
+		return nil, fmt.Errorf("Assertion error")
 	}
-	return Nil
+	return Nil, nil
 }
 
-func builtinItems(v Value) Value {
-	switch x := v.(type) {
+func builtinItems(vm *VM, args []Value) (Value, error) {
+	switch x := args[0].(type) {
 	case *MapValue:
 		pairs := ListNil()
 		for k, v := range x.Map {
 			pairs = ListCons(ListCons(NewString(k), ListCons(v, ListNil())), pairs)
 		}
-		return pairs
+		return pairs, nil
 	default:
-		panic(fmt.Sprintf("%v does not support items()", v))
+		return nil, fmt.Errorf("%v does not support items()", x)
 	}
 }
 
-func builtinTypeof(v Value) Value {
-	return NewTypeValue(v.Type())
+func builtinTypeof(vm *VM, args []Value) (Value, error) {
+	return NewTypeValue(args[0].Type()), nil
+}
+
+func builtinRaise(vm *VM, args []Value) (Value, error) {
+	return nil, vm.currentFrame.raise(args[0])
 }
 
 func NewVm() *VM {
 	globals := map[string]Value{}
 	globals["readlines"] = NewBuiltin("readlines", 1, builtinReadlines)
+	globals["writefile"] = NewBuiltin("writefile", 2, builtinWritefile)
+	globals["getenv"] = NewBuiltin("getenv", 1, builtinGetenv)
+	globals["exec"] = NewVariadicBuiltin("exec", 1, VARIADIC, builtinExec)
 	globals["str"] = NewBuiltin("str", 1, builtinStr)
-	globals["println"] = NewBuiltin("println", 1, builtinPrintln)
-	globals["atoi"] = NewBuiltin("atoi", 1, builtinAtoi)
+	globals["println"] = mustBuiltinFromFunc("println", builtinPrintln)
+	globals["atoi"] = mustBuiltinFromFunc("atoi", strconv.Atoi)
 	globals["len"] = NewBuiltin("len", 1, builtinLen)
-	globals["ord"] = NewBuiltin("ord", 1, builtinOrd)
-	globals["assert"] = NewBuiltin("assert", 2, builtinAssert)
+	globals["ord"] = mustBuiltinFromFunc("ord", builtinOrd)
+	globals["assert"] = NewVariadicBuiltin("assert", 1, 2, builtinAssert)
 	globals["items"] = NewBuiltin("items", 1, builtinItems)
 	globals["typeof"] = NewBuiltin("typeof", 1, builtinTypeof)
-
-	globals["Nil"] = NewTypeValue(BoolType)
+	globals["raise"] = NewBuiltin("raise", 1, builtinRaise)
+	globals["generator"] = NewBuiltin("generator", 1, builtinGenerator)
+	globals["iter"] = NewBuiltin("iter", 1, builtinIter)
+	globals["spawn"] = NewBuiltin("spawn", 1, builtinSpawn)
+	globals["sleep"] = NewBuiltin("sleep", 1, builtinSleep)
+	globals["chan"] = NewVariadicBuiltin("chan", 0, 1, builtinChan)
+
+	globals["Nil"] = NewTypeValue(NilType)
 	globals["Bool"] = NewTypeValue(BoolType)
 	globals["Int"] = NewTypeValue(IntType)
 	globals["Str"] = NewTypeValue(StringType)
 	globals["List"] = NewTypeValue(ListType)
 	globals["Map"] = NewTypeValue(MapType)
+	globals["Exception"] = NewTypeValue(ExceptionType)
+	globals["Iterator"] = NewTypeValue(IteratorType)
+	globals["Range"] = NewTypeValue(RangeType)
+	globals["Task"] = NewTypeValue(TaskType)
+	globals["Chan"] = NewTypeValue(ChannelType)
+
+	vm := &VM{
+		globals:      globals,
+		methods:      map[*Type]FunctionMap{},
+		effects:      map[string]*EffectValue{},
+		hostHandlers: map[string]*BuiltinValue{},
+		scheduler:    newScheduler(),
+	}
+	vm.SetLimits(Limits{})
+	return vm
+}
+
+func (vm *VM) SetLimits(limits Limits) {
+	if limits.MaxCallDepth <= 0 {
+		limits.MaxCallDepth = FRAMES_MAX
+	}
+	if limits.MaxStackSize <= 0 {
+		limits.MaxStackSize = STACK_MAX
+	}
+	vm.limits = limits
+}
+
+// Handle the effect with a go function when there is no wosh handler for it.
+// Scripts can still handle it with try, like when mocking it in tests. A nil
+// handler removes the go handler.
+func (vm *VM) HandleEffect(name string, handler *BuiltinValue) {
+	if handler == nil {
+		delete(vm.hostHandlers, name)
+		return
+	}
+	vm.hostHandlers[name] = handler
+}
+
+// Names of the effects with go handlers, sorted
+func (vm *VM) HostEffects() []string {
+	names := make([]string, 0, len(vm.hostHandlers))
+	for name := range vm.hostHandlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Restrict what scripts may do outside of the vm, nil removes the restrictions.
+// Builtins check the policy and raise permission errors.
+func (vm *VM) SetSandbox(policy *sandbox.Policy) {
+	vm.sandbox = policy
+}
+
+// The policy that go functions called by scripts should check
+func (vm *VM) Sandbox() *sandbox.Policy {
+	return vm.sandbox
+}
+
+func (vm *VM) MethodNames(typ *Type) []string {
+	methods := vm.methods[typ]
+	names := make([]string, 0, len(methods)+len(typ.Builtins))
+	for _, method := range methods {
+		names = append(names, method.Name)
+	}
+	for name := range typ.Builtins {
+		if _, ok := methods[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Returns the method with the given name as a closure or builtin
+func (vm *VM) lookupMethod(typ *Type, name string) (Value, bool) {
+	if method, ok := vm.methods[typ][name]; ok {
+		return NewClosure(method, []*BoxValue{}), true
+	}
+	if builtin, ok := typ.Builtins[name]; ok {
+		return builtin, true
+	}
+	return nil, false
+}
+
+func (vm *VM) setMethod(typ *Type, name string, method *FunctionValue) {
+	methods, ok := vm.methods[typ]
+	if !ok {
+		methods = FunctionMap{}
+		vm.methods[typ] = methods
+	}
+	methods[name] = method
+}
+
+func (vm *VM) GetGlobal(name string) (Value, bool) {
+	v, ok := vm.globals[name]
+	return v, ok
+}
 
-	return &VM{globals: globals}
+func (vm *VM) SetGlobal(name string, v Value) {
+	vm.globals[name] = v
 }
 
 func (frame *CallFrame) pushStack(v Value) {
-	frame.stack[frame.stackTop] = v
+	if frame.stackTop == len(frame.stack) {
+		frame.stack = append(frame.stack, v)
+	} else {
+		frame.stack[frame.stackTop] = v
+	}
 	frame.stackTop += 1
 }
 
@@ -165,6 +463,21 @@ func (frame *CallFrame) replaceStack(offset int, v Value) {
 
 func (vm *VM) NewFrame(cl *ClosureValue, args []Value, returnFrame *CallFrame, returnIp int) *CallFrame {
 	frame := &CallFrame{} //&vm.frames[vm.currentFrame]
+	frame.stack = make([]Value, 0, len(cl.Function.Chunk.LocalNames)+INITIAL_STACK_SIZE)
+	frame.setupCall(cl, args)
+	frame.returnFrame = returnFrame
+	frame.returnIp = returnIp
+	frame.depth = 1
+	if returnFrame != nil {
+		frame.depth = returnFrame.depth + 1
+	}
+	frame.level = vm.level
+	vm.frameCount++
+	return frame
+}
+
+// Set up an empty frame to run a call of cl
+func (frame *CallFrame) setupCall(cl *ClosureValue, args []Value) {
 	frame.closure = cl
 	frame.ip = 0
 	frame.pushStack(cl)
@@ -183,17 +496,167 @@ func (vm *VM) NewFrame(cl *ClosureValue, args []Value, returnFrame *CallFrame, r
 	for i, x := range cl.Function.CaptureSlots {
 		frame.stack[x] = cl.Captures[i]
 	}
-	frame.returnFrame = returnFrame
-	frame.returnIp = returnIp
-	vm.frameCount++
-	return frame
 }
 
 func (vm *VM) Interpret(main *FunctionValue) (Value, error) {
+	return vm.InterpretContext(context.Background(), main)
+}
+
+// Interpret main, stopping with a LimitError if ctx is done
+func (vm *VM) InterpretContext(ctx context.Context, main *FunctionValue) (res Value, err error) {
 	vm.frameCount = 0
+	vm.level = &runLevel{}
+	vm.startRun(ctx)
 	frame := vm.NewFrame(NewClosure(main, []*BoxValue{}), []Value{}, nil, -1)
 	vm.currentFrame = frame
-	return vm.run()
+	defer func() {
+		if r := recover(); r != nil {
+			res, err = nil, vm.internalError(r)
+		}
+		vm.currentFrame = nil
+	}()
+	res, err = vm.run()
+	if err == nil {
+		// Spawned tasks run to the end with the program
+		err = vm.finishTasks()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Turn a go panic into an error so that a bug in the vm doesn't crash the host
+func (vm *VM) internalError(r interface{}) error {
+	if vm.currentFrame == nil {
+		return fmt.Errorf("Internal error: %v", r)
+	}
+	return vm.currentFrame.runtimeError(fmt.Sprintf("Internal error: %v", r))
+}
+
+// Function of the frame that calls from an embedder start from
+var hostFunction = &FunctionValue{Name: "<host>", Chunk: NewChunk()}
+
+// Call a closure, builtin or constructor from go code. It can be used by
+// builtins while the vm is running as well as by embedders between runs.
+func (vm *VM) Call(callable Value, args ...Value) (Value, error) {
+	return vm.CallContext(context.Background(), callable, args...)
+}
+
+// Call from go code, stopping with a LimitError if ctx is done. When called
+// while the vm is running, the call is part of the current run and ctx is
+// ignored.
+func (vm *VM) CallContext(ctx context.Context, callable Value, args ...Value) (res Value, err error) {
+	if vm.currentFrame == nil {
+		vm.level = &runLevel{}
+		vm.startRun(ctx)
+		vm.currentFrame = vm.NewFrame(NewClosure(hostFunction, []*BoxValue{}), []Value{}, nil, -1)
+		defer func() {
+			if r := recover(); r != nil {
+				res, err = nil, vm.internalError(r)
+			}
+			vm.currentFrame = nil
+		}()
+	}
+	return vm.call(callable, args)
+}
+
+// Reset the limits for a new run
+func (vm *VM) startRun(ctx context.Context) {
+	vm.ctx = ctx
+	vm.deadline = time.Time{}
+	if vm.limits.Timeout > 0 {
+		vm.deadline = time.Now().Add(vm.limits.Timeout)
+	}
+	vm.instructions = 0
+	vm.interval = 0
+	vm.untilCheck = 0
+	vm.allocations = 0
+	vm.scheduler = newScheduler()
+}
+
+// Check the limits of the run. It's done every CHECK_INTERVAL instructions,
+// and exactly when the instruction limit is reached.
+func (vm *VM) checkLimits() error {
+	vm.instructions += vm.interval
+	max := vm.limits.MaxInstructions
+	if max > 0 && vm.instructions >= max {
+		return &LimitError{Msg: fmt.Sprintf("Instruction limit of %d exceeded", max)}
+	}
+	if err := vm.checkTime(); err != nil {
+		return err
+	}
+	vm.interval = CHECK_INTERVAL
+	if max > 0 && max-vm.instructions < vm.interval {
+		vm.interval = max - vm.instructions
+	}
+	vm.untilCheck = vm.interval
+	return nil
+}
+
+// Check if the run is stopped by its context or its timeout
+func (vm *VM) checkTime() error {
+	if err := vm.ctx.Err(); err != nil {
+		return &LimitError{Msg: fmt.Sprintf("Run stopped: %s", err), Err: err}
+	}
+	if !vm.deadline.IsZero() && time.Now().After(vm.deadline) {
+		return &LimitError{Msg: fmt.Sprintf("Timeout of %s exceeded", vm.limits.Timeout)}
+	}
+	return nil
+}
+
+// Count the allocation of a value created by an instruction
+func (vm *VM) allocate(v Value) error {
+	vm.allocations += allocationSize(v)
+	if vm.allocations > vm.limits.MaxAllocations {
+		return &LimitError{Msg: fmt.Sprintf("Allocation limit of %d exceeded", vm.limits.MaxAllocations)}
+	}
+	return nil
+}
+
+// Check that a builtin can allocate n values before it allocates them, so
+// that one call can't go far past the limit. Its result is counted like the
+// results of other instructions when it returns.
+func (vm *VM) reserve(n int) error {
+	max := vm.limits.MaxAllocations
+	if max > 0 && n > max-vm.allocations {
+		return &LimitError{Msg: fmt.Sprintf("Allocation limit of %d exceeded", max)}
+	}
+	return nil
+}
+
+// Values count as one, strings, lists and maps also count their length
+func allocationSize(v Value) int {
+	switch v := v.(type) {
+	case *StringValue:
+		return 1 + len(v.Val)
+	case *ListValue:
+		return 1 + v.len
+	case *MapValue:
+		return 1 + len(v.Map)
+	case *CustomValue:
+		return 1 + len(v.Attributes)
+	default:
+		return 1
+	}
+}
+
+// Instructions that leave a new value on the stack. Tail calls count their
+// results in opTailCall, since a reused frame doesn't leave one.
+var allocatingOps = map[Op]bool{
+	OP_ADD:          true,
+	OP_SUB:          true,
+	OP_MULT:         true,
+	OP_DIV:          true,
+	OP_MOD:          true,
+	OP_NEG:          true,
+	OP_CONS:         true,
+	OP_SUB_SLICE:    true,
+	OP_CREATE_LIST:  true,
+	OP_CREATE_MAP:   true,
+	OP_MAKE_CLOSURE: true,
+	OP_CALL:         true,
+	OP_CALL_METHOD:  true,
 }
 
 func (frame *CallFrame) readCode() Op {
@@ -202,27 +665,42 @@ func (frame *CallFrame) readCode() Op {
 	return op
 }
 
+// Read an arg operand, it's four bytes if the instruction is wide
+func (frame *CallFrame) readArg() int {
+	if frame.wide {
+		return frame.readUint32()
+	}
+	return int(frame.readCode())
+}
+
+// Read a jump operand
+func (frame *CallFrame) readJump() int {
+	return frame.readUint32()
+}
+
+func (frame *CallFrame) readUint32() int {
+	v := frame.closure.Function.Chunk.readBytes4(frame.ip)
+	frame.ip += 4
+	return v
+}
+
 func (frame *CallFrame) readConstant() Value {
-	pos := frame.readCode()
+	pos := frame.readArg()
 	return frame.closure.Function.Chunk.Constants[pos]
 }
 
 func (frame *CallFrame) readFunction() *FunctionValue {
-	pos := frame.readCode()
+	pos := frame.readArg()
 	fn := frame.closure.Function.Chunk.Constants[pos].(*FunctionValue)
 	return fn
 }
 
 func (frame *CallFrame) readName() string {
-	pos := frame.readCode()
+	pos := frame.readArg()
 	return frame.closure.Function.Chunk.Names[pos]
 }
 
-func (frame *CallFrame) readUint16() uint16 {
-	return uint16(frame.readCode())<<8 + uint16(frame.readCode())
-}
-
-func (frame *CallFrame) putSlot(idx uint8, v Value) {
+func (frame *CallFrame) putSlot(idx int, v Value) {
 	frame.stack[idx] = v
 }
 
@@ -230,8 +708,19 @@ func (vm *VM) run() (Value, error) {
 	for true {
 		frame := vm.currentFrame
 
+		if vm.untilCheck == 0 {
+			if err := vm.checkLimits(); err != nil {
+				return nil, err
+			}
+		}
+		vm.untilCheck--
+
 		startIP := frame.ip
 		instr := frame.readCode()
+		frame.wide = instr == OP_WIDE
+		if frame.wide {
+			instr = frame.readCode()
+		}
 
 		if DEBUG_TRACE {
 			fmt.Printf("%-4d %-20s ", startIP, instr)
@@ -243,6 +732,9 @@ func (vm *VM) run() (Value, error) {
 
 		var err error
 		switch instr {
+		case OP_RETURN_NIL:
+			frame.pushStack(Nil)
+			fallthrough
 		case OP_RETURN:
 			retVal := frame.popStack()
 
@@ -250,11 +742,21 @@ func (vm *VM) run() (Value, error) {
 			// todo: clean up references for garbage collection
 
 			if frame.stackTop != 0 {
-				panic("expected empty stack")
+				return nil, frame.runtimeError("Internal error: expected empty stack when returning")
 			}
 
+			// Returning from a frame of an outer level, like when a handler
+			// returns from its function without resuming
+			unwinding := frame.level.depth < vm.level.depth
+
 			// todo: clean up memory
-			if frame.returnFrame == nil {
+			if frame.returnFrame == nil || frame.hostCall {
+				if frame.returnFrame != nil {
+					vm.currentFrame = frame.returnFrame
+				}
+				if unwinding {
+					return nil, &unwindError{frame.level, retVal}
+				}
 				return retVal, nil
 			} else {
 				frame.returnFrame.ip = frame.returnIp
@@ -263,6 +765,9 @@ func (vm *VM) run() (Value, error) {
 				}
 				frame.returnFrame.pushStack(retVal)
 				vm.currentFrame = frame.returnFrame
+				if unwinding {
+					err = &unwindError{frame.level, nil}
+				}
 			}
 		case OP_LOAD_CONSTANT:
 			constant := frame.readConstant()
@@ -330,7 +835,7 @@ func (vm *VM) run() (Value, error) {
 		case OP_LESS:
 			err = frame.opLess()
 		case OP_LESS_EQ:
-			panic("Not implemented")
+			err = frame.runtimeError("Not implemented: OP_LESS_EQ")
 		case OP_NOT:
 			err = frame.opNot()
 		case OP_AND:
@@ -340,11 +845,11 @@ func (vm *VM) run() (Value, error) {
 		case OP_SUBSCRIPT_BINARY:
 			err = frame.opSubscr()
 		case OP_CREATE_LIST:
-			size := int(frame.readCode())
+			size := frame.readArg()
 			frame.opCreateList(size)
 		case OP_CREATE_MAP:
-			size := int(frame.readCode())
-			frame.opCreateMap(size)
+			size := frame.readArg()
+			err = frame.opCreateMap(size)
 		case OP_COPY:
 			frame.pushStack(frame.peekStack(0))
 		case OP_POP:
@@ -356,34 +861,38 @@ func (vm *VM) run() (Value, error) {
 			frame.pushStack(a)
 			frame.pushStack(b)
 		case OP_JUMP:
-			offset := frame.readUint16()
-			frame.ip += int(offset)
+			offset := frame.readJump()
+			frame.ip += offset
 		case OP_JUMP_IF_FALSE:
-			offset := frame.readUint16()
-			if !GetBool(frame.popStack()) {
-				frame.ip += int(offset)
+			offset := frame.readJump()
+			var cond bool
+			cond, err = GetBool(frame.popStack())
+			if err != nil {
+				err = frame.runtimeError(err.Error())
+			} else if !cond {
+				frame.ip += offset
 			}
 		case OP_LOAD_GLOBAL_NAME:
 			name := frame.readName()
-			val, ok := vm.globals[name]
-			if !ok {
-				return nil, frame.runtimeError(fmt.Sprintf("Not defined: %s", name))
+			if val, ok := vm.globals[name]; ok {
+				frame.pushStack(val)
+			} else {
+				err = frame.runtimeError(fmt.Sprintf("Not defined: %s", name))
 			}
-			frame.pushStack(val)
 		case OP_LOOP:
-			offset := frame.readUint16()
-			frame.ip -= int(offset)
+			offset := frame.readJump()
+			frame.ip -= offset
 		case OP_LOAD_SLOT:
-			slot := uint8(frame.readCode())
+			slot := frame.readArg()
 			frame.pushStack(frame.stack[slot])
 		case OP_LOAD_SLOT_HEAP:
-			slot := uint8(frame.readCode())
+			slot := frame.readArg()
 			frame.pushStack(frame.stack[slot].(*BoxValue).Get())
 		case OP_PUT_SLOT:
-			slot := uint8(frame.readCode())
+			slot := frame.readArg()
 			frame.putSlot(slot, frame.popStack())
 		case OP_PUT_SLOT_HEAP:
-			slot := uint8(frame.readCode())
+			slot := frame.readArg()
 			v := frame.popStack()
 			// we should never have nil pointer
 			/*
@@ -405,13 +914,17 @@ func (vm *VM) run() (Value, error) {
 			typ, ok := vm.globals[class].(*TypeValue)
 			if !ok {
 				err = frame.runtimeError("Trying to define method on non-class")
+			} else {
+				vm.setMethod(typ.typ, method, closure.Function)
 			}
-			typ.typ.Methods[method] = closure.Function
 		case OP_CALL:
-			arity := int(frame.readCode())
-			vm.opCall(arity)
+			arity := frame.readArg()
+			err = vm.opCall(arity)
+		case OP_TAIL_CALL:
+			arity := frame.readArg()
+			err = vm.opTailCall(arity)
 		case OP_CALL_METHOD:
-			arity := int(frame.readCode())
+			arity := frame.readArg()
 			method := frame.readName()
 			err = vm.opCallMethod(arity, method)
 		case OP_ATTR:
@@ -419,27 +932,97 @@ func (vm *VM) run() (Value, error) {
 			err = vm.opAttr(attr)
 		case OP_SET_HANDLER:
 			effect := frame.readName()
-			handlerIp := frame.readUint16()
-
-			frame.pushHandler(effect, frame, int(handlerIp))
+			handlerIp := frame.readJump()
+			index := frame.readArg()
+
+			frame.pushHandler(Handler{
+				effect:   effect,
+				frame:    frame,
+				ip:       handlerIp,
+				base:     len(frame.handlers) - index,
+				stackTop: frame.stackTop,
+			})
+		case OP_SET_FINALLY:
+			finallyIp := frame.readJump()
+
+			frame.pushHandler(Handler{
+				frame:    frame,
+				ip:       finallyIp,
+				base:     len(frame.handlers),
+				stackTop: frame.stackTop,
+				finally:  true,
+			})
 		case OP_POP_HANDLERS:
-			numHandlers := int(frame.readCode())
+			numHandlers := frame.readArg()
 			frame.handlers = frame.handlers[:len(frame.handlers)-numHandlers]
 		case OP_DO:
-			arity := int(frame.readCode())
-			vm.opDo(arity)
+			arity := frame.readArg()
+			err = vm.opDo(arity)
 		case OP_RESUME:
-			vm.opResume()
+			err = vm.opResume()
+		case OP_HANDLER_END:
+			err = vm.opHandlerEnd()
+		case OP_END_FINALLY:
+			err = vm.opEndFinally()
+		case OP_ITER:
+			var it *IteratorValue
+			it, err = vm.iterate(frame.popStack())
+			if err == nil {
+				frame.pushStack(it)
+			}
+		case OP_ITER_NEXT:
+			offset := frame.readJump()
+			err = vm.opIterNext(offset)
+		case OP_LOOP_MARK:
+			slot := frame.readArg()
+			frame.putSlot(slot, &LoopMarkValue{frame.stackTop, len(frame.handlers)})
+		case OP_BREAK:
+			slot := frame.readArg()
+			offset := frame.readJump()
+			err = vm.exitLoop(slot, frame.ip+offset, []Value{frame.popStack()})
+		case OP_CONTINUE:
+			slot := frame.readArg()
+			offset := frame.readJump()
+			err = vm.exitLoop(slot, frame.ip+offset, nil)
+		case OP_RANGE:
+			inclusive := frame.readArg() == 1
+			err = vm.opRange(inclusive)
+		case OP_IN:
+			err = vm.opIn()
+		case OP_DECLARE_EFFECT:
+			effect := frame.popStack().(*EffectValue)
+			vm.effects[effect.Name] = effect
 		case OP_TYPE:
 			frame.pushStack(NewTypeValue(frame.peekStack(0).Type()))
 		case OP_CHECK:
-			errNum := int(frame.readCode())
+			errNum := frame.readArg()
 			err = frame.opCheck(errNum)
+		case OP_CHECK_PARAM:
+			slot := frame.readArg()
+			err = frame.opCheckParam(slot)
+		case OP_CHECK_RETURN:
+			err = frame.opCheckReturn()
 		default:
-			return nil, fmt.Errorf("Unexpected opcode %s(%d) ", instr.String(), instr)
+			err = frame.runtimeError(fmt.Sprintf("Unexpected opcode %s(%d) ", instr.String(), instr))
+		}
+		// Results of closure calls are counted when they are created
+		if err == nil && vm.limits.MaxAllocations > 0 && vm.currentFrame == frame && allocatingOps[instr] {
+			err = vm.allocate(frame.peekStack(0))
+		}
+		if err == nil && vm.currentFrame.stackTop > vm.limits.MaxStackSize {
+			err = vm.currentFrame.stackOverflow()
+		}
+		if rtErr, ok := err.(*RuntimeError); ok {
+			err = vm.throw(rtErr)
 		}
 		if err != nil {
-			return nil, err
+			unwind, ok := err.(*unwindError)
+			if !ok || unwind.level != vm.level {
+				return nil, err
+			}
+			if unwind.result != nil {
+				return unwind.result, nil
+			}
 		}
 	}
 	// Unreachable
@@ -467,14 +1050,9 @@ func (frame *CallFrame) opLess() error {
 	b := frame.popStack()
 	a := frame.popStack()
 
-	switch l := a.(type) {
-	case *IntValue:
-		r, ok := b.(*IntValue)
-		if ok {
-			frame.pushStack(NewBool(l.Val < r.Val))
-			return nil
-		}
-	default:
+	if v := builtinLess(a, b); v != nil {
+		frame.pushStack(v)
+		return nil
 	}
 	return frame.runtimeError(fmt.Sprintf("Trying to compare less between %s and %s", a.Type().Name, b.Type().Name))
 
@@ -487,7 +1065,7 @@ func (frame *CallFrame) opNeg() error {
 	case *IntValue:
 		frame.pushStack(NewInt(-l.Val))
 	default:
-		return fmt.Errorf("Trying to neg %s", a.Type().Name)
+		return frame.runtimeError(fmt.Sprintf("Trying to neg %s", a.Type().Name))
 	}
 	return nil
 }
@@ -499,7 +1077,7 @@ func (frame *CallFrame) opNot() error {
 	case *BoolValue:
 		frame.pushStack(NewBool(!l.Val))
 	default:
-		return fmt.Errorf("Trying to not %s", a.Type().Name)
+		return frame.runtimeError(fmt.Sprintf("Trying to not %s", a.Type().Name))
 	}
 	return nil
 }
@@ -512,12 +1090,12 @@ func (frame *CallFrame) opAnd() error {
 	case *BoolValue:
 		r, ok := b.(*BoolValue)
 		if !ok {
-			return fmt.Errorf("Trying to and %s and %s", a.Type().Name, b.Type().Name)
+			return frame.runtimeError(fmt.Sprintf("Trying to and %s and %s", a.Type().Name, b.Type().Name))
 		} else {
 			frame.pushStack(NewBool(l.Val && r.Val))
 		}
 	default:
-		return fmt.Errorf("Trying to and %s and %s", a.Type().Name, b.Type().Name)
+		return frame.runtimeError(fmt.Sprintf("Trying to and %s and %s", a.Type().Name, b.Type().Name))
 	}
 	return nil
 }
@@ -530,12 +1108,12 @@ func (frame *CallFrame) opOr() error {
 	case *BoolValue:
 		r, ok := b.(*BoolValue)
 		if !ok {
-			return fmt.Errorf("Trying to or %s and %s", a.Type().Name, b.Type().Name)
+			return frame.runtimeError(fmt.Sprintf("Trying to or %s and %s", a.Type().Name, b.Type().Name))
 		} else {
 			frame.pushStack(NewBool(l.Val || r.Val))
 		}
 	default:
-		return fmt.Errorf("Trying to or %s and %s", a.Type().Name, b.Type().Name)
+		return frame.runtimeError(fmt.Sprintf("Trying to or %s and %s", a.Type().Name, b.Type().Name))
 	}
 	return nil
 }
@@ -548,19 +1126,22 @@ func (frame *CallFrame) opSubscr() error {
 	case *StringValue:
 		r, ok := b.(*IntValue)
 		if !ok {
-			return fmt.Errorf("Trying to subscript %s with %s", a.Type().Name, b.Type().Name)
+			return frame.runtimeError(fmt.Sprintf("Trying to subscript %s with %s", a.Type().Name, b.Type().Name))
 		} else {
+			runes := []rune(v.Val)
 			idx := r.Val
 			if idx < 0 {
-				idx = v.Len() - idx
+				idx = len(runes) + idx
+			}
+			if idx < 0 || idx >= len(runes) {
+				return frame.runtimeError(fmt.Sprintf("String index out of bounds %d", r.Val))
 			}
-			val := []rune(v.Val)[idx]
-			frame.pushStack(NewString(string(val)))
+			frame.pushStack(NewString(string(runes[idx])))
 		}
 	case *ListValue:
 		r, ok := b.(*IntValue)
 		if !ok {
-			return fmt.Errorf("Trying to subscript %s with %s", a.Type().Name, b.Type().Name)
+			return frame.runtimeError(fmt.Sprintf("Trying to subscript %s with %s", a.Type().Name, b.Type().Name))
 		} else {
 			idx := r.Val
 			if idx < 0 {
@@ -568,23 +1149,37 @@ func (frame *CallFrame) opSubscr() error {
 			}
 			val, ok := v.Get(idx)
 			if !ok {
-				return fmt.Errorf("List index out of bounds %d", r.Val)
+				return frame.runtimeError(fmt.Sprintf("List index out of bounds %d", r.Val))
 			}
 			frame.pushStack(val)
 		}
+	case *RangeValue:
+		r, ok := b.(*IntValue)
+		if !ok {
+			return frame.runtimeError(fmt.Sprintf("Trying to subscript %s with %s", a.Type().Name, b.Type().Name))
+		}
+		idx := r.Val
+		if idx < 0 {
+			idx = v.Len() + idx
+		}
+		val, ok := v.Get(idx)
+		if !ok {
+			return frame.runtimeError(fmt.Sprintf("Range index out of bounds %d", r.Val))
+		}
+		frame.pushStack(val)
 	case *MapValue:
 		key, ok := b.(*StringValue)
 		if !ok {
-			return fmt.Errorf("Trying to subscript %s with %s", a.Type().Name, b.Type().Name)
+			return frame.runtimeError(fmt.Sprintf("Trying to subscript %s with %s", a.Type().Name, b.Type().Name))
 		} else {
 			val, ok := v.Get(key.Val)
 			if !ok {
-				return fmt.Errorf("Non-existing map key: \"%s\"", key.Val)
+				return frame.runtimeError(fmt.Sprintf("Non-existing map key: \"%s\"", key.Val))
 			}
 			frame.pushStack(val)
 		}
 	default:
-		return fmt.Errorf("Trying to subscript %s with %s", a.Type().Name, b.Type().Name)
+		return frame.runtimeError(fmt.Sprintf("Trying to subscript %s with %s", a.Type().Name, b.Type().Name))
 	}
 	return nil
 }
@@ -593,7 +1188,7 @@ func (frame *CallFrame) opSubscr() error {
 func (frame *CallFrame) opAdd() (bool, error) {
 	res, err := builtinAdd(frame.peekStack(1), frame.peekStack(0))
 	if err != nil {
-		return false, err
+		return false, frame.runtimeError(err.Error())
 	}
 	if res != nil {
 		frame.popStack()
@@ -611,7 +1206,7 @@ func (frame *CallFrame) opMult() (bool, error) {
 		a := frame.popStack()
 		r, ok := b.(*IntValue)
 		if !ok {
-			return false, fmt.Errorf("Trying to mult %s and %s", a.Type().Name, b.Type().Name)
+			return false, frame.runtimeError(fmt.Sprintf("Trying to mult %s and %s", a.Type().Name, b.Type().Name))
 		}
 		frame.pushStack(NewInt(l.Val * r.Val))
 		return true, nil
@@ -627,7 +1222,7 @@ func (frame *CallFrame) opSub() (bool, error) {
 		a := frame.popStack()
 		r, ok := b.(*IntValue)
 		if !ok {
-			return false, fmt.Errorf("Trying to sub %s and %s", a.Type().Name, b.Type().Name)
+			return false, frame.runtimeError(fmt.Sprintf("Trying to sub %s and %s", a.Type().Name, b.Type().Name))
 		} else {
 			frame.pushStack(NewInt(l.Val - r.Val))
 		}
@@ -644,7 +1239,9 @@ func (frame *CallFrame) opDiv() (bool, error) {
 		a := frame.popStack()
 		r, ok := b.(*IntValue)
 		if !ok {
-			return false, fmt.Errorf("Trying to div %s and %s", a.Type().Name, b.Type().Name)
+			return false, frame.runtimeError(fmt.Sprintf("Trying to div %s and %s", a.Type().Name, b.Type().Name))
+		} else if r.Val == 0 {
+			return false, frame.runtimeError("Division by zero")
 		} else {
 			frame.pushStack(NewInt(l.Val / r.Val))
 		}
@@ -663,6 +1260,9 @@ func (frame *CallFrame) opMod() error {
 		if !ok {
 			return frame.runtimeError(fmt.Sprintf("Trying to mod %s and %s", a.Type().Name, b.Type().Name))
 		}
+		if r.Val == 0 {
+			return frame.runtimeError("Division by zero")
+		}
 		frame.pushStack(NewInt(l.Val % r.Val))
 		return nil
 	default:
@@ -688,6 +1288,7 @@ func (frame *CallFrame) opSubSlice() error {
 	a := frame.popStack()
 	x := frame.popStack()
 
+	var err error
 	intOr := func(v Value, def int) int {
 		switch i := v.(type) {
 		case *IntValue:
@@ -695,33 +1296,67 @@ func (frame *CallFrame) opSubSlice() error {
 		case *NilValue:
 			return def
 		default:
-			panic("Element in subslice is not integer")
+			err = frame.runtimeError(fmt.Sprintf("Trying to slice with %s, expected Int", v.Type().Name))
+			return def
 		}
 	}
 
 	from := intOr(a, 0)
 	step := intOr(c, 1)
+	if err != nil {
+		return err
+	}
+	if step != 1 {
+		return frame.runtimeError(fmt.Sprintf("Slicing with step %d is not supported", step))
+	}
 
 	switch v := x.(type) {
 	case *ListValue:
 		to := intOr(b, v.Len())
-		newList := v.Slice(from, to, step)
-		frame.pushStack(newList)
+		if err != nil {
+			return err
+		}
+		frame.pushStack(v.Slice(from, to))
 	case *StringValue:
-		to := intOr(b, v.Len())
 		s := []rune(v.Val)
-		if from > to {
-			return frame.runtimeError(fmt.Sprintf("Slice out of bounds %#v[%d:%d]", v.Val, from, to))
+		to := intOr(b, len(s))
+		if err != nil {
+			return err
 		}
-
-		newString := NewString(string(s[from:to]))
-		frame.pushStack(newString)
+		from, to = sliceBounds(len(s), from, to)
+		frame.pushStack(NewString(string(s[from:to])))
+	case *RangeValue:
+		to := intOr(b, v.Len())
+		if err != nil {
+			return err
+		}
+		frame.pushStack(v.Slice(from, to))
 	default:
-		panic("Subslice on non-suported value")
+		return frame.runtimeError(fmt.Sprintf("Can't slice %s", x.Type().Name))
 	}
 	return nil
 }
 
+// Resolve negative indexes and clamp slice bounds to [0, length]
+func sliceBounds(length, from, to int) (int, int) {
+	if from < 0 {
+		from += length
+	}
+	if to < 0 {
+		to += length
+	}
+	if from < 0 {
+		from = 0
+	}
+	if to > length {
+		to = length
+	}
+	if from > to {
+		from = to
+	}
+	return from, to
+}
+
 func (frame *CallFrame) opSubAssign() error {
 	key := frame.popStack()
 	obj := frame.popStack()
@@ -731,7 +1366,7 @@ func (frame *CallFrame) opSubAssign() error {
 	case *MapValue:
 		k, ok := key.(*StringValue)
 		if !ok {
-			panic("Non-string key in map assignment")
+			return frame.runtimeError(fmt.Sprintf("Map keys must be Str, got %s", key.Type().Name))
 		}
 		v.Set(k.Val, value)
 		return nil
@@ -740,68 +1375,184 @@ func (frame *CallFrame) opSubAssign() error {
 }
 
 func (frame *CallFrame) opCreateList(size int) {
-	v := ListNil()
-	for i := 0; i < size; i++ {
-		v = ListCons(frame.popStack(), v)
+	items := make([]Value, size)
+	for i := size - 1; i >= 0; i-- {
+		items[i] = frame.popStack()
 	}
-	frame.pushStack(v)
+	frame.pushStack(NewList(items))
 }
 
-func (frame *CallFrame) opCreateMap(size int) {
+func (frame *CallFrame) opCreateMap(size int) error {
 	v := NewMap()
 	for i := 0; i < size; i++ {
 		value := frame.popStack()
-		key, ok := frame.popStack().(*StringValue)
+		key := frame.popStack()
+		k, ok := key.(*StringValue)
 		if !ok {
-			panic("Expected string key in map")
+			return frame.runtimeError(fmt.Sprintf("Map keys must be Str, got %s", key.Type().Name))
 		}
-		v.Set(key.Val, value)
+		v.Set(k.Val, value)
 	}
 	frame.pushStack(v)
+	return nil
 }
 
-func (vm *VM) opCall(arity int) {
+func (vm *VM) opCall(arity int) error {
 	frame := vm.currentFrame
 	switch fn := frame.peekStack(arity).(type) {
 	case *ClosureValue:
+		if err := frame.checkArity(fn, arity); err != nil {
+			return err
+		}
+		if frame.depth >= vm.limits.MaxCallDepth {
+			return frame.stackOverflow()
+		}
 		newFrame := vm.NewFrame(fn, frame.stack[frame.stackTop-arity:frame.stackTop], frame, frame.ip)
 		vm.currentFrame = newFrame
 		frame.stackTop -= arity + 1
 	case *BuiltinValue:
-		if arity == 1 {
-			f, ok := fn.Func.(func(Value) Value)
-			if !ok {
-				panic(fmt.Sprintf("Calling builtin function '%s' with wrong number of arguments, expected %d", fn.Name, arity))
-			}
-			v := frame.popStack()
-			frame.popStack()
-			frame.pushStack(f(v))
-		} else if arity == 2 {
-			f, ok := fn.Func.(func(Value, Value) Value)
-			if !ok {
-				panic(fmt.Sprintf("Calling builtin function '%s' with wrong number of arguments, expected %d", fn.Name, arity))
-			}
-			b := frame.popStack()
-			a := frame.popStack()
-			frame.popStack()
-			frame.pushStack(f(a, b))
-		} else {
-			panic(fmt.Sprintf("Not implemented arity: %d", arity))
+		args := make([]Value, arity)
+		copy(args, frame.stack[frame.stackTop-arity:frame.stackTop])
+		frame.stackTop -= arity + 1
+		res, err := vm.callBuiltin(fn, args)
+		if err != nil {
+			return err
 		}
+		frame.pushStack(res)
 	case *TypeValue:
 		// Constructor
 		if arity != len(fn.typ.Attributes) {
-			panic(fmt.Sprintf("Calling constructor '%s' with wrong number of arguments, expected %d", fn.typ.Name, arity))
+			return frame.runtimeError(fmt.Sprintf("Calling constructor '%s' with %d arguments, expected %d", fn.typ.Name, arity, len(fn.typ.Attributes)))
 		}
 		attributes := make([]Value, arity)
 		for i := arity - 1; i >= 0; i-- {
 			attributes[i] = frame.popStack()
 		}
 		frame.popStack() // pop type
+		if err := vm.checkAttributeTypes(fn.typ, attributes); err != nil {
+			return err
+		}
 		frame.pushStack(NewCustom(fn.typ, attributes))
 	default:
-		panic(fmt.Sprintf("Trying to call non closure and non builtin: %v", frame.peekStack(arity)))
+		return frame.runtimeError(fmt.Sprintf("Trying to call non closure and non builtin: %v", frame.peekStack(arity)))
+	}
+	return nil
+}
+
+// Call a closure by reusing the frame of the caller, so that its result is
+// returned directly to the caller's caller. Frames with handlers or running a
+// finally block are kept since they have more to do after the call.
+func (vm *VM) opTailCall(arity int) error {
+	frame := vm.currentFrame
+	fn, ok := frame.peekStack(arity).(*ClosureValue)
+	if !ok || len(frame.handlers) > 0 || len(frame.aborts) > 0 {
+		if err := vm.opCall(arity); err != nil {
+			return err
+		}
+		// Count the results of builtins and constructors as for OP_CALL
+		if vm.limits.MaxAllocations > 0 && vm.currentFrame == frame {
+			return vm.allocate(frame.peekStack(0))
+		}
+		return nil
+	}
+	if err := frame.checkArity(fn, arity); err != nil {
+		return err
+	}
+	args := make([]Value, arity)
+	copy(args, frame.stack[frame.stackTop-arity:frame.stackTop])
+	// Drop the references of the old call
+	for i := range frame.stack[:frame.stackTop] {
+		frame.stack[i] = nil
+	}
+	frame.stackTop = 0
+	frame.setupCall(fn, args)
+	return nil
+}
+
+// Check the number of arguments of a call of a closure
+func (frame *CallFrame) checkArity(fn *ClosureValue, arity int) error {
+	if arity != fn.Function.Arity {
+		return frame.runtimeError(fmt.Sprintf("Calling function '%s' with %d arguments, expected %d", fn.Function.Name, arity, fn.Function.Arity))
+	}
+	return nil
+}
+
+func (vm *VM) callBuiltin(fn *BuiltinValue, args []Value) (Value, error) {
+	if len(args) < fn.Arity || (fn.MaxArity != VARIADIC && len(args) > fn.MaxArity) {
+		return nil, vm.currentFrame.runtimeError(fmt.Sprintf(
+			"Calling builtin function '%s' with %d arguments, expected %s",
+			fn.Name,
+			len(args),
+			fn.arityText(),
+		))
+	}
+	res, err := fn.Func(vm, args)
+	if err != nil {
+		switch err.(type) {
+		case *RuntimeError, *unwindError, *LimitError, *ExitError:
+			return nil, err
+		default:
+			return nil, vm.currentFrame.runtimeError(fmt.Sprintf("%s: %s", fn.Name, err))
+		}
+	}
+	if res == nil {
+		return Nil, nil
+	}
+	return res, nil
+}
+
+// Call a closure, builtin or constructor from go code. Closures are run in a
+// nested dispatch loop that exits when the called closure returns.
+func (vm *VM) call(callable Value, args []Value) (Value, error) {
+	frame := vm.currentFrame
+	outer := vm.level
+	vm.level = &runLevel{depth: outer.depth + 1}
+	defer func() {
+		vm.level.done = true
+		vm.level = outer
+	}()
+	frame.pushStack(callable)
+	for _, arg := range args {
+		frame.pushStack(arg)
+	}
+	if err := vm.opCall(len(args)); err != nil {
+		return nil, err
+	}
+	if vm.currentFrame == frame {
+		// Builtins and constructors leave the result on the stack
+		return frame.popStack(), nil
+	}
+	vm.currentFrame.hostCall = true
+	res, err := vm.run()
+	if _, ok := err.(*unwindError); err != nil && !ok {
+		// Let the caller handle the error from where it called
+		vm.currentFrame = frame
+	}
+	return res, err
+}
+
+// Check constructor arguments against the attribute type annotations of typ
+func (vm *VM) checkAttributeTypes(typ *Type, attributes []Value) error {
+	for i, typeName := range typ.AttributeTypes {
+		if typeName == "" {
+			continue
+		}
+		expected, ok := vm.globals[typeName].(*TypeValue)
+		if !ok {
+			return vm.currentFrame.runtimeError(fmt.Sprintf("Type annotation '%s' of attribute '%s' is not a type", typeName, typ.Attributes[i]))
+		}
+		if attributes[i].Type() != expected.typ {
+			return vm.currentFrame.runtimeError(fmt.Sprintf(
+				"%s in constructor '%s': attribute '%s' expected %s, got %s",
+				runtimeErrorText(TYPE_ERROR),
+				typ.Name,
+				typ.Attributes[i],
+				expected.typ.Name,
+				attributes[i].Type().Name,
+			))
+		}
 	}
+	return nil
 }
 
 func (vm *VM) opCallMethod(arity int, name string) error {
@@ -811,28 +1562,44 @@ func (vm *VM) opCallMethod(arity int, name string) error {
 	// Special case for type values
 	t, ok := obj.(*TypeValue)
 	if ok {
-		method, ok := t.typ.Methods[name]
+		method, ok := vm.lookupMethod(t.typ, name)
 		if !ok {
-			methods := strings.Join(t.typ.MethodNames(), ", ")
+			methods := strings.Join(vm.MethodNames(t.typ), ", ")
 			return frame.runtimeError(fmt.Sprintf("No such attribute: %s on type %s. Has these methods: %s", name, obj.Type().Name, methods))
 		}
-		closure := NewClosure(method, []*BoxValue{})
-		frame.replaceStack(arity, closure)
-		vm.opCall(arity)
-		return nil
+		frame.replaceStack(arity, method)
+		return vm.opCall(arity)
 	}
 
-	method, ok := obj.Type().Methods[name]
+	method, ok := vm.lookupMethod(obj.Type(), name)
 	if !ok {
-		methods := strings.Join(obj.Type().MethodNames(), ", ")
+		methods := strings.Join(vm.MethodNames(obj.Type()), ", ")
 		return frame.runtimeError(fmt.Sprintf("No such attribute: %s on %s. Has these methods: %s", name, obj.Type().Name, methods))
 	}
 
-	closure := NewClosure(method, []*BoxValue{})
-	// Include object on stack
-	newFrame := vm.NewFrame(closure, frame.stack[frame.stackTop-arity-1:frame.stackTop], frame, frame.ip)
-	vm.currentFrame = newFrame
-	frame.stackTop -= arity + 1
+	switch m := method.(type) {
+	case *BuiltinValue:
+		// Include object as first argument
+		args := make([]Value, arity+1)
+		copy(args, frame.stack[frame.stackTop-arity-1:frame.stackTop])
+		frame.stackTop -= arity + 1
+		res, err := vm.callBuiltin(m, args)
+		if err != nil {
+			return err
+		}
+		frame.pushStack(res)
+	case *ClosureValue:
+		// Include object on stack
+		if arity+1 != m.Function.Arity {
+			return frame.runtimeError(fmt.Sprintf("Calling method '%s' with %d arguments, expected %d", name, arity, m.Function.Arity-1))
+		}
+		if frame.depth >= vm.limits.MaxCallDepth {
+			return frame.stackOverflow()
+		}
+		newFrame := vm.NewFrame(m, frame.stack[frame.stackTop-arity-1:frame.stackTop], frame, frame.ip)
+		vm.currentFrame = newFrame
+		frame.stackTop -= arity + 1
+	}
 	return nil
 }
 
@@ -843,12 +1610,11 @@ func (vm *VM) opAttr(name string) error {
 	switch t := obj.(type) {
 	case *TypeValue:
 		// Attribute for type methods (like `List.head`)
-		method, ok := t.typ.Methods[name]
+		method, ok := vm.lookupMethod(t.typ, name)
 		if !ok {
 			return frame.runtimeError(fmt.Sprintf("No such attribute: %s on %s", name, obj.Type().Name))
 		}
-		closure := NewClosure(method, []*BoxValue{})
-		frame.pushStack(closure)
+		frame.pushStack(method)
 	case *CustomValue:
 		idx := 0
 		for ; idx < len(t.Attributes) && t.Type().Attributes[idx] != name; idx++ {
@@ -863,19 +1629,78 @@ func (vm *VM) opAttr(name string) error {
 	return nil
 }
 
+// Replace the iterator on top of the stack with its next value, or pop it and
+// jump forward by offset at the end
+func (vm *VM) opIterNext(offset int) error {
+	frame := vm.currentFrame
+	it := frame.popStack().(*IteratorValue)
+	v, ok, err := it.Next(vm)
+	if err != nil {
+		return err
+	}
+	if ok {
+		frame.pushStack(v)
+	} else {
+		frame.ip += offset
+	}
+	return nil
+}
+
+// Continue at ip in the loop marked in slot, with the stack and handlers of
+// the frame as they were when the loop started. The finally blocks of the try
+// blocks started in the loop are run first.
+func (vm *VM) exitLoop(slot int, ip int, values []Value) error {
+	frame := vm.currentFrame
+	mark := frame.stack[slot].(*LoopMarkValue)
+	return vm.continueAbort(&abort{
+		finallies: frame.finallies(mark.handlers),
+		frame:     frame,
+		ip:        ip,
+		base:      mark.handlers,
+		stackTop:  mark.stackTop,
+		values:    values,
+	})
+}
+
+// Find the innermost handler of the effect in the frame
 func (frame *CallFrame) findHandler(name string) *Handler {
-	for _, h := range frame.handlers {
-		if h.effect == name {
+	for i := len(frame.handlers) - 1; i >= 0; i-- {
+		h := frame.handlers[i]
+		if !h.finally && h.effect == name {
 			return &h
 		}
 	}
 	return nil
 }
 
-func (vm *VM) opDo(arity int) {
+// Finally blocks of the frame from the handler index from, innermost first
+func (frame *CallFrame) finallies(from int) []Handler {
+	finallies := []Handler{}
+	for i := len(frame.handlers) - 1; i >= from; i-- {
+		if frame.handlers[i].finally {
+			finallies = append(finallies, frame.handlers[i])
+		}
+	}
+	return finallies
+}
+
+func (vm *VM) opDo(arity int) error {
 	frame := vm.currentFrame
 	effect := frame.popStack().(*StringValue).Val
 
+	if effect == EXN_EFFECT {
+		if arity != 1 {
+			return frame.runtimeError(fmt.Sprintf("Effect '%s' takes 1 argument, got %d", EXN_EFFECT, arity))
+		}
+		return frame.raise(frame.popStack())
+	}
+
+	if declared, ok := vm.effects[effect]; ok {
+		if err := vm.checkEffectArgs(declared, arity); err != nil {
+			return err
+		}
+	}
+
 	var handler *Handler
 
 	handlerFrame := frame
@@ -888,45 +1713,378 @@ func (vm *VM) opDo(arity int) {
 	}
 
 	if handler == nil {
-		panic(fmt.Sprintf("No handler for effect '%s'", effect))
+		if host, ok := vm.hostHandlers[effect]; ok {
+			return vm.callHostHandler(host, effect, arity)
+		}
+		return frame.runtimeError(fmt.Sprintf("No handler for effect '%s'", effect))
 	}
 
+	if handler.coroutine != nil {
+		if handler.coroutine.task != nil {
+			return frame.runtimeError(fmt.Sprintf("Effect '%s' can only be performed by the scheduler", effect))
+		}
+		return vm.yield(handler.coroutine, arity)
+	}
+
+	// Pop the arguments before capturing the continuation, the handler frame
+	// can be the same frame
+	args := make([]Value, arity)
 	for i := 0; i < arity; i++ {
-		v := frame.popStack()
-		handlerFrame.pushStack(v)
+		args[i] = frame.popStack()
 	}
 
 	// Create continuation
-	k := NewContinuation(frame)
+	k := NewContinuation(frame, *handler)
+
+	// Handlers are deep: the handler is installed again when resuming, but
+	// runs outside its try block, so effects it performs go to outer handlers
+	handlerFrame.handlers = handlerFrame.handlers[:handler.base]
+	for len(handlerFrame.aborts) > 0 && handlerFrame.aborts[len(handlerFrame.aborts)-1].base >= handler.base {
+		handlerFrame.aborts = handlerFrame.aborts[:len(handlerFrame.aborts)-1]
+	}
+
+	for _, v := range args {
+		handlerFrame.pushStack(v)
+	}
 	handlerFrame.pushStack(k)
 	handlerFrame.ip = handler.ip
 	vm.currentFrame = handlerFrame
+	return nil
 }
 
-func (frame *CallFrame) pushHandler(effect string, handlerFrame *CallFrame, ip int) {
-	frame.handlers = append(frame.handlers, struct {
-		effect string
-		frame  *CallFrame
-		ip     int
-	}{effect, handlerFrame, ip})
+// Handle an effect with a go handler, which resumes the continuation with its
+// result right away
+func (vm *VM) callHostHandler(host *BuiltinValue, effect string, arity int) error {
+	frame := vm.currentFrame
+	args := make([]Value, arity)
+	copy(args, frame.stack[frame.stackTop-arity:frame.stackTop])
+	frame.stackTop -= arity
+	res, err := vm.callBuiltin(host, args)
+	if err != nil {
+		return err
+	}
+	if err := vm.checkEffectResult(effect, res); err != nil {
+		return err
+	}
+	frame.pushStack(res)
+	return nil
 }
 
-func (vm *VM) opResume() {
+// Check the arguments on top of the stack against the declaration of the
+// effect
+func (vm *VM) checkEffectArgs(effect *EffectValue, arity int) error {
+	frame := vm.currentFrame
+	if arity != len(effect.Params) {
+		return frame.runtimeError(fmt.Sprintf("Performing effect '%s' with %d arguments, expected %d", effect.Name, arity, len(effect.Params)))
+	}
+	for i, typeName := range effect.ParamTypes {
+		if typeName == "" {
+			continue
+		}
+		expected, ok := vm.globals[typeName].(*TypeValue)
+		if !ok {
+			return frame.runtimeError(fmt.Sprintf("Type annotation '%s' of parameter '%s' is not a type", typeName, effect.Params[i]))
+		}
+		arg := frame.stack[frame.stackTop-arity+i]
+		if arg.Type() != expected.typ {
+			return frame.runtimeError(fmt.Sprintf(
+				"%s in effect '%s': parameter '%s' expected %s, got %s",
+				runtimeErrorText(TYPE_ERROR),
+				effect.Name,
+				effect.Params[i],
+				typeName,
+				arg.Type().Name,
+			))
+		}
+	}
+	return nil
+}
+
+// Check a value that a continuation is resumed with against the return type
+// of its effect
+func (vm *VM) checkEffectResult(effect string, v Value) error {
+	declared, ok := vm.effects[effect]
+	if !ok || declared.ReturnType == "" {
+		return nil
+	}
+	expected, ok := vm.globals[declared.ReturnType].(*TypeValue)
+	if !ok {
+		return vm.currentFrame.runtimeError(fmt.Sprintf("Return type annotation '%s' of effect '%s' is not a type", declared.ReturnType, effect))
+	}
+	if v.Type() != expected.typ {
+		return vm.currentFrame.runtimeError(fmt.Sprintf(
+			"%s in effect '%s': resumed with %s, expected %s",
+			runtimeErrorText(TYPE_ERROR),
+			effect,
+			v.Type().Name,
+			declared.ReturnType,
+		))
+	}
+	return nil
+}
+
+func (frame *CallFrame) pushHandler(handler Handler) {
+	frame.handlers = append(frame.handlers, handler)
+}
+
+// Raise v as an exception. Other values than exceptions are raised as an
+// exception with the string as message. The returned error is caught by the
+// dispatch loop like other runtime errors.
+func (frame *CallFrame) raise(v Value) error {
+	exn, ok := v.(*ExnValue)
+	if !ok {
+		msg := v.String()
+		if s, ok := v.(*StringValue); ok {
+			msg = s.Val
+		}
+		exn = NewExn(msg, frame.stackTrace())
+	}
+	pos := frame.currentPosition()
+	return &RuntimeError{Line: pos.Line(), Col: pos.Col(), Msg: exn.Msg(), Exn: exn, Trace: exn.stack}
+}
+
+// Transfer control to the innermost handler of the exn effect, running the
+// finally blocks on the way. Returns the error if there is no handler.
+func (vm *VM) throw(err *RuntimeError) error {
+	if err.Exn == nil {
+		err.Exn = NewExn(err.Msg, err.Trace)
+	}
+	finallies := []Handler{}
+	for frame := vm.currentFrame; frame != nil; frame = frame.returnFrame {
+		for i := len(frame.handlers) - 1; i >= 0; i-- {
+			h := frame.handlers[i]
+			if h.finally {
+				finallies = append(finallies, h)
+			} else if h.effect == EXN_EFFECT {
+				return vm.continueAbort(&abort{
+					finallies: finallies,
+					frame:     frame,
+					ip:        h.ip,
+					base:      h.base,
+					stackTop:  h.stackTop,
+					values:    []Value{err.Exn, NewContinuation(nil, h)},
+				})
+			}
+		}
+	}
+	return vm.continueAbort(&abort{finallies: finallies, err: err})
+}
+
+// Run the next finally block of the abort or continue at its target
+func (vm *VM) continueAbort(a *abort) error {
+	if len(a.finallies) > 0 {
+		f := a.finallies[0]
+		a.finallies = a.finallies[1:]
+		frame := f.frame
+		frame.handlers = frame.handlers[:f.base]
+		frame.aborts = append(frame.aborts, pendingAbort{f.base, a})
+		frame.stackTop = f.stackTop
+		frame.ip = f.ip
+		vm.currentFrame = frame
+		return nil
+	}
+
+	if a.err != nil {
+		return a.err
+	}
+
+	frame := a.frame
+	if a.base < len(frame.handlers) {
+		frame.handlers = frame.handlers[:a.base]
+	}
+	// Drop aborts of finally blocks that were left by the transfer
+	for len(frame.aborts) > 0 && frame.aborts[len(frame.aborts)-1].base >= a.base {
+		frame.aborts = frame.aborts[:len(frame.aborts)-1]
+	}
+	frame.stackTop = a.stackTop
+	for _, v := range a.values {
+		frame.pushStack(v)
+	}
+	frame.ip = a.ip
+	vm.currentFrame = frame
+	if frame.level.depth < vm.level.depth {
+		return &unwindError{frame.level, nil}
+	}
+	return nil
+}
+
+// A handler finished without resuming. The try block it handles is aborted
+// and execution continues after the try expression.
+func (vm *VM) opHandlerEnd() error {
+	frame := vm.currentFrame
+	k, ok := frame.popStack().(*ContinuationValue)
+	if !ok {
+		return frame.runtimeError("Internal error: expected continuation at end of handler")
+	}
+	result := frame.popStack()
+
+	finallies := []Handler{}
+	if k.Frame != nil {
+		// The finally blocks of the try block run after the handler
+		k.restoreHandlers()
+		for f := k.Frame; f != nil && f != frame; f = f.returnFrame {
+			finallies = append(finallies, f.finallies(0)...)
+		}
+		finallies = append(finallies, frame.finallies(k.handler.base)...)
+	}
+	return vm.continueAbort(&abort{
+		finallies: finallies,
+		frame:     frame,
+		ip:        frame.ip,
+		base:      k.handler.base,
+		stackTop:  k.handler.stackTop,
+		values:    []Value{result},
+	})
+}
+
+func (vm *VM) opEndFinally() error {
+	frame := vm.currentFrame
+	frame.popStack()
+	if len(frame.aborts) == 0 {
+		return frame.runtimeError("Internal error: finally block ended without an abort")
+	}
+	pending := frame.aborts[len(frame.aborts)-1]
+	frame.aborts = frame.aborts[:len(frame.aborts)-1]
+	return vm.continueAbort(pending.abort)
+}
+
+func (vm *VM) opResume() error {
 	v := vm.currentFrame.popStack()
 
 	switch continuation := v.(type) {
 	case *ContinuationValue:
-		continuation.Frame.pushStack(vm.currentFrame.popStack())
-		vm.currentFrame = continuation.Frame
+		if continuation.Frame == nil {
+			return vm.currentFrame.runtimeError("Exceptions can't be resumed")
+		}
+		if continuation.Frame.level.done {
+			return vm.currentFrame.runtimeError("Can't resume a continuation from a call from go code that has returned")
+		}
+		if err := vm.checkEffectResult(continuation.handler.effect, vm.currentFrame.peekStack(0)); err != nil {
+			return err
+		}
+		if continuation.OneShot() {
+			if continuation.resumed {
+				return vm.currentFrame.runtimeError("Continuation can only be resumed once since it was captured in a call from go code")
+			}
+			continuation.resumed = true
+		}
+		value := vm.currentFrame.popStack()
+		frame := continuation.restore()
+		frame.pushStack(value)
+		frame.ip = continuation.ip
+		vm.currentFrame = frame
 	default:
-		panic("Expected continuation on top of stack")
+		return vm.currentFrame.runtimeError(fmt.Sprintf("Can only resume continuations, got %s", v.Type().Name))
+	}
+	return nil
+}
+
+// The state of a continuation's frames. The frames below the handler frame
+// are copied whole, unless the continuation is one-shot. The handler frame
+// keeps its locals, which the handler shares with the try block, and only
+// saves the rest of its stack and its handlers.
+type savedFrames struct {
+	frames   *CallFrame // frame that performed the effect, nil if it is the handler frame
+	stack    []Value    // stack of the handler frame above its locals
+	handlers []Handler
+	aborts   []pendingAbort
+}
+
+func saveFrames(frame, handlerFrame *CallFrame, multiShot bool) *savedFrames {
+	locals := len(handlerFrame.closure.Function.Chunk.LocalNames)
+	saved := &savedFrames{
+		stack:    append([]Value{}, handlerFrame.stack[locals:handlerFrame.stackTop]...),
+		handlers: copyHandlers(handlerFrame.handlers, nil),
+		aborts:   copyAborts(handlerFrame.aborts, nil),
+	}
+	if multiShot {
+		saved.frames = copyFrames(frame, handlerFrame)
+	} else if frame != handlerFrame {
+		saved.frames = frame
+	}
+	return saved
+}
+
+// Restore the handler frame and return the frame to resume. Unless the
+// continuation is one-shot, it is a fresh copy that leaves the saved frames
+// untouched for the next resume.
+func (k *ContinuationValue) restore() *CallFrame {
+	handlerFrame := k.handler.frame
+	k.restoreHandlers()
+	handlerFrame.stackTop = len(handlerFrame.closure.Function.Chunk.LocalNames)
+	for _, v := range k.saved.stack {
+		handlerFrame.pushStack(v)
+	}
+	if k.saved.frames == nil {
+		return handlerFrame
+	}
+	if k.oneShot {
+		return k.saved.frames
+	}
+	return copyFrames(k.saved.frames, handlerFrame)
+}
+
+// Reinstall the handlers of the handler frame, which are removed while the
+// handler runs
+func (k *ContinuationValue) restoreHandlers() {
+	k.handler.frame.handlers = copyHandlers(k.saved.handlers, nil)
+	k.handler.frame.aborts = copyAborts(k.saved.aborts, nil)
+}
+
+// Copy the chain of frames from frame up to, but not including, stop
+func copyFrames(frame, stop *CallFrame) *CallFrame {
+	copies := map[*CallFrame]*CallFrame{}
+	order := []*CallFrame{}
+	for f := frame; f != stop; f = f.returnFrame {
+		c := *f
+		c.stack = make([]Value, f.stackTop, cap(f.stack))
+		copy(c.stack, f.stack)
+		copies[f] = &c
+		order = append(order, &c)
+	}
+	if len(order) == 0 {
+		return nil
+	}
+	for i, c := range order {
+		if i+1 < len(order) {
+			c.returnFrame = order[i+1]
+		}
+		c.handlers = copyHandlers(c.handlers, copies)
+		c.aborts = copyAborts(c.aborts, copies)
+	}
+	return order[0]
+}
+
+// Copy handlers, pointing them to the copies of their frames
+func copyHandlers(handlers []Handler, copies map[*CallFrame]*CallFrame) []Handler {
+	res := make([]Handler, len(handlers))
+	for i, h := range handlers {
+		if c, ok := copies[h.frame]; ok {
+			h.frame = c
+		}
+		res[i] = h
 	}
+	return res
+}
+
+// Copy aborts, which are consumed as their finally blocks run
+func copyAborts(aborts []pendingAbort, copies map[*CallFrame]*CallFrame) []pendingAbort {
+	res := make([]pendingAbort, len(aborts))
+	for i, p := range aborts {
+		a := *p.abort
+		a.finallies = copyHandlers(a.finallies, copies)
+		if c, ok := copies[a.frame]; ok {
+			a.frame = c
+		}
+		res[i] = pendingAbort{p.base, &a}
+	}
+	return res
 }
 
 func (frame *CallFrame) opCheck(errNum int) error {
 	b, ok := frame.popStack().(*BoolValue)
 	if !ok {
-		return fmt.Errorf("Panic: expected bool in check operation")
+		return frame.runtimeError(fmt.Sprintf("Panic: expected bool in check operation"))
 	}
 	if !b.Val {
 		return frame.runtimeError(runtimeErrorText(errNum))
@@ -934,7 +2092,83 @@ func (frame *CallFrame) opCheck(errNum int) error {
 	return nil
 }
 
+func (frame *CallFrame) opCheckParam(slot int) error {
+	typ, ok := frame.popStack().(*TypeValue)
+	name := frame.closure.Function.Chunk.LocalNames[slot]
+	if !ok {
+		return frame.runtimeError(fmt.Sprintf("Type annotation of parameter '%s' is not a type", name))
+	}
+	v := frame.stack[slot]
+	if box, ok := v.(*BoxValue); ok {
+		v = box.Get()
+	}
+	if v.Type() != typ.typ {
+		return frame.runtimeError(fmt.Sprintf(
+			"%s in function '%s': parameter '%s' expected %s, got %s",
+			runtimeErrorText(TYPE_ERROR),
+			frame.closure.Function.Name,
+			name,
+			typ.typ.Name,
+			v.Type().Name,
+		))
+	}
+	return nil
+}
+
+func (frame *CallFrame) opCheckReturn() error {
+	typ, ok := frame.popStack().(*TypeValue)
+	if !ok {
+		return frame.runtimeError("Return type annotation is not a type")
+	}
+	v := frame.peekStack(0)
+	if v.Type() != typ.typ {
+		return frame.runtimeError(fmt.Sprintf(
+			"%s in function '%s': expected return value of type %s, got %s",
+			runtimeErrorText(TYPE_ERROR),
+			frame.closure.Function.Name,
+			typ.typ.Name,
+			v.Type().Name,
+		))
+	}
+	return nil
+}
+
 func (frame *CallFrame) runtimeError(msg string) error {
-	line := frame.closure.Function.Chunk.LineNr[frame.ip]
-	return fmt.Errorf("Runtime Error on line %d: %s", line, msg)
+	pos := frame.currentPosition()
+	return &RuntimeError{Line: pos.Line(), Col: pos.Col(), Msg: msg, Trace: frame.stackTrace()}
+}
+
+// Error for exceeding the call depth or the stack size. Only the innermost
+// and outermost frames are kept in the traceback.
+func (frame *CallFrame) stackOverflow() error {
+	pos := frame.currentPosition()
+	trace := frame.stackTrace()
+	omitted := 0
+	if len(trace) > MAX_TRACE {
+		omitted = len(trace) - MAX_TRACE
+		trace = append(trace[:MAX_TRACE/2], trace[len(trace)-MAX_TRACE/2:]...)
+	}
+	return &RuntimeError{Line: pos.Line(), Col: pos.Col(), Msg: "Stack overflow", Trace: trace, Omitted: omitted}
+}
+
+// The frames that will be returned to from frame, starting with frame itself
+func (frame *CallFrame) stackTrace() []StackEntry {
+	trace := []StackEntry{}
+	for f := frame; f != nil; f = f.returnFrame {
+		fn := f.closure.Function
+		if fn == hostFunction {
+			continue
+		}
+		trace = append(trace, StackEntry{fn.Name, f.currentPosition()})
+	}
+	return trace
+}
+
+// Source position of the instruction being executed
+func (frame *CallFrame) currentPosition() SourcePos {
+	ip := frame.ip - 1
+	if ip < 0 {
+		ip = 0
+	}
+	return frame.closure.Function.Chunk.Position(ip)
 }
@@ -0,0 +1,308 @@
+package interpret
+
+import (
+	"fmt"
+	"sort"
+)
+
+var IteratorType = &Type{Name: "Iterator", Builtins: BuiltinMap{}}
+
+// Name of the effect that generators perform to produce their values
+const YIELD_EFFECT = "yield"
+
+func init() {
+	addNativeMethod(IteratorType, "next", 1, iteratorNext)
+	addNativeMethod(IteratorType, "done", 1, iteratorDone)
+	addNativeMethod(IteratorType, "list", 1, iteratorList)
+	addNativeMethod(IteratorType, "take", 2, iteratorTake)
+	addNativeMethod(IteratorType, "drop", 2, iteratorDrop)
+	addNativeMethod(IteratorType, "map", 2, iteratorMap)
+	addNativeMethod(IteratorType, "filter", 2, iteratorFilter)
+	addNativeMethod(IteratorType, "chunk", 2, iteratorChunk)
+}
+
+// A lazy sequence of values that is consumed by iterating over it
+type IteratorValue struct {
+	// Produce the next value, or false at the end
+	step func(vm *VM) (Value, bool, error)
+
+	peeked   Value // the next value if it has been read ahead, otherwise nil
+	finished bool
+}
+
+func (t *IteratorValue) Type() *Type {
+	return IteratorType
+}
+
+func (t *IteratorValue) String() string {
+	return "Iterator[]"
+}
+
+func NewIterator(step func(vm *VM) (Value, bool, error)) *IteratorValue {
+	return &IteratorValue{step: step}
+}
+
+// The next value of the iterator, or false if there are no more values
+func (t *IteratorValue) Next(vm *VM) (Value, bool, error) {
+	if t.peeked != nil {
+		v := t.peeked
+		t.peeked = nil
+		return v, true, nil
+	}
+	if t.finished {
+		return nil, false, nil
+	}
+	v, ok, err := t.step(vm)
+	if err != nil || !ok {
+		t.finished = true
+		return nil, false, err
+	}
+	return v, true, nil
+}
+
+// Read ahead to see if there are more values
+func (t *IteratorValue) Done(vm *VM) (bool, error) {
+	if t.peeked != nil {
+		return false, nil
+	}
+	v, ok, err := t.Next(vm)
+	if err != nil || !ok {
+		return true, err
+	}
+	t.peeked = v
+	return false, nil
+}
+
+// An iterator over the values of a list, the characters of a string, the
+// [key, value] pairs of a map ordered by key, or what the iter method of a
+// custom value returns
+func (vm *VM) iterate(v Value) (*IteratorValue, error) {
+	switch x := v.(type) {
+	case *IteratorValue:
+		return x, nil
+	case *ListValue:
+		i := 0
+		return NewIterator(func(vm *VM) (Value, bool, error) {
+			v, ok := x.Get(i)
+			i++
+			return v, ok, nil
+		}), nil
+	case *RangeValue:
+		i := 0
+		return NewIterator(func(vm *VM) (Value, bool, error) {
+			v, ok := x.Get(i)
+			i++
+			return v, ok, nil
+		}), nil
+	case *StringValue:
+		chars := []rune(x.Val)
+		i := 0
+		return NewIterator(func(vm *VM) (Value, bool, error) {
+			if i >= len(chars) {
+				return nil, false, nil
+			}
+			i++
+			return NewString(string(chars[i-1])), true, nil
+		}), nil
+	case *MapValue:
+		keys := make([]string, 0, len(x.Map))
+		for k := range x.Map {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		i := 0
+		return NewIterator(func(vm *VM) (Value, bool, error) {
+			// Keys deleted while iterating are skipped
+			for i < len(keys) {
+				k := keys[i]
+				i++
+				if v, ok := x.Map[k]; ok {
+					return NewList([]Value{NewString(k), v}), true, nil
+				}
+			}
+			return nil, false, nil
+		}), nil
+	case *CustomValue:
+		if method, ok := vm.lookupMethod(x.Type(), "iter"); ok {
+			res, err := vm.call(method, []Value{x})
+			if err != nil {
+				return nil, err
+			}
+			return vm.iterate(res)
+		}
+	}
+	return nil, vm.currentFrame.runtimeError(fmt.Sprintf("Can't iterate over %s", v.Type().Name))
+}
+
+// Suspend the generator that handles yield and return the yielded value from
+// its resume
+func (vm *VM) yield(co *coroutine, arity int) error {
+	frame := vm.currentFrame
+	if arity != 1 {
+		return frame.runtimeError(fmt.Sprintf("Effect '%s' takes 1 argument, got %d", YIELD_EFFECT, arity))
+	}
+	if frame.level != co.base.level {
+		return frame.runtimeError("Can't yield from a call from go code inside a generator")
+	}
+	return vm.suspend(co, frame.popStack())
+}
+
+func builtinGenerator(vm *VM, args []Value) (Value, error) {
+	co, err := vm.newCoroutine("generator", args[0], YIELD_EFFECT)
+	if err != nil {
+		return nil, err
+	}
+	return NewIterator(func(vm *VM) (Value, bool, error) {
+		v, suspended, err := vm.resumeCoroutine(co, Nil, nil)
+		if err != nil || !suspended {
+			return nil, false, err
+		}
+		return v, true, nil
+	}), nil
+}
+
+func builtinIter(vm *VM, args []Value) (Value, error) {
+	return vm.iterate(args[0])
+}
+
+func iteratorNext(vm *VM, args []Value) (Value, error) {
+	v, ok, err := args[0].(*IteratorValue).Next(vm)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return Nil, nil
+	}
+	return v, nil
+}
+
+func iteratorDone(vm *VM, args []Value) (Value, error) {
+	done, err := args[0].(*IteratorValue).Done(vm)
+	if err != nil {
+		return nil, err
+	}
+	return NewBool(done), nil
+}
+
+func iteratorList(vm *VM, args []Value) (Value, error) {
+	it := args[0].(*IteratorValue)
+	items := []Value{}
+	for {
+		v, ok, err := it.Next(vm)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return NewList(items), nil
+		}
+		items = append(items, v)
+	}
+}
+
+// The combinators below return iterators that only read from the iterator
+// they are called on when their own values are needed
+
+func (vm *VM) countArg(method string, v Value) (int, error) {
+	n, err := vm.intArg(method, v)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("expected a non-negative count, got %d", n)
+	}
+	return n, nil
+}
+
+func iteratorTake(vm *VM, args []Value) (Value, error) {
+	it := args[0].(*IteratorValue)
+	n, err := vm.countArg("take", args[1])
+	if err != nil {
+		return nil, err
+	}
+	return NewIterator(func(vm *VM) (Value, bool, error) {
+		if n == 0 {
+			return nil, false, nil
+		}
+		n--
+		return it.Next(vm)
+	}), nil
+}
+
+func iteratorDrop(vm *VM, args []Value) (Value, error) {
+	it := args[0].(*IteratorValue)
+	n, err := vm.countArg("drop", args[1])
+	if err != nil {
+		return nil, err
+	}
+	return NewIterator(func(vm *VM) (Value, bool, error) {
+		for ; n > 0; n-- {
+			if _, ok, err := it.Next(vm); err != nil || !ok {
+				return nil, false, err
+			}
+		}
+		return it.Next(vm)
+	}), nil
+}
+
+func iteratorMap(vm *VM, args []Value) (Value, error) {
+	it := args[0].(*IteratorValue)
+	return NewIterator(func(vm *VM) (Value, bool, error) {
+		v, ok, err := it.Next(vm)
+		if err != nil || !ok {
+			return nil, false, err
+		}
+		res, err := vm.Call(args[1], v)
+		if err != nil {
+			return nil, false, err
+		}
+		return res, true, nil
+	}), nil
+}
+
+func iteratorFilter(vm *VM, args []Value) (Value, error) {
+	it := args[0].(*IteratorValue)
+	return NewIterator(func(vm *VM) (Value, bool, error) {
+		for {
+			v, ok, err := it.Next(vm)
+			if err != nil || !ok {
+				return nil, false, err
+			}
+			keep, err := vm.callPredicate("filter", args[1], v)
+			if err != nil {
+				return nil, false, err
+			}
+			if keep {
+				return v, true, nil
+			}
+		}
+	}), nil
+}
+
+// Lists of n values, the last one might be shorter
+func iteratorChunk(vm *VM, args []Value) (Value, error) {
+	it := args[0].(*IteratorValue)
+	n, err := vm.intArg("chunk", args[1])
+	if err != nil {
+		return nil, err
+	}
+	if n <= 0 {
+		return nil, fmt.Errorf("expected a positive chunk size, got %d", n)
+	}
+	return NewIterator(func(vm *VM) (Value, bool, error) {
+		chunk := []Value{}
+		for len(chunk) < n {
+			v, ok, err := it.Next(vm)
+			if err != nil {
+				return nil, false, err
+			}
+			if !ok {
+				break
+			}
+			chunk = append(chunk, v)
+		}
+		if len(chunk) == 0 {
+			return nil, false, nil
+		}
+		return NewList(chunk), true, nil
+	}), nil
+}
@@ -0,0 +1,208 @@
+package interpret
+
+import (
+	"fmt"
+	"strings"
+)
+
+var RangeType = &Type{Name: "Range", Builtins: BuiltinMap{}}
+
+func init() {
+	addNativeMethod(RangeType, "step", 2, rangeStep)
+	addNativeMethod(RangeType, "take", 2, rangeTake)
+	addNativeMethod(RangeType, "drop", 2, rangeDrop)
+
+	// The other sequence methods work on an iterator over the range
+	addNativeMethod(RangeType, "map", 2, rangeIterMethod(iteratorMap))
+	addNativeMethod(RangeType, "filter", 2, rangeIterMethod(iteratorFilter))
+	addNativeMethod(RangeType, "chunk", 2, rangeIterMethod(iteratorChunk))
+	addNativeMethod(RangeType, "list", 1, rangeIterMethod(iteratorList))
+}
+
+// A sequence of integers from Start towards End, Step apart. The values are
+// computed when needed, so a range takes the same memory whatever its length.
+type RangeValue struct {
+	Start     int
+	End       int
+	Step      int  // never 0
+	Inclusive bool // End is in the range if it's reached
+}
+
+func (t *RangeValue) Type() *Type {
+	return RangeType
+}
+
+func (t *RangeValue) String() string {
+	op := "..<"
+	if t.Inclusive {
+		op = ".."
+	}
+	if t.Step == 1 {
+		return fmt.Sprintf("%d%s%d", t.Start, op, t.End)
+	}
+	return fmt.Sprintf("(%d%s%d).step(%d)", t.Start, op, t.End, t.Step)
+}
+
+func NewRange(start, end int, inclusive bool) *RangeValue {
+	return &RangeValue{start, end, 1, inclusive}
+}
+
+// Number of values in the range
+func (t *RangeValue) Len() int {
+	// The last value that can be in the range
+	last := t.End
+	if !t.Inclusive {
+		if t.Step > 0 {
+			last--
+		} else {
+			last++
+		}
+	}
+	if t.Step > 0 && last >= t.Start {
+		return (last-t.Start)/t.Step + 1
+	}
+	if t.Step < 0 && last <= t.Start {
+		return (t.Start-last)/-t.Step + 1
+	}
+	return 0
+}
+
+// Returns (nil, false) in case of out of bounds error
+func (t *RangeValue) Get(idx int) (Value, bool) {
+	if idx < 0 || idx >= t.Len() {
+		return nil, false
+	}
+	return NewInt(t.Start + idx*t.Step), true
+}
+
+func (t *RangeValue) Contains(n int) bool {
+	d := n - t.Start
+	if d%t.Step != 0 {
+		return false
+	}
+	idx := d / t.Step
+	return idx >= 0 && idx < t.Len()
+}
+
+// The values from index from up to index to, with the bounds resolved like
+// for lists
+func (t *RangeValue) Slice(from, to int) *RangeValue {
+	from, to = sliceBounds(t.Len(), from, to)
+	start := t.Start + from*t.Step
+	return &RangeValue{start, start + (to-from)*t.Step, t.Step, false}
+}
+
+// Ranges are equal if they have the same values
+func (t *RangeValue) Eq(o *RangeValue) bool {
+	n := t.Len()
+	if n != o.Len() {
+		return false
+	}
+	return n == 0 || t.Start == o.Start && (n == 1 || t.Step == o.Step)
+}
+
+func (vm *VM) opRange(inclusive bool) error {
+	frame := vm.currentFrame
+	b := frame.popStack()
+	a := frame.popStack()
+	start, ok1 := a.(*IntValue)
+	end, ok2 := b.(*IntValue)
+	if !ok1 || !ok2 {
+		return frame.runtimeError(fmt.Sprintf("Range bounds must be Int, got %s and %s", a.Type().Name, b.Type().Name))
+	}
+	frame.pushStack(NewRange(start.Val, end.Val, inclusive))
+	return nil
+}
+
+// Replace the value and the collection on top of the stack with whether the
+// value is in the collection
+func (vm *VM) opIn() error {
+	frame := vm.currentFrame
+	collection := frame.popStack()
+	v := frame.popStack()
+	found, err := vm.contains(collection, v)
+	if err != nil {
+		return err
+	}
+	frame.pushStack(NewBool(found))
+	return nil
+}
+
+// Check if v is in the collection, which is a range, a list, a substring of
+// a string, a key of a map, or else one of the values iterated over
+func (vm *VM) contains(collection Value, v Value) (bool, error) {
+	switch c := collection.(type) {
+	case *RangeValue:
+		n, ok := v.(*IntValue)
+		return ok && c.Contains(n.Val), nil
+	case *ListValue:
+		idx, err := vm.indexOf(c, v)
+		return idx >= 0, err
+	case *StringValue:
+		s, err := vm.stringArg("in", v)
+		if err != nil {
+			return false, err
+		}
+		return strings.Contains(c.Val, s), nil
+	case *MapValue:
+		key, err := vm.stringArg("in", v)
+		if err != nil {
+			return false, err
+		}
+		_, ok := c.Map[key]
+		return ok, nil
+	}
+	it, err := vm.iterate(collection)
+	if err != nil {
+		return false, err
+	}
+	for {
+		item, ok, err := it.Next(vm)
+		if err != nil || !ok {
+			return false, err
+		}
+		if eq, err := vm.equal(item, v); err != nil || eq {
+			return eq, err
+		}
+	}
+}
+
+func rangeStep(vm *VM, args []Value) (Value, error) {
+	r := args[0].(*RangeValue)
+	step, err := vm.intArg("step", args[1])
+	if err != nil {
+		return nil, err
+	}
+	if step == 0 {
+		return nil, fmt.Errorf("expected a non-zero step")
+	}
+	return &RangeValue{r.Start, r.End, step, r.Inclusive}, nil
+}
+
+func rangeTake(vm *VM, args []Value) (Value, error) {
+	n, err := vm.countArg("take", args[1])
+	if err != nil {
+		return nil, err
+	}
+	return args[0].(*RangeValue).Slice(0, n), nil
+}
+
+func rangeDrop(vm *VM, args []Value) (Value, error) {
+	r := args[0].(*RangeValue)
+	n, err := vm.countArg("drop", args[1])
+	if err != nil {
+		return nil, err
+	}
+	return r.Slice(n, r.Len()), nil
+}
+
+// Call an iterator method with an iterator over the range
+func rangeIterMethod(f NativeFunction) NativeFunction {
+	return func(vm *VM, args []Value) (Value, error) {
+		it, err := vm.iterate(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return f(vm, append([]Value{it}, args[1:]...))
+	}
+}
@@ -0,0 +1,104 @@
+package interpret
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRanges(t *testing.T) {
+	assertRes(t, "len(0..10)", NewInt(11))
+	assertRes(t, "len(0..<10)", NewInt(10))
+	assertRes(t, "len((0..10).step(3))", NewInt(4))
+	assertRes(t, "len(10..0)", NewInt(0))
+	assertRes(t, "len((10..0).step(-2))", NewInt(6))
+	assertRes(t, "len((10..<0).step(-2))", NewInt(5))
+	assertRes(t, "len(0..<1000000000)", NewInt(1000000000))
+
+	assertRes(t, "(0..<10)[3]", NewInt(3))
+	assertRes(t, "(0..<10)[-1]", NewInt(9))
+	assertRes(t, "(5..1).step(-2)[2]", NewInt(1))
+	assertRes(t, "str((0..<10)[2:5])", NewString("2..<5"))
+	assertRes(t, "str((0..10).step(2)[1:3])", NewString("(2..<6).step(2)"))
+	assertRes(t, "str((0..<100).drop(95))", NewString("95..<100"))
+	assertRes(t, "str((0..<10).take(3))", NewString("0..<3"))
+	assertRes(t, "str(1..3)", NewString("1..3"))
+
+	assertRes(t, "s = 0\nfor x in 1..100 { s = s + x }\ns", NewInt(5050))
+	assertRes(t, "str((10..<0).step(-3).list())", NewString("list(10, 7, 4, 1)"))
+	assertRes(t, "n = 3\nstr((0..<n - 1).list())", NewString("list(0, 1)"))
+	assertRes(t, "1 + 1..3 == (2..3)", NewBool(true))
+
+	assertRes(t, "0..<3 == (0..2)", NewBool(true))
+	assertRes(t, "(0..10).step(20) == (0..0)", NewBool(true))
+	assertRes(t, "5..<5 == (1..0)", NewBool(true))
+	assertRes(t, "0..3 == (0..4)", NewBool(false))
+	assertRes(t, "(0..3) == [0, 1, 2, 3]", NewBool(false))
+
+	tests := []struct {
+		prog string
+		msg  string
+	}{
+		{"'a'..3", "Range bounds must be Int, got Str and Int"},
+		{"(0..3).step(0)", "expected a non-zero step"},
+		{"(0..3)[4]", "Range index out of bounds 4"},
+		{"(0..3).take(-1)", "expected a non-negative count"},
+	}
+	for _, test := range tests {
+		_, err := runWithGlobals(t, test.prog, nil)
+		if err == nil || !strings.Contains(err.Error(), test.msg) {
+			t.Errorf("Expected error '%s', got %v", test.msg, err)
+		}
+	}
+}
+
+func TestIn(t *testing.T) {
+	assertTrue(t, "5 in 0..10")
+	assertFalse(t, "11 in 0..10")
+	assertFalse(t, "10 in 0..<10")
+	assertTrue(t, "4 in (0..10).step(2)")
+	assertFalse(t, "5 in (0..10).step(2)")
+	assertTrue(t, "7 in (10..0).step(-3)")
+	assertFalse(t, "'a' in 0..10")
+	assertTrue(t, "2 in [1, 2]")
+	assertFalse(t, "[2] in [1, 2]")
+	assertTrue(t, "'bc' in 'abcd'")
+	assertTrue(t, "'a' in {'a': 1}")
+	assertFalse(t, "'b' in {'a': 1}")
+	assertTrue(t, "3 in iter([1, 2, 3])")
+	assertTrue(t, "!(3 in [1, 2]) && 1 in [1]")
+
+	_, err := runWithGlobals(t, "1 in 'abc'", nil)
+	if err == nil || !strings.Contains(err.Error(), "in expected Str argument, got Int") {
+		t.Errorf("Expected argument error, got %v", err)
+	}
+}
+
+func TestLazySequences(t *testing.T) {
+	assertRes(t, "str((0..<1000000000).map((x) => x * 2).filter((x) => x % 3 == 0).take(3).list())", NewString("list(0, 6, 12)"))
+	assertRes(t, "str((1..5).chunk(2).list())", NewString("list(list(1, 2), list(3, 4), list(5))"))
+	assertRes(t, "str(iter([1, 2, 3, 4]).drop(1).take(2).list())", NewString("list(2, 3)"))
+	assertRes(t, "str(iter([1, 2]).drop(5).list())", NewString("list()"))
+
+	// Values are only computed when they are consumed
+	assertRes(t, `
+	fn naturals() {
+		generator(() => {
+			i = 0
+			for true {
+				do yield(i)
+				i = i + 1
+			}
+		})
+	}
+	fn check(x) {
+		if x > 4 { raise("too far") }
+		x
+	}
+	it = naturals().map(check).drop(2)
+	str([it.next(), it.take(2).list()])`, NewString("list(2, list(3, 4))"))
+
+	_, err := runWithGlobals(t, "(0..3).chunk(0)", nil)
+	if err == nil || !strings.Contains(err.Error(), "expected a positive chunk size") {
+		t.Errorf("Expected chunk size error, got %v", err)
+	}
+}
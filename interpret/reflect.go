@@ -0,0 +1,463 @@
+package interpret
+
+import (
+	"fmt"
+	"reflect"
+	"unicode"
+	"unicode/utf8"
+)
+
+var valueType = reflect.TypeOf((*Value)(nil)).Elem()
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+var emptyInterfaceType = reflect.TypeOf((*interface{})(nil)).Elem()
+
+// Maps wosh types to go struct types, for converting between custom values
+// and structs
+type StructTypes interface {
+	// The wosh type of the go struct type t and the struct field index of
+	// each of its attributes
+	WoshType(t reflect.Type) (*Type, []int, bool)
+
+	// The go struct type of the wosh type t and the struct field index of
+	// each of its attributes
+	GoType(t *Type) (reflect.Type, []int, bool)
+}
+
+// Converts between go values and wosh values.
+//
+// Integers, strings and bools become Int, Str and Bool. Slices and arrays
+// become lists and maps with string keys become maps. Structs of the types
+// in Structs become custom values of that type and other structs become maps
+// of their exported fields. Functions become builtins with their arguments
+// and results converted. Nil becomes ().
+type Converter struct {
+	// Might be nil, then all structs are converted to and from maps
+	Structs StructTypes
+}
+
+// Create a builtin from an ordinary go function like `func(string, int) (string, error)`.
+//
+// Parameters and results can be Value (or a type implementing it) or any
+// type that a Converter without struct types converts, where slices
+// correspond to wosh lists. Variadic functions become variadic builtins. The
+// function can return at most one value, optionally followed by an error.
+// Functions without a result return ().
+func NewBuiltinFromFunc(name string, f interface{}) (*BuiltinValue, error) {
+	return (&Converter{}).BuiltinFromFunc(name, f)
+}
+
+func mustBuiltinFromFunc(name string, f interface{}) *BuiltinValue {
+	builtin, err := NewBuiltinFromFunc(name, f)
+	if err != nil {
+		panic(err)
+	}
+	return builtin
+}
+
+// Create a builtin from a go function, converting its arguments and results
+// with c
+func (c *Converter) BuiltinFromFunc(name string, f interface{}) (*BuiltinValue, error) {
+	fn := reflect.ValueOf(f)
+	if fn.Kind() != reflect.Func {
+		return nil, fmt.Errorf("Builtin '%s' is not a function", name)
+	}
+	return c.builtinFromFunc(name, fn)
+}
+
+func (c *Converter) builtinFromFunc(name string, fn reflect.Value) (*BuiltinValue, error) {
+	ft := fn.Type()
+	params := make([]reflect.Type, ft.NumIn())
+	for i := range params {
+		params[i] = ft.In(i)
+		if ft.IsVariadic() && i == len(params)-1 {
+			params[i] = params[i].Elem()
+		}
+		if !convertibleType(params[i]) {
+			return nil, fmt.Errorf("Builtin '%s' has unsupported parameter type %s", name, params[i])
+		}
+	}
+
+	numOut := ft.NumOut()
+	returnsError := numOut > 0 && ft.Out(numOut-1) == errorType
+	if returnsError {
+		numOut--
+	}
+	if numOut > 1 {
+		return nil, fmt.Errorf("Builtin '%s' returns more than one value", name)
+	}
+	if numOut == 1 && !convertibleType(ft.Out(0)) {
+		return nil, fmt.Errorf("Builtin '%s' has unsupported result type %s", name, ft.Out(0))
+	}
+
+	native := func(vm *VM, args []Value) (Value, error) {
+		in := make([]reflect.Value, len(args))
+		for i, arg := range args {
+			param := params[len(params)-1]
+			if i < len(params) {
+				param = params[i]
+			}
+			v, err := c.toGo(arg, param)
+			if err != nil {
+				return nil, fmt.Errorf("argument %d: %s", i+1, err)
+			}
+			in[i] = v
+		}
+		out := fn.Call(in)
+		if returnsError {
+			if err := out[len(out)-1]; !err.IsNil() {
+				return nil, err.Interface().(error)
+			}
+			out = out[:len(out)-1]
+		}
+		if len(out) == 0 {
+			return Nil, nil
+		}
+		return c.fromGo(out[0])
+	}
+
+	if ft.IsVariadic() {
+		return NewVariadicBuiltin(name, len(params)-1, VARIADIC, native), nil
+	}
+	return NewBuiltin(name, len(params), native), nil
+}
+
+func convertibleType(t reflect.Type) bool {
+	if t.Implements(valueType) {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.String, reflect.Bool, reflect.Interface, reflect.Struct:
+		return true
+	case reflect.Slice, reflect.Ptr:
+		return convertibleType(t.Elem())
+	case reflect.Map:
+		return t.Key().Kind() == reflect.String && convertibleType(t.Elem())
+	default:
+		return false
+	}
+}
+
+// Name of the wosh type corresponding to a go type, used in error messages
+func woshTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return IntType.Name
+	case reflect.String:
+		return StringType.Name
+	case reflect.Bool:
+		return BoolType.Name
+	case reflect.Slice:
+		return ListType.Name
+	case reflect.Map:
+		return MapType.Name
+	default:
+		return t.String()
+	}
+}
+
+// The name of the attribute for a struct field, given by its `wosh` tag or
+// the field name with a lower case first letter
+func AttributeName(field reflect.StructField) string {
+	if tag := field.Tag.Get("wosh"); tag != "" {
+		return tag
+	}
+	r, size := utf8.DecodeRuneInString(field.Name)
+	return string(unicode.ToLower(r)) + field.Name[size:]
+}
+
+// Convert a go value to a wosh value
+func (c *Converter) FromGo(v interface{}) (Value, error) {
+	if v == nil {
+		return Nil, nil
+	}
+	return c.fromGo(reflect.ValueOf(v))
+}
+
+func (c *Converter) fromGo(v reflect.Value) (Value, error) {
+	if v.Type().Implements(valueType) {
+		if (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() {
+			return Nil, nil
+		}
+		return v.Interface().(Value), nil
+	}
+
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return NewInt(int(v.Int())), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return NewInt(int(v.Uint())), nil
+	case reflect.String:
+		return NewString(v.String()), nil
+	case reflect.Bool:
+		return NewBool(v.Bool()), nil
+	case reflect.Interface, reflect.Ptr:
+		if v.IsNil() {
+			return Nil, nil
+		}
+		return c.fromGo(v.Elem())
+	case reflect.Slice, reflect.Array:
+		items := make([]Value, v.Len())
+		for i := range items {
+			item, err := c.fromGo(v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return NewList(items), nil
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("Can't convert map with %s keys, only string keys are supported", v.Type().Key())
+		}
+		m := NewMap()
+		iter := v.MapRange()
+		for iter.Next() {
+			item, err := c.fromGo(iter.Value())
+			if err != nil {
+				return nil, err
+			}
+			m.Set(iter.Key().String(), item)
+		}
+		return m, nil
+	case reflect.Struct:
+		return c.fromGoStruct(v)
+	case reflect.Func:
+		return c.builtinFromFunc("<go>", v)
+	default:
+		return nil, fmt.Errorf("Can't convert value of type %s to wosh", v.Type())
+	}
+}
+
+func (c *Converter) fromGoStruct(v reflect.Value) (Value, error) {
+	if c.Structs != nil {
+		if typ, fields, ok := c.Structs.WoshType(v.Type()); ok {
+			attributes := make([]Value, len(fields))
+			for i, field := range fields {
+				attr, err := c.fromGo(v.Field(field))
+				if err != nil {
+					return nil, err
+				}
+				attributes[i] = attr
+			}
+			return NewCustom(typ, attributes), nil
+		}
+	}
+
+	m := NewMap()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.PkgPath != "" {
+			// unexported
+			continue
+		}
+		attr, err := c.fromGo(v.Field(i))
+		if err != nil {
+			return nil, err
+		}
+		m.Set(AttributeName(field), attr)
+	}
+	return m, nil
+}
+
+// Convert a wosh value to a go value.
+//
+// Int, Str and Bool become int, string and bool, lists become []interface{},
+// maps become map[string]interface{} and () becomes nil. Values of the types
+// in Structs become their struct type and other custom values become maps of
+// their attributes. Other values, like functions, are returned as they are.
+func (c *Converter) ToGo(v Value) (interface{}, error) {
+	res, err := c.toGo(v, emptyInterfaceType)
+	if err != nil {
+		return nil, err
+	}
+	return res.Interface(), nil
+}
+
+// Convert a wosh value and store it in the value that target points to
+func (c *Converter) ToGoInto(v Value, target interface{}) error {
+	ptr := reflect.ValueOf(target)
+	if ptr.Kind() != reflect.Ptr || ptr.IsNil() {
+		return fmt.Errorf("Target must be a non nil pointer, got %T", target)
+	}
+	res, err := c.toGo(v, ptr.Elem().Type())
+	if err != nil {
+		return err
+	}
+	ptr.Elem().Set(res)
+	return nil
+}
+
+func (c *Converter) toGo(v Value, t reflect.Type) (reflect.Value, error) {
+	if t == emptyInterfaceType {
+		return c.toGoDynamic(v)
+	}
+	if reflect.TypeOf(v).AssignableTo(t) {
+		return reflect.ValueOf(v), nil
+	}
+	if _, ok := v.(*NilValue); ok {
+		switch t.Kind() {
+		case reflect.Ptr, reflect.Slice, reflect.Map, reflect.Interface:
+			return reflect.Zero(t), nil
+		}
+	}
+
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if n, ok := v.(*IntValue); ok {
+			return reflect.ValueOf(n.Val).Convert(t), nil
+		}
+	case reflect.String:
+		if s, ok := v.(*StringValue); ok {
+			return reflect.ValueOf(s.Val).Convert(t), nil
+		}
+	case reflect.Bool:
+		if b, ok := v.(*BoolValue); ok {
+			return reflect.ValueOf(b.Val).Convert(t), nil
+		}
+	case reflect.Slice:
+		if lst, ok := v.(*ListValue); ok {
+			items := lst.Items()
+			slice := reflect.MakeSlice(t, len(items), len(items))
+			for i, item := range items {
+				elem, err := c.toGo(item, t.Elem())
+				if err != nil {
+					return reflect.Value{}, err
+				}
+				slice.Index(i).Set(elem)
+			}
+			return slice, nil
+		}
+	case reflect.Map:
+		if m, ok := v.(*MapValue); ok && t.Key().Kind() == reflect.String {
+			res := reflect.MakeMapWithSize(t, len(m.Map))
+			for key, item := range m.Map {
+				elem, err := c.toGo(item, t.Elem())
+				if err != nil {
+					return reflect.Value{}, err
+				}
+				res.SetMapIndex(reflect.ValueOf(key).Convert(t.Key()), elem)
+			}
+			return res, nil
+		}
+	case reflect.Struct:
+		return c.toGoStruct(v, t)
+	case reflect.Ptr:
+		elem, err := c.toGo(v, t.Elem())
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		ptr := reflect.New(t.Elem())
+		ptr.Elem().Set(elem)
+		return ptr, nil
+	case reflect.Interface:
+		res, err := c.toGoDynamic(v)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		if res.Type().AssignableTo(t) {
+			return res, nil
+		}
+	}
+	return reflect.Value{}, fmt.Errorf("expected %s, got %s", woshTypeName(t), v.Type().Name)
+}
+
+func (c *Converter) toGoStruct(v Value, t reflect.Type) (reflect.Value, error) {
+	res := reflect.New(t).Elem()
+	switch x := v.(type) {
+	case *CustomValue:
+		if c.Structs == nil {
+			break
+		}
+		goType, fields, ok := c.Structs.GoType(x.Typ)
+		if !ok || goType != t {
+			break
+		}
+		for i, field := range fields {
+			attr, err := c.toGo(x.Attributes[i], t.Field(field).Type)
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			res.Field(field).Set(attr)
+		}
+		return res, nil
+	case *MapValue:
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			item, ok := x.Map[AttributeName(field)]
+			if field.PkgPath != "" || !ok {
+				continue
+			}
+			attr, err := c.toGo(item, field.Type)
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			res.Field(i).Set(attr)
+		}
+		return res, nil
+	}
+	return reflect.Value{}, fmt.Errorf("expected %s, got %s", t, v.Type().Name)
+}
+
+func (c *Converter) toGoDynamic(v Value) (reflect.Value, error) {
+	var res interface{}
+	switch x := v.(type) {
+	case *NilValue:
+		return reflect.Zero(emptyInterfaceType), nil
+	case *IntValue:
+		res = x.Val
+	case *StringValue:
+		res = x.Val
+	case *BoolValue:
+		res = x.Val
+	case *ListValue:
+		items := []interface{}{}
+		for _, item := range x.Items() {
+			elem, err := c.ToGo(item)
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			items = append(items, elem)
+		}
+		res = items
+	case *MapValue:
+		m := map[string]interface{}{}
+		for key, item := range x.Map {
+			elem, err := c.ToGo(item)
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			m[key] = elem
+		}
+		res = m
+	case *CustomValue:
+		if c.Structs != nil {
+			if t, _, ok := c.Structs.GoType(x.Typ); ok {
+				s, err := c.toGoStruct(x, t)
+				if err != nil {
+					return reflect.Value{}, err
+				}
+				res = s.Interface()
+				break
+			}
+		}
+		m := map[string]interface{}{}
+		for i, item := range x.Attributes {
+			elem, err := c.ToGo(item)
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			m[x.Typ.Attributes[i]] = elem
+		}
+		res = m
+	default:
+		res = v
+	}
+	// Wrap in an interface value so the result is assignable to interface{}
+	wrapped := reflect.New(emptyInterfaceType).Elem()
+	wrapped.Set(reflect.ValueOf(res))
+	return wrapped, nil
+}
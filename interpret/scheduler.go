@@ -0,0 +1,428 @@
+package interpret
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+var TaskType = &Type{Name: "Task", Builtins: BuiltinMap{}}
+var ChannelType = &Type{Name: "Chan", Builtins: BuiltinMap{}}
+
+// Name of the effect that tasks are parked on while they wait. It's handled
+// by the scheduler and performed by the builtins that wait, like recv.
+const AWAIT_EFFECT = "await"
+
+func init() {
+	addNativeMethod(TaskType, "join", 1, taskJoin)
+	addNativeMethod(TaskType, "done", 1, taskDone)
+
+	addNativeMethod(ChannelType, "send", 2, chanSend)
+	addNativeMethod(ChannelType, "recv", 1, chanRecv)
+	addNativeMethod(ChannelType, "close", 1, chanClose)
+}
+
+// Runs tasks, which are functions that run concurrently on the vm. Only one
+// task runs at a time, until it waits for something. Waiting outside of a
+// task, like in the main program, runs the other tasks until the wait is
+// over.
+type scheduler struct {
+	ready  []*TaskValue // tasks that can continue, in the order they got ready
+	timers []*timer
+	// Commands running on goroutines
+	pending int
+	// Tasks that ended with an exception, reported if they are never joined
+	failed []*TaskValue
+
+	// Functions from goroutines to run on the vm, guarded by mu
+	mu        sync.Mutex
+	completed []func()
+	notify    chan struct{} // signaled when a function is added to completed
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{notify: make(chan struct{}, 1)}
+}
+
+// Something a task or the main program waits for
+type waiter struct {
+	name  string     // name of the builtin that waits, for errors
+	task  *TaskValue // the parked task, nil when waiting outside a task
+	woken bool
+	value Value
+	err   error
+}
+
+type timer struct {
+	at     time.Time
+	waiter *waiter
+}
+
+type TaskValue struct {
+	co      *coroutine
+	waiting *waiter // what the task is parked on, nil if it's ready
+
+	finished bool
+	result   Value
+	err      *RuntimeError // the uncaught exception that ended the task
+	joined   bool
+	joiners  []*waiter
+}
+
+func (t *TaskValue) Type() *Type {
+	return TaskType
+}
+
+func (t *TaskValue) String() string {
+	return "Task[]"
+}
+
+type ChannelValue struct {
+	buffer   []Value
+	capacity int // max number of buffered values, 0 if unbounded
+	closed   bool
+	senders  []*waiter // waiting to add their value when the buffer is full
+	receiver []*waiter
+}
+
+func (t *ChannelValue) Type() *Type {
+	return ChannelType
+}
+
+func (t *ChannelValue) String() string {
+	return fmt.Sprintf("Chan[%d]", len(t.buffer))
+}
+
+// Mark w as done with the result value. A parked task gets ready to continue.
+func (s *scheduler) wake(w *waiter, value Value) {
+	w.woken = true
+	w.value = value
+	if w.task != nil {
+		s.ready = append(s.ready, w.task)
+	}
+}
+
+// Run f on the vm from a goroutine, when the scheduler gets to it
+func (s *scheduler) complete(f func()) {
+	s.mu.Lock()
+	s.completed = append(s.completed, f)
+	s.mu.Unlock()
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Run the functions of finished goroutines and wake the sleepers whose time is up
+func (s *scheduler) poll(now time.Time) {
+	s.mu.Lock()
+	completed := s.completed
+	s.completed = nil
+	s.mu.Unlock()
+	for _, f := range completed {
+		f()
+	}
+
+	timers := s.timers[:0]
+	for _, t := range s.timers {
+		if now.Before(t.at) {
+			timers = append(timers, t)
+		} else {
+			s.wake(t.waiter, Nil)
+		}
+	}
+	s.timers = timers
+}
+
+// Wait for w. A task is parked on the await effect, and the returned error
+// exits its dispatch loop until it's woken. Elsewhere the scheduler runs the
+// tasks until w is woken.
+func (vm *VM) await(w *waiter) (Value, error) {
+	if co := vm.findCoroutine(AWAIT_EFFECT); co != nil {
+		w.task = co.task
+		co.task.waiting = w
+		return nil, vm.suspend(co, Nil)
+	}
+	if err := vm.runTasks(func() bool { return w.woken }); err != nil {
+		return nil, err
+	}
+	return w.value, w.err
+}
+
+// Run ready tasks until done returns true, waiting for timers and commands
+// when no task is ready
+func (vm *VM) runTasks(done func() bool) error {
+	s := vm.scheduler
+	for {
+		s.poll(time.Now())
+		if done() {
+			return nil
+		}
+		if len(s.ready) > 0 {
+			task := s.ready[0]
+			s.ready = s.ready[1:]
+			if err := vm.stepTask(task); err != nil {
+				return err
+			}
+			continue
+		}
+		if len(s.timers) == 0 && s.pending == 0 {
+			return vm.currentFrame.runtimeError("Deadlock: waiting with no task that can continue")
+		}
+		if err := vm.idle(); err != nil {
+			return err
+		}
+	}
+}
+
+// Sleep until the next timer or a command finishes, or the run is stopped
+func (vm *VM) idle() error {
+	s := vm.scheduler
+	var wake <-chan time.Time
+	if len(s.timers) > 0 {
+		next := s.timers[0].at
+		for _, t := range s.timers {
+			if t.at.Before(next) {
+				next = t.at
+			}
+		}
+		t := time.NewTimer(time.Until(next))
+		defer t.Stop()
+		wake = t.C
+	}
+	var deadline <-chan time.Time
+	if !vm.deadline.IsZero() {
+		t := time.NewTimer(time.Until(vm.deadline))
+		defer t.Stop()
+		deadline = t.C
+	}
+	select {
+	case <-s.notify:
+	case <-wake:
+	case <-deadline:
+	case <-vm.ctx.Done():
+	}
+	return vm.checkTime()
+}
+
+// Continue a ready task until it waits or ends. Exceptions end the task and
+// are raised by join, other errors stop the run.
+func (vm *VM) stepTask(task *TaskValue) error {
+	value := Value(Nil)
+	var raise *RuntimeError
+	if w := task.waiting; w != nil {
+		task.waiting = nil
+		value = w.value
+		if w.err != nil {
+			raise = vm.waitError(w)
+		}
+	}
+	res, suspended, err := vm.resumeCoroutine(task.co, value, raise)
+	if suspended {
+		return nil
+	}
+	if err != nil {
+		rtErr, ok := err.(*RuntimeError)
+		if !ok {
+			return err
+		}
+		task.err = rtErr
+		vm.scheduler.failed = append(vm.scheduler.failed, task)
+	}
+	task.finished = true
+	task.result = res
+	for _, w := range task.joiners {
+		if task.err != nil {
+			w.err = task.err
+		}
+		vm.scheduler.wake(w, res)
+	}
+	task.joiners = nil
+	return nil
+}
+
+// Run the tasks that can still continue when the main program is done. The
+// exception of a failed task that was never joined is the error of the run.
+func (vm *VM) finishTasks() error {
+	s := vm.scheduler
+	err := vm.runTasks(func() bool {
+		return len(s.ready) == 0 && len(s.timers) == 0 && s.pending == 0
+	})
+	if err != nil {
+		return err
+	}
+	for _, task := range s.failed {
+		if !task.joined {
+			return task.err
+		}
+	}
+	return nil
+}
+
+// The error of a wait as an exception raised in the parked task
+func (vm *VM) waitError(w *waiter) *RuntimeError {
+	if rtErr, ok := w.err.(*RuntimeError); ok {
+		return rtErr
+	}
+	return w.task.co.frame.runtimeError(fmt.Sprintf("%s: %s", w.name, w.err)).(*RuntimeError)
+}
+
+func builtinSpawn(vm *VM, args []Value) (Value, error) {
+	co, err := vm.newCoroutine("spawn", args[0], AWAIT_EFFECT)
+	if err != nil {
+		return nil, err
+	}
+	co.detached = true
+	task := &TaskValue{co: co}
+	co.task = task
+	vm.scheduler.ready = append(vm.scheduler.ready, task)
+	return task, nil
+}
+
+func builtinSleep(vm *VM, args []Value) (Value, error) {
+	ms, err := vm.intArg("sleep", args[0])
+	if err != nil {
+		return nil, err
+	}
+	w := &waiter{name: "sleep"}
+	at := time.Now().Add(time.Duration(ms) * time.Millisecond)
+	vm.scheduler.timers = append(vm.scheduler.timers, &timer{at, w})
+	return vm.await(w)
+}
+
+func builtinChan(vm *VM, args []Value) (Value, error) {
+	capacity := 0
+	if len(args) > 0 {
+		n, err := vm.intArg("chan", args[0])
+		if err != nil {
+			return nil, err
+		}
+		if n <= 0 {
+			return nil, fmt.Errorf("expected a positive capacity, got %d", n)
+		}
+		capacity = n
+	}
+	return &ChannelValue{capacity: capacity}, nil
+}
+
+// Run a command on a goroutine, so that other tasks can run until it's done
+func (vm *VM) runCommand(name string, args []string) (Value, error) {
+	s := vm.scheduler
+	cmd := exec.CommandContext(vm.ctx, name, args...)
+	cmd.Env = vm.sandbox.Environ(os.Environ())
+	// The output can't be larger than what's left of the allocation limit
+	out := &limitedBuffer{max: -1}
+	if vm.limits.MaxAllocations > 0 {
+		out.max = vm.limits.MaxAllocations - vm.allocations
+	}
+	cmd.Stdout = out
+	w := &waiter{name: "exec"}
+	s.pending++
+	go func() {
+		err := cmd.Run()
+		s.complete(func() {
+			s.pending--
+			if limitErr := vm.reserve(1 + out.written); limitErr != nil {
+				w.err = limitErr
+			} else if err != nil {
+				w.err = fmt.Errorf("%s: %s", name, err)
+			}
+			s.wake(w, NewString(out.buf.String()))
+		})
+	}()
+	return vm.await(w)
+}
+
+// Collects the output of a command, failing the writes past max bytes
+// unless max is negative
+type limitedBuffer struct {
+	buf     bytes.Buffer
+	max     int
+	written int // bytes written, including the failed writes
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.written += len(p)
+	if b.max >= 0 && b.written > b.max {
+		return 0, fmt.Errorf("output is too large")
+	}
+	return b.buf.Write(p)
+}
+
+func taskJoin(vm *VM, args []Value) (Value, error) {
+	task := args[0].(*TaskValue)
+	task.joined = true
+	if task.finished {
+		if task.err != nil {
+			return nil, task.err
+		}
+		return task.result, nil
+	}
+	w := &waiter{name: "join"}
+	task.joiners = append(task.joiners, w)
+	return vm.await(w)
+}
+
+func taskDone(vm *VM, args []Value) (Value, error) {
+	return NewBool(args[0].(*TaskValue).finished), nil
+}
+
+func chanSend(vm *VM, args []Value) (Value, error) {
+	ch := args[0].(*ChannelValue)
+	if ch.closed {
+		return nil, fmt.Errorf("channel is closed")
+	}
+	if len(ch.receiver) > 0 {
+		w := ch.receiver[0]
+		ch.receiver = ch.receiver[1:]
+		vm.scheduler.wake(w, args[1])
+		return Nil, nil
+	}
+	if ch.capacity == 0 || len(ch.buffer) < ch.capacity {
+		ch.buffer = append(ch.buffer, args[1])
+		return Nil, nil
+	}
+	w := &waiter{name: "send", value: args[1]}
+	ch.senders = append(ch.senders, w)
+	return vm.await(w)
+}
+
+func chanRecv(vm *VM, args []Value) (Value, error) {
+	ch := args[0].(*ChannelValue)
+	if len(ch.buffer) > 0 {
+		v := ch.buffer[0]
+		ch.buffer = ch.buffer[1:]
+		if len(ch.senders) > 0 {
+			w := ch.senders[0]
+			ch.senders = ch.senders[1:]
+			ch.buffer = append(ch.buffer, w.value)
+			vm.scheduler.wake(w, Nil)
+		}
+		return v, nil
+	}
+	if ch.closed {
+		return Nil, nil
+	}
+	w := &waiter{name: "recv"}
+	ch.receiver = append(ch.receiver, w)
+	return vm.await(w)
+}
+
+// Close the channel. Waiting receivers get (), and waiting senders an error.
+func chanClose(vm *VM, args []Value) (Value, error) {
+	ch := args[0].(*ChannelValue)
+	ch.closed = true
+	for _, w := range ch.receiver {
+		vm.scheduler.wake(w, Nil)
+	}
+	for _, w := range ch.senders {
+		w.err = fmt.Errorf("channel is closed")
+		vm.scheduler.wake(w, Nil)
+	}
+	ch.receiver = nil
+	ch.senders = nil
+	return Nil, nil
+}
@@ -0,0 +1,209 @@
+package interpret
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTasks(t *testing.T) {
+	assertRes(t, `
+	fn main() {
+		c = chan()
+		producer = spawn(() => {
+			for x in [1, 2, 3] { c.send(x) }
+			c.close()
+			"done"
+		})
+		sum = 0
+		x = c.recv()
+		for x != () {
+			sum = sum + x
+			x = c.recv()
+		}
+		str([sum, producer.join()])
+	}
+	main()`, NewString(`list(6, "done")`))
+
+	// Tasks run in turns when they wait
+	assertRes(t, `
+	fn main() {
+		log = chan()
+		ping = chan()
+		pong = chan()
+		a = spawn(() => {
+			for i in [1, 2] {
+				log.send("ping")
+				ping.send(i)
+				pong.recv()
+			}
+		})
+		b = spawn(() => {
+			for i in [1, 2] {
+				ping.recv()
+				log.send("pong")
+				pong.send(i)
+			}
+		})
+		a.join()
+		b.join()
+		str([log.recv(), log.recv(), log.recv(), log.recv()])
+	}
+	main()`, NewString(`list("ping", "pong", "ping", "pong")`))
+
+	// A full channel blocks the sender until there is room
+	assertRes(t, `
+	fn main() {
+		c = chan(1)
+		sent = chan()
+		spawn(() => {
+			for x in [1, 2, 3] {
+				c.send(x)
+				sent.send(x)
+			}
+		})
+		first = sent.recv()
+		str([first, c.recv(), sent.recv(), c.recv(), c.recv()])
+	}
+	main()`, NewString("list(1, 1, 2, 2, 3)"))
+
+	// Waiting inside a call from go code runs the other tasks from there
+	assertRes(t, `
+	fn main() {
+		c = chan()
+		t = spawn(() => [1, 2].map((x) => c.recv() * x))
+		c.send(10)
+		c.send(20)
+		str(t.join())
+	}
+	main()`, NewString("list(10, 40)"))
+
+	// Sleeping tasks wake in order
+	assertRes(t, `
+	fn main() {
+		c = chan()
+		fn sleeper(ms) {
+			() => {
+				sleep(ms)
+				c.send(ms)
+			}
+		}
+		spawn(sleeper(20))
+		spawn(sleeper(1))
+		spawn(sleeper(10))
+		str([c.recv(), c.recv(), c.recv()])
+	}
+	main()`, NewString("list(1, 10, 20)"))
+
+	// Exceptions in tasks are raised by join
+	assertRes(t, `
+	fn main() {
+		t = spawn(() => raise("boom"))
+		sleep(1)
+		[t.done(), try { t.join() } handle { exn(e) -> e.msg() }]
+	}
+	str(main())`, NewString(`list(true, "boom")`))
+
+	tests := []struct {
+		prog string
+		msg  string
+	}{
+		{"chan().recv()", "Deadlock"},
+		{"c = chan()\nc.close()\nc.send(1)", "channel is closed"},
+		{"spawn((x) => x)", "expected a function without parameters"},
+		{"chan(0)", "expected a positive capacity"},
+		{"t = spawn(() => do await(1))\nt.join()", "Effect 'await' can only be performed by the scheduler"},
+	}
+	for _, test := range tests {
+		_, err := runWithGlobals(t, test.prog, nil)
+		if err == nil || !strings.Contains(err.Error(), test.msg) {
+			t.Errorf("Expected error '%s', got %v", test.msg, err)
+		}
+	}
+}
+
+func TestUnjoinedTasks(t *testing.T) {
+	// Tasks that are still sleeping when the program is done run to the end
+	log := NewMap()
+	_, err := runWithGlobals(t, `spawn(() => {
+		sleep(10)
+		log["woke"] = true
+	})
+	"done"`, map[string]Value{"log": log})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := log.Map["woke"]; !ok {
+		t.Error("Expected the sleeping task to run")
+	}
+
+	// An exception of a task that is never joined is the error of the run
+	_, err = runWithGlobals(t, `spawn(() => { raise("boom") })
+	"done"`, nil)
+	if err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("Expected the exception of the task, got %v", err)
+	}
+	_, err = runWithGlobals(t, `spawn(() => {
+		sleep(1)
+		raise("late boom")
+	})`, nil)
+	if err == nil || !strings.Contains(err.Error(), "late boom") {
+		t.Errorf("Expected the exception of the sleeping task, got %v", err)
+	}
+}
+
+func TestTaskAlreadyRunning(t *testing.T) {
+	vm := NewVm()
+	vm.currentFrame = vm.NewFrame(NewClosure(hostFunction, []*BoxValue{}), []Value{}, nil, -1)
+	co := &coroutine{running: true}
+	co.task = &TaskValue{co: co}
+	_, _, err := vm.resumeCoroutine(co, Nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "Task is already running") {
+		t.Errorf("Expected task error, got %v", err)
+	}
+}
+
+func TestTaskCommands(t *testing.T) {
+	// Commands run on goroutines, so tasks waiting for them overlap
+	start := time.Now()
+	res, err := runWithGlobals(t, `
+	fn main() {
+		tasks = [1, 2, 3].map((i) => spawn(() => exec("sleep", "0.2")))
+		tasks.map((t) => t.join())
+		exec("echo", "hi")
+	}
+	main()`, nil)
+	if err != nil || res.String() != `"hi\n"` {
+		t.Fatalf("Unexpected result %v, %v", res, err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected commands to run concurrently, took %s", elapsed)
+	}
+
+	_, err = runWithGlobals(t, `t = spawn(() => exec("false"))
+	try { t.join() } handle { exn(e) -> raise(e.msg() + "!") }`, nil)
+	if err == nil || !strings.Contains(err.Error(), "exec: false: exit status 1!") {
+		t.Errorf("Expected exec error, got %v", err)
+	}
+}
+
+func TestTaskTimeout(t *testing.T) {
+	main, err := parseMain("sleep(10000)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	function, err := Compile(main)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := NewVm()
+	vm.SetLimits(Limits{Timeout: 50 * time.Millisecond})
+	start := time.Now()
+	_, err = vm.Interpret(function)
+	if _, ok := err.(*LimitError); !ok {
+		t.Errorf("Expected limit error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the timeout to stop the sleep, took %s", elapsed)
+	}
+}
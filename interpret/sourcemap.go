@@ -0,0 +1,81 @@
+package interpret
+
+import (
+	"sort"
+
+	"github.com/rymdhund/wosh/lexer"
+)
+
+// Where the code of an instruction comes from
+type SourcePos struct {
+	File *Source // nil if unknown
+	Area lexer.Area
+}
+
+// Line counting from 1
+func (p SourcePos) Line() int {
+	return p.Area.Start.Line + 1
+}
+
+// Column counting from 1
+func (p SourcePos) Col() int {
+	return p.Area.Start.Col + 1
+}
+
+// Maps each byte of a chunk to a source position. It's run-length encoded:
+// consecutive bytes with the same position share one run.
+type SourceMap struct {
+	Files []*Source // the files referenced by index from the runs
+	runs  []sourceRun
+	size  int // number of mapped bytes
+	file  int // file of the bytes being added, -1 if unknown
+}
+
+type sourceRun struct {
+	start int // offset of the first byte in the run
+	file  int // index in Files, -1 if unknown
+	area  lexer.Area
+}
+
+func NewSourceMap() *SourceMap {
+	return &SourceMap{file: -1}
+}
+
+// Set the file of the bytes added from now on
+func (m *SourceMap) setFile(file *Source) {
+	if file == nil {
+		m.file = -1
+		return
+	}
+	for i, f := range m.Files {
+		if f == file {
+			m.file = i
+			return
+		}
+	}
+	m.Files = append(m.Files, file)
+	m.file = len(m.Files) - 1
+}
+
+// Map the next n bytes to area
+func (m *SourceMap) add(area lexer.Area, n int) {
+	last := len(m.runs) - 1
+	if last < 0 || m.runs[last].area != area || m.runs[last].file != m.file {
+		m.runs = append(m.runs, sourceRun{m.size, m.file, area})
+	}
+	m.size += n
+}
+
+func (m *SourceMap) Lookup(offset int) SourcePos {
+	i := sort.Search(len(m.runs), func(i int) bool {
+		return m.runs[i].start > offset
+	}) - 1
+	if i < 0 {
+		return SourcePos{}
+	}
+	run := m.runs[i]
+	if run.file < 0 {
+		return SourcePos{nil, run.area}
+	}
+	return SourcePos{m.Files[run.file], run.area}
+}
@@ -0,0 +1,512 @@
+package interpret
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Go implemented methods on the builtin types. The receiver is passed as the
+// first argument and is included in the arity.
+func init() {
+	addNativeMethod(ListType, "map", 2, listMap)
+	addNativeMethod(ListType, "filter", 2, listFilter)
+	addNativeMethod(ListType, "fold", 3, listFold)
+	addNativeMethod(ListType, "sort", 1, listSort)
+	addNativeMethod(ListType, "sort_by", 2, listSortBy)
+	addNativeMethod(ListType, "sort_with", 2, listSortWith)
+	addNativeMethod(ListType, "reverse", 1, listReverse)
+	addNativeMethod(ListType, "contains", 2, listContains)
+	addNativeMethod(ListType, "index", 2, listIndex)
+	addNativeMethod(ListType, "zip", 2, listZip)
+	addNativeMethod(ListType, "enumerate", 1, listEnumerate)
+	addNativeMethod(ListType, "eq", 2, listEq)
+
+	addVariadicNativeMethod(StringType, "split", 1, 2, strSplit)
+	addNativeMethod(StringType, "join", 2, strJoin)
+	addNativeMethod(StringType, "trim", 1, strTrim)
+	addNativeMethod(StringType, "replace", 3, strReplace)
+	addNativeMethod(StringType, "find", 2, strFind)
+	addNativeMethod(StringType, "upper", 1, strUpper)
+	addNativeMethod(StringType, "lower", 1, strLower)
+	addNativeMethod(StringType, "starts_with", 2, strStartsWith)
+	addNativeMethod(StringType, "ends_with", 2, strEndsWith)
+	addNativeMethod(StringType, "chars", 1, strChars)
+	addNativeMethod(StringType, "repeat", 2, strRepeat)
+
+	addNativeMethod(MapType, "keys", 1, mapKeys)
+	addNativeMethod(MapType, "values", 1, mapValues)
+	addNativeMethod(MapType, "has", 2, mapHas)
+	addNativeMethod(MapType, "delete", 2, mapDelete)
+	addVariadicNativeMethod(MapType, "get", 2, 3, mapGet)
+	addNativeMethod(MapType, "eq", 2, mapEq)
+
+	addNativeMethod(ExceptionType, "msg", 1, exnMsg)
+	addNativeMethod(ExceptionType, "trace", 1, exnTrace)
+}
+
+func addNativeMethod(typ *Type, name string, arity int, f NativeFunction) {
+	addVariadicNativeMethod(typ, name, arity, arity, f)
+}
+
+func addVariadicNativeMethod(typ *Type, name string, minArity int, maxArity int, f NativeFunction) {
+	method := func(vm *VM, args []Value) (Value, error) {
+		// The receiver can have any type when called like `List.map(x, f)`
+		if args[0].Type() != typ {
+			return nil, vm.argError(name, args[0], typ.Name)
+		}
+		return f(vm, args)
+	}
+	typ.Builtins[name] = NewVariadicBuiltin(name, minArity, maxArity, method)
+}
+
+func (vm *VM) argError(method string, arg Value, expected string) error {
+	return vm.currentFrame.runtimeError(fmt.Sprintf("%s expected %s argument, got %s", method, expected, arg.Type().Name))
+}
+
+func (vm *VM) listArg(method string, v Value) (*ListValue, error) {
+	lst, ok := v.(*ListValue)
+	if !ok {
+		return nil, vm.argError(method, v, ListType.Name)
+	}
+	return lst, nil
+}
+
+func (vm *VM) stringArg(method string, v Value) (string, error) {
+	s, ok := v.(*StringValue)
+	if !ok {
+		return "", vm.argError(method, v, StringType.Name)
+	}
+	return s.Val, nil
+}
+
+func (vm *VM) intArg(method string, v Value) (int, error) {
+	n, ok := v.(*IntValue)
+	if !ok {
+		return 0, vm.argError(method, v, IntType.Name)
+	}
+	return n.Val, nil
+}
+
+// Call f and expect a bool result
+func (vm *VM) callPredicate(method string, f Value, args ...Value) (bool, error) {
+	res, err := vm.Call(f, args...)
+	if err != nil {
+		return false, err
+	}
+	b, ok := res.(*BoolValue)
+	if !ok {
+		return false, vm.currentFrame.runtimeError(fmt.Sprintf("%s expected function returning Bool, got %s", method, res.Type().Name))
+	}
+	return b.Val, nil
+}
+
+// Compare values with builtin equality, falling back to the eq method of the type
+func (vm *VM) equal(a, b Value) (bool, error) {
+	if res := builtinEq(a, b); res != nil {
+		return res.Val, nil
+	}
+	method, ok := vm.lookupMethod(a.Type(), "eq")
+	if !ok {
+		return a == b, nil
+	}
+	return vm.callPredicate("eq", method, a, b)
+}
+
+func (vm *VM) less(method string, a, b Value) (bool, error) {
+	res := builtinLess(a, b)
+	if res == nil {
+		return false, vm.currentFrame.runtimeError(fmt.Sprintf("%s can't compare %s and %s", method, a.Type().Name, b.Type().Name))
+	}
+	return res.Val, nil
+}
+
+func listMap(vm *VM, args []Value) (Value, error) {
+	items := args[0].(*ListValue).Items()
+	for i, item := range items {
+		res, err := vm.Call(args[1], item)
+		if err != nil {
+			return nil, err
+		}
+		items[i] = res
+	}
+	return NewList(items), nil
+}
+
+func listFilter(vm *VM, args []Value) (Value, error) {
+	res := []Value{}
+	for _, item := range args[0].(*ListValue).Items() {
+		keep, err := vm.callPredicate("filter", args[1], item)
+		if err != nil {
+			return nil, err
+		}
+		if keep {
+			res = append(res, item)
+		}
+	}
+	return NewList(res), nil
+}
+
+func listFold(vm *VM, args []Value) (Value, error) {
+	acc := args[1]
+	for _, item := range args[0].(*ListValue).Items() {
+		var err error
+		acc, err = vm.Call(args[2], acc, item)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return acc, nil
+}
+
+// Stable sort of items, less returns an error to abort the sort
+func sortItems(items []Value, less func(a, b Value) (bool, error)) error {
+	var err error
+	sort.SliceStable(items, func(i, j int) bool {
+		if err != nil {
+			return false
+		}
+		var res bool
+		res, err = less(items[i], items[j])
+		return res
+	})
+	return err
+}
+
+func listSort(vm *VM, args []Value) (Value, error) {
+	items := args[0].(*ListValue).Items()
+	err := sortItems(items, func(a, b Value) (bool, error) {
+		return vm.less("sort", a, b)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return NewList(items), nil
+}
+
+func listSortBy(vm *VM, args []Value) (Value, error) {
+	items := args[0].(*ListValue).Items()
+	pairs := make([]Value, len(items))
+	// Sort pairs of [key, item] so the key function is called once per item
+	for i, item := range items {
+		key, err := vm.Call(args[1], item)
+		if err != nil {
+			return nil, err
+		}
+		pairs[i] = NewList([]Value{key, item})
+	}
+	err := sortItems(pairs, func(a, b Value) (bool, error) {
+		ka, _ := a.(*ListValue).Get(0)
+		kb, _ := b.(*ListValue).Get(0)
+		return vm.less("sort_by", ka, kb)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, pair := range pairs {
+		items[i], _ = pair.(*ListValue).Get(1)
+	}
+	return NewList(items), nil
+}
+
+func listSortWith(vm *VM, args []Value) (Value, error) {
+	items := args[0].(*ListValue).Items()
+	err := sortItems(items, func(a, b Value) (bool, error) {
+		return vm.callPredicate("sort_with", args[1], a, b)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return NewList(items), nil
+}
+
+func listReverse(vm *VM, args []Value) (Value, error) {
+	res := ListNil()
+	for _, item := range args[0].(*ListValue).Items() {
+		res = ListCons(item, res)
+	}
+	return res, nil
+}
+
+func (vm *VM) indexOf(lst *ListValue, v Value) (int, error) {
+	for i, item := range lst.Items() {
+		eq, err := vm.equal(item, v)
+		if err != nil {
+			return 0, err
+		}
+		if eq {
+			return i, nil
+		}
+	}
+	return -1, nil
+}
+
+func listContains(vm *VM, args []Value) (Value, error) {
+	idx, err := vm.indexOf(args[0].(*ListValue), args[1])
+	if err != nil {
+		return nil, err
+	}
+	return NewBool(idx >= 0), nil
+}
+
+// Returns -1 if the element is not in the list
+func listIndex(vm *VM, args []Value) (Value, error) {
+	idx, err := vm.indexOf(args[0].(*ListValue), args[1])
+	if err != nil {
+		return nil, err
+	}
+	return NewInt(idx), nil
+}
+
+func listZip(vm *VM, args []Value) (Value, error) {
+	other, err := vm.listArg("zip", args[1])
+	if err != nil {
+		return nil, err
+	}
+	as := args[0].(*ListValue).Items()
+	bs := other.Items()
+	n := len(as)
+	if len(bs) < n {
+		n = len(bs)
+	}
+	pairs := make([]Value, n)
+	for i := 0; i < n; i++ {
+		pairs[i] = NewList([]Value{as[i], bs[i]})
+	}
+	return NewList(pairs), nil
+}
+
+func listEnumerate(vm *VM, args []Value) (Value, error) {
+	items := args[0].(*ListValue).Items()
+	pairs := make([]Value, len(items))
+	for i, item := range items {
+		pairs[i] = NewList([]Value{NewInt(i), item})
+	}
+	return NewList(pairs), nil
+}
+
+func listEq(vm *VM, args []Value) (Value, error) {
+	other, ok := args[1].(*ListValue)
+	if !ok || other.Len() != args[0].(*ListValue).Len() {
+		return NewBool(false), nil
+	}
+	bs := other.Items()
+	for i, a := range args[0].(*ListValue).Items() {
+		eq, err := vm.equal(a, bs[i])
+		if err != nil {
+			return nil, err
+		}
+		if !eq {
+			return NewBool(false), nil
+		}
+	}
+	return NewBool(true), nil
+}
+
+func stringList(strs []string) *ListValue {
+	items := make([]Value, len(strs))
+	for i, s := range strs {
+		items[i] = NewString(s)
+	}
+	return NewList(items)
+}
+
+// Splits on whitespace if no separator is given
+func strSplit(vm *VM, args []Value) (Value, error) {
+	s := args[0].(*StringValue).Val
+	if len(args) == 1 {
+		return stringList(strings.Fields(s)), nil
+	}
+	sep, err := vm.stringArg("split", args[1])
+	if err != nil {
+		return nil, err
+	}
+	if s == "" {
+		return ListNil(), nil
+	}
+	return stringList(strings.Split(s, sep)), nil
+}
+
+func strJoin(vm *VM, args []Value) (Value, error) {
+	lst, err := vm.listArg("join", args[1])
+	if err != nil {
+		return nil, err
+	}
+	strs := []string{}
+	for _, item := range lst.Items() {
+		s, err := vm.stringArg("join", item)
+		if err != nil {
+			return nil, err
+		}
+		strs = append(strs, s)
+	}
+	return NewString(strings.Join(strs, args[0].(*StringValue).Val)), nil
+}
+
+func strTrim(vm *VM, args []Value) (Value, error) {
+	return NewString(strings.TrimSpace(args[0].(*StringValue).Val)), nil
+}
+
+func strReplace(vm *VM, args []Value) (Value, error) {
+	old, err := vm.stringArg("replace", args[1])
+	if err != nil {
+		return nil, err
+	}
+	new, err := vm.stringArg("replace", args[2])
+	if err != nil {
+		return nil, err
+	}
+	return NewString(strings.ReplaceAll(args[0].(*StringValue).Val, old, new)), nil
+}
+
+// Returns the index in characters of the first occurrence, or -1
+func strFind(vm *VM, args []Value) (Value, error) {
+	sub, err := vm.stringArg("find", args[1])
+	if err != nil {
+		return nil, err
+	}
+	s := args[0].(*StringValue).Val
+	idx := strings.Index(s, sub)
+	if idx < 0 {
+		return NewInt(-1), nil
+	}
+	return NewInt(len([]rune(s[:idx]))), nil
+}
+
+func strUpper(vm *VM, args []Value) (Value, error) {
+	return NewString(strings.ToUpper(args[0].(*StringValue).Val)), nil
+}
+
+func strLower(vm *VM, args []Value) (Value, error) {
+	return NewString(strings.ToLower(args[0].(*StringValue).Val)), nil
+}
+
+func strStartsWith(vm *VM, args []Value) (Value, error) {
+	prefix, err := vm.stringArg("starts_with", args[1])
+	if err != nil {
+		return nil, err
+	}
+	return NewBool(strings.HasPrefix(args[0].(*StringValue).Val, prefix)), nil
+}
+
+func strEndsWith(vm *VM, args []Value) (Value, error) {
+	suffix, err := vm.stringArg("ends_with", args[1])
+	if err != nil {
+		return nil, err
+	}
+	return NewBool(strings.HasSuffix(args[0].(*StringValue).Val, suffix)), nil
+}
+
+func strChars(vm *VM, args []Value) (Value, error) {
+	chars := []Value{}
+	for _, r := range args[0].(*StringValue).Val {
+		chars = append(chars, NewString(string(r)))
+	}
+	return NewList(chars), nil
+}
+
+func strRepeat(vm *VM, args []Value) (Value, error) {
+	n, err := vm.intArg("repeat", args[1])
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		return nil, vm.currentFrame.runtimeError("repeat expected non-negative count")
+	}
+	str := args[0].(*StringValue).Val
+	maxInt := int(^uint(0) >> 1)
+	if len(str) > 0 && n > (maxInt-1)/len(str) {
+		return nil, vm.currentFrame.runtimeError("repeat count is too large")
+	}
+	if err := vm.reserve(1 + len(str)*n); err != nil {
+		return nil, err
+	}
+	return NewString(strings.Repeat(str, n)), nil
+}
+
+func sortedKeys(m *MapValue) []string {
+	keys := make([]string, 0, len(m.Map))
+	for k := range m.Map {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Keys are returned in sorted order
+func mapKeys(vm *VM, args []Value) (Value, error) {
+	return stringList(sortedKeys(args[0].(*MapValue))), nil
+}
+
+// Values are returned in the order of their sorted keys
+func mapValues(vm *VM, args []Value) (Value, error) {
+	m := args[0].(*MapValue)
+	values := []Value{}
+	for _, k := range sortedKeys(m) {
+		values = append(values, m.Map[k])
+	}
+	return NewList(values), nil
+}
+
+func mapHas(vm *VM, args []Value) (Value, error) {
+	key, err := vm.stringArg("has", args[1])
+	if err != nil {
+		return nil, err
+	}
+	_, ok := args[0].(*MapValue).Map[key]
+	return NewBool(ok), nil
+}
+
+func mapDelete(vm *VM, args []Value) (Value, error) {
+	key, err := vm.stringArg("delete", args[1])
+	if err != nil {
+		return nil, err
+	}
+	delete(args[0].(*MapValue).Map, key)
+	return Nil, nil
+}
+
+func mapGet(vm *VM, args []Value) (Value, error) {
+	key, err := vm.stringArg("get", args[1])
+	if err != nil {
+		return nil, err
+	}
+	v, ok := args[0].(*MapValue).Map[key]
+	if !ok {
+		if len(args) < 3 {
+			return Nil, nil
+		}
+		return args[2], nil
+	}
+	return v, nil
+}
+
+func mapEq(vm *VM, args []Value) (Value, error) {
+	m := args[0].(*MapValue)
+	other, ok := args[1].(*MapValue)
+	if !ok || len(other.Map) != len(m.Map) {
+		return NewBool(false), nil
+	}
+	for k, a := range m.Map {
+		b, ok := other.Map[k]
+		if !ok {
+			return NewBool(false), nil
+		}
+		eq, err := vm.equal(a, b)
+		if err != nil {
+			return nil, err
+		}
+		if !eq {
+			return NewBool(false), nil
+		}
+	}
+	return NewBool(true), nil
+}
+
+func exnMsg(vm *VM, args []Value) (Value, error) {
+	return NewString(args[0].(*ExnValue).Msg()), nil
+}
+
+func exnTrace(vm *VM, args []Value) (Value, error) {
+	return NewString(args[0].(*ExnValue).GetStackTrace()), nil
+}
@@ -14,33 +14,36 @@ const (
 
 type FunctionMap map[string]*FunctionValue
 
+type BuiltinMap map[string]*BuiltinValue
+
+// Types are shared between vms and must not be changed after creation. Methods
+// defined in wosh are stored per vm, see VM.methods.
 type Type struct {
 	Name       string
-	Methods    FunctionMap
 	Attributes []string
-}
-
-func (t *Type) MethodNames() []string {
-	names := make([]string, 0, len(t.Methods))
-	for _, method := range t.Methods {
-		names = append(names, method.Name)
-	}
-	return names
-}
 
-var NilType = &Type{"Nil", FunctionMap{}, nil}
-var BoolType = &Type{"Bool", FunctionMap{}, nil}
-var IntType = &Type{"Int", FunctionMap{}, nil}
-var StringType = &Type{"Str", FunctionMap{}, nil}
-var ListType = &Type{"List", FunctionMap{}, nil}
-var MapType = &Type{"Map", FunctionMap{}, nil}
-var FunctionType = &Type{"Function", FunctionMap{}, nil}
-var ClosureType = &Type{"Closure", FunctionMap{}, nil}
-var ExceptionType = &Type{"Exception", FunctionMap{}, nil}
-var BoxType = &Type{"Box", FunctionMap{}, nil}
-var ContinuationType = &Type{"Continuation", FunctionMap{}, nil}
-var BuiltinType = &Type{"Builtin", FunctionMap{}, nil}
-var TypeType = &Type{"Type", FunctionMap{}, nil}
+	// Methods implemented in go. Methods defined in wosh take precedence over these
+	Builtins BuiltinMap
+
+	// Name of the type of each attribute, or "" if the attribute is untyped
+	AttributeTypes []string
+}
+
+var NilType = &Type{Name: "Nil", Builtins: BuiltinMap{}}
+var BoolType = &Type{Name: "Bool", Builtins: BuiltinMap{}}
+var IntType = &Type{Name: "Int", Builtins: BuiltinMap{}}
+var StringType = &Type{Name: "Str", Builtins: BuiltinMap{}}
+var ListType = &Type{Name: "List", Builtins: BuiltinMap{}}
+var MapType = &Type{Name: "Map", Builtins: BuiltinMap{}}
+var FunctionType = &Type{Name: "Function", Builtins: BuiltinMap{}}
+var ClosureType = &Type{Name: "Closure", Builtins: BuiltinMap{}}
+var ExceptionType = &Type{Name: "Exception", Builtins: BuiltinMap{}}
+var BoxType = &Type{Name: "Box", Builtins: BuiltinMap{}}
+var LoopMarkType = &Type{Name: "LoopMark", Builtins: BuiltinMap{}}
+var ContinuationType = &Type{Name: "Continuation", Builtins: BuiltinMap{}}
+var EffectType = &Type{Name: "Effect", Builtins: BuiltinMap{}}
+var BuiltinType = &Type{Name: "Builtin", Builtins: BuiltinMap{}}
+var TypeType = &Type{Name: "Type", Builtins: BuiltinMap{}}
 
 type Value interface {
 	Type() *Type
@@ -69,12 +72,12 @@ type FunctionValue struct {
 	Chunk *Chunk
 
 	// Slot indexes that need to be captured when creating a closure from this function
-	OuterCaptures []uint8
+	OuterCaptures []int
 
 	// The slots to put captured variables in when calling this function
-	CaptureSlots []uint8
+	CaptureSlots []int
 
-	SlotsToPutOnHeap []uint8
+	SlotsToPutOnHeap []int
 }
 
 func (t *FunctionValue) Type() *Type {
@@ -185,11 +188,6 @@ func (t *BoolValue) String() string {
 	}
 }
 
-type StackEntry struct {
-	Function string
-	Line     int
-}
-
 type ExnValue struct {
 	Val   string
 	stack []StackEntry
@@ -215,7 +213,7 @@ func (t *ExnValue) GetStackTrace() string {
 	res := ""
 	for i := len(t.stack) - 1; i >= 0; i-- {
 		e := t.stack[i]
-		res += fmt.Sprintf("  unknown:%d - %s", e.Line, e.Function)
+		res += fmt.Sprintf("  %s:%d - %s", e.FileName(), e.Line(), e.Function)
 		if i > 0 {
 			res += "\n"
 		}
@@ -239,9 +237,18 @@ type ListNode struct {
 	next *ListNode
 }
 
+// A persistent vector, see vector.go. The values of the list are the
+// headLen values linked from head, then the values of the trie from index
+// start up to index end, then tail. Keeping the head as linked nodes makes
+// `::` allocate a single node.
 type ListValue struct {
-	head *ListNode
-	len  int
+	head       *ListNode
+	headLen    int
+	root       *vecNode
+	shift      uint
+	start, end int
+	tail       []Value
+	len        int
 }
 
 func (t *ListValue) Type() *Type {
@@ -251,15 +258,11 @@ func (t *ListValue) Type() *Type {
 func (t *ListValue) String() string {
 	b := strings.Builder{}
 	b.WriteString("list(")
-	x := t.head
-	if x != nil {
-		b.WriteString(x.Val.String())
-		x = x.next
-	}
-	for x != nil {
-		b.WriteString(", ")
-		b.WriteString(x.Val.String())
-		x = x.next
+	for i, v := range t.Items() {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(v.String())
 	}
 	b.WriteString(")")
 
@@ -268,101 +271,165 @@ func (t *ListValue) String() string {
 
 // Returns (nil, false) in case of out of bounds error
 func (t *ListValue) Get(idx int) (Value, bool) {
-	if idx < 0 {
+	if idx < 0 || idx >= t.len {
 		return nil, false
 	}
-
-	cur := t.head
-	for true {
-		if cur == nil {
-			return nil, false
-		}
-
-		if idx == 0 {
-			return cur.Val, true
+	if idx < t.headLen {
+		cur := t.head
+		for ; idx > 0; idx-- {
+			cur = cur.next
 		}
-
-		cur = cur.next
-		idx--
+		return cur.Val, true
 	}
-
-	// unreachable
-	return nil, false
+	idx -= t.headLen
+	if idx < t.end-t.start {
+		return vecGet(t.root, t.shift, t.start+idx), true
+	}
+	return t.tail[idx-(t.end-t.start)], true
 }
 
-// mutates the list! only for internal usage
-func (t *ListValue) PrivPush(o Value) {
-	t.len++
-	e := &ListNode{Val: o, next: nil}
-	if t.head == nil {
-		t.head = e
-		return
+// A copy of the list with the value at idx replaced. Returns (nil, false) in
+// case of out of bounds error
+func (t *ListValue) Set(idx int, v Value) (*ListValue, bool) {
+	if idx < 0 || idx >= t.len {
+		return nil, false
 	}
-
-	cur := t.head
-	for cur.next != nil {
-		cur = cur.next
+	res := *t
+	if idx < t.headLen {
+		vals := nodeValues(t.head, idx+1)
+		vals[idx] = v
+		res.head = nodeChain(vals, nodeAt(t.head, idx+1))
+		return &res, true
 	}
-	cur.next = e
+	idx -= t.headLen
+	if idx < t.end-t.start {
+		res.root = vecStore(t.root, t.shift, t.start+idx, []Value{v})
+		return &res, true
+	}
+	res.tail = joinValues(t.tail, nil)
+	res.tail[idx-(t.end-t.start)] = v
+	return &res, true
+}
+
+// A copy of the list with vals added to the end
+func (t *ListValue) Append(vals ...Value) *ListValue {
+	res := *t
+	res.len += len(vals)
+	tail := joinValues(t.tail, vals)
+	if len(tail) <= vecWidth {
+		res.tail = tail
+		return &res
+	}
+	// Move all but the last partly filled chunk into the trie
+	keep := (len(tail)-1)%vecWidth + 1
+	res.trieAppend(tail[:len(tail)-keep])
+	res.tail = tail[len(tail)-keep:]
+	return &res
+}
+
+// A copy of the list with vals added to the start
+func (t *ListValue) Prepend(vals ...Value) *ListValue {
+	res := *t
+	res.len += len(vals)
+	if t.headLen+len(vals) <= vecWidth {
+		res.head = nodeChain(vals, t.head)
+		res.headLen += len(vals)
+		return &res
+	}
+	// Move all but the first partly filled chunk into the trie
+	head := joinValues(vals, nodeValues(t.head, t.headLen))
+	keep := (len(head)-1)%vecWidth + 1
+	res.triePrepend(head[keep:])
+	res.head = nodeChain(head[:keep], nil)
+	res.headLen = keep
+	return &res
 }
 
 func (t *ListValue) Concat(o *ListValue) *ListValue {
-	if t.head == nil {
+	if t.len == 0 {
 		return o
 	}
-
-	copyHead := &ListNode{Val: t.head.Val, next: nil}
-	copyCur := copyHead
-
-	cur := t.head
-	for cur.next != nil {
-		cur = cur.next
-		copyCur.next = &ListNode{Val: cur.Val, next: nil}
-		copyCur = copyCur.next
+	if o.len == 0 {
+		return t
 	}
-	copyCur.next = o.head
-	return &ListValue{head: copyHead, len: t.len + o.len}
+	if o.len > t.len {
+		return o.Prepend(t.Items()...)
+	}
+	return t.Append(o.Items()...)
 }
 
 func (t *ListValue) Len() int {
 	return t.len
 }
 
-func (t *ListValue) Slice(i, j, step int) *ListValue {
-	if step == 0 {
-		panic("List cannot slice on step = 0")
+// The values from index from up to index to, with negative indexes counted
+// from the end. The result shares its nodes with the list.
+func (t *ListValue) Slice(from, to int) *ListValue {
+	from, to = sliceBounds(t.len, from, to)
+	if from == 0 && to == t.len {
+		return t
 	}
-	if step != 1 {
-		// TODO
-		panic("Not yet support for different step sizes")
+	trieLen := t.end - t.start
+	// The part of from:to that falls in a part of length n starting at offset
+	part := func(n, offset int) (int, int) {
+		lo, hi := from-offset, to-offset
+		if lo < 0 {
+			lo = 0
+		}
+		if hi < 0 {
+			hi = 0
+		}
+		if lo > n {
+			lo = n
+		}
+		if hi > n {
+			hi = n
+		}
+		return lo, hi
 	}
 
-	length := t.Len()
-	idx1 := i
-	idx2 := j
-	if idx1 < 0 {
-		idx1 = length + idx1
+	res := &ListValue{root: t.root, shift: t.shift, len: to - from}
+	lo, hi := part(t.headLen, 0)
+	if hi == t.headLen {
+		res.head = nodeAt(t.head, lo)
+	} else {
+		res.head = nodeChain(nodeValues(t.head, hi)[lo:], nil)
 	}
-	if idx2 < 0 {
-		idx2 = t.Len() + idx2
+	res.headLen = hi - lo
+	lo, hi = part(trieLen, t.headLen)
+	res.start, res.end = t.start+lo, t.start+hi
+	lo, hi = part(len(t.tail), t.headLen+trieLen)
+	res.tail = t.tail[lo:hi]
+	if res.start == res.end {
+		res.root, res.shift = nil, 0
 	}
-	if idx2 <= idx1 || idx1 >= length || idx2 <= 0 {
-		return ListNil()
+	return res
+}
+
+// The node n steps after node
+func nodeAt(node *ListNode, n int) *ListNode {
+	for ; n > 0; n-- {
+		node = node.next
 	}
+	return node
+}
 
-	cnt := 0
-	cur := t.head
-	for cnt < idx1 && cur != nil {
-		cur = cur.next
-		cnt++
+// The values of the first n nodes starting at node
+func nodeValues(node *ListNode, n int) []Value {
+	vals := make([]Value, n)
+	for i := range vals {
+		vals[i] = node.Val
+		node = node.next
 	}
-	list := ListNil()
-	for cnt < idx2 && cur != nil {
-		list.PrivPush(cur.Val)
-		cur = cur.next
-		cnt++
+	return vals
+}
+
+// New nodes with vals, linked to rest
+func nodeChain(vals []Value, rest *ListNode) *ListNode {
+	for i := len(vals) - 1; i >= 0; i-- {
+		rest = &ListNode{Val: vals[i], next: rest}
 	}
-	return list
+	return rest
 }
 
 func NewInt(n int) *IntValue {
@@ -379,18 +446,32 @@ func NewString(s string) *StringValue {
 
 var Nil = &NilValue{}
 
-func NewExn(s string, cause string, line int) *ExnValue {
-	entry := StackEntry{cause, line}
-	return &ExnValue{Val: s, stack: []StackEntry{entry}}
+func NewExn(s string, stack []StackEntry) *ExnValue {
+	return &ExnValue{Val: s, stack: stack}
 }
 
 func ListCons(val Value, tail *ListValue) *ListValue {
-	node := ListNode{Val: val, next: tail.head}
-	return &ListValue{head: &node, len: tail.len + 1}
+	return tail.Prepend(val)
 }
 
 func ListNil() *ListValue {
-	return &ListValue{head: nil, len: 0}
+	return &ListValue{}
+}
+
+func NewList(items []Value) *ListValue {
+	return ListNil().Append(items...)
+}
+
+// Returns the elements of the list as a slice
+func (t *ListValue) Items() []Value {
+	items := make([]Value, 0, t.len)
+	for cur := t.head; cur != nil && len(items) < t.headLen; cur = cur.next {
+		items = append(items, cur.Val)
+	}
+	if t.start < t.end {
+		items = vecCollect(items, t.root, t.shift, t.start, t.end)
+	}
+	return append(items, t.tail...)
 }
 
 var NoExnVal = &ExnValue{}
@@ -403,12 +484,12 @@ func GetString(v Value) (string, error) {
 	return s.Val, nil
 }
 
-func GetBool(v Value) bool {
+func GetBool(v Value) (bool, error) {
 	n, ok := v.(*BoolValue)
 	if !ok {
-		panic(fmt.Sprintf("Trying to use value of type '%s' as bool", v.Type().Name))
+		return false, fmt.Errorf("Trying to use value of type '%s' as bool", v.Type().Name)
 	}
-	return n.Val
+	return n.Val, nil
 }
 
 type MapValue struct {
@@ -474,26 +555,92 @@ func (t *BoxValue) Set(v Value) {
 	t.Val = v
 }
 
+// The state of a frame when a loop started, which is restored when the loop is
+// exited by break or continue. Kept in a hidden local of the function.
+type LoopMarkValue struct {
+	stackTop int
+	handlers int
+}
+
+func (t *LoopMarkValue) Type() *Type {
+	return LoopMarkType
+}
+
+func (t *LoopMarkValue) String() string {
+	return fmt.Sprintf("LoopMark[%d, %d]", t.stackTop, t.handlers)
+}
+
+// Declaration of an effect. Types are "" when there is no annotation, and
+// ParamTypes is nil when type checks are disabled.
+type EffectValue struct {
+	Name       string
+	Params     []string
+	ParamTypes []string
+	ReturnType string
+}
+
+func (t *EffectValue) Type() *Type {
+	return EffectType
+}
+
+func (t *EffectValue) String() string {
+	return fmt.Sprintf("Effect(%s)", t.Name)
+}
+
 type ContinuationValue struct {
-	Frame *CallFrame
+	Frame   *CallFrame // nil for the continuation of a raised exception
+	ip      int        // where to resume in the frame
+	handler Handler    // the handler that received the continuation
+
+	// State of the frames when the effect was performed, which is restored
+	// when resuming. Nil for exceptions.
+	saved *savedFrames
+
+	oneShot bool // the frames include a call from go code and can't be copied
+	resumed bool
 }
 
 func (t *ContinuationValue) Type() *Type {
 	return ContinuationType
 }
 
-func NewContinuation(frame *CallFrame) *ContinuationValue {
-	return &ContinuationValue{frame}
+// Capture the continuation of frame up to the frame of handler. It can be
+// resumed several times, unless the frames include a call from go code
+// which can't be copied. Then it can only be resumed once.
+func NewContinuation(frame *CallFrame, handler Handler) *ContinuationValue {
+	if frame == nil {
+		return &ContinuationValue{handler: handler}
+	}
+	k := &ContinuationValue{Frame: frame, ip: frame.ip, handler: handler}
+	for f := frame; f != handler.frame; f = f.returnFrame {
+		if f.hostCall {
+			k.oneShot = true
+		}
+	}
+	k.saved = saveFrames(frame, handler.frame, !k.oneShot)
+	return k
+}
+
+// Can only be resumed once
+func (t *ContinuationValue) OneShot() bool {
+	return t.oneShot
 }
 
 func (t *ContinuationValue) String() string {
 	return fmt.Sprintf("Continuation[]")
 }
 
+// Signature of builtin functions. Returned errors become runtime errors
+type NativeFunction func(vm *VM, args []Value) (Value, error)
+
+// MaxArity of builtins that take any number of arguments
+const VARIADIC = -1
+
 type BuiltinValue struct {
-	Name  string
-	Arity int
-	Func  interface{} // should be a function taking arity number of Value and returning Value
+	Name     string
+	Arity    int // minimum number of arguments
+	MaxArity int // maximum number of arguments or VARIADIC
+	Func     NativeFunction
 }
 
 func (t *BuiltinValue) Type() *Type {
@@ -504,8 +651,21 @@ func (t *BuiltinValue) String() string {
 	return fmt.Sprintf("%s(%s, %d)", t.Type().Name, t.Name, t.Arity)
 }
 
-func NewBuiltin(name string, arity int, function interface{}) *BuiltinValue {
-	return &BuiltinValue{name, arity, function}
+func NewBuiltin(name string, arity int, function NativeFunction) *BuiltinValue {
+	return &BuiltinValue{name, arity, arity, function}
+}
+
+func NewVariadicBuiltin(name string, minArity int, maxArity int, function NativeFunction) *BuiltinValue {
+	return &BuiltinValue{name, minArity, maxArity, function}
+}
+
+func (t *BuiltinValue) arityText() string {
+	if t.MaxArity == VARIADIC {
+		return fmt.Sprintf("at least %d", t.Arity)
+	} else if t.MaxArity != t.Arity {
+		return fmt.Sprintf("%d to %d", t.Arity, t.MaxArity)
+	}
+	return fmt.Sprintf("%d", t.Arity)
 }
 
 type CustomValue struct {
@@ -0,0 +1,121 @@
+package interpret
+
+// Lists are persistent vectors: a 32-ary trie of values with a small buffer
+// of values in front of it and one after it. Indexing, updating and slicing
+// walk at most one path of the trie, and pushing to either end only copies a
+// buffer until it is full and gets moved into the trie.
+
+const (
+	vecBits  = 5
+	vecWidth = 1 << vecBits
+	vecMask  = vecWidth - 1
+)
+
+// A trie node. Inner nodes have children and leaves have values, both of
+// length vecWidth. Nodes are never changed once they are part of a list.
+type vecNode struct {
+	children []*vecNode
+	values   []Value
+}
+
+// The number of indexes a trie with the given root shift can hold
+func vecCapacity(shift uint) int {
+	return 1 << (shift + vecBits)
+}
+
+func vecGet(node *vecNode, shift uint, idx int) Value {
+	for ; shift > 0; shift -= vecBits {
+		node = node.children[(idx>>shift)&vecMask]
+	}
+	return node.values[idx&vecMask]
+}
+
+// A copy of node with vals stored from index idx on. Only the nodes on the
+// paths to the changed indexes are copied, the rest are shared with node.
+func vecStore(node *vecNode, shift uint, idx int, vals []Value) *vecNode {
+	n := &vecNode{}
+	if shift == 0 {
+		n.values = make([]Value, vecWidth)
+		if node != nil {
+			copy(n.values, node.values)
+		}
+		copy(n.values[idx&vecMask:], vals)
+		return n
+	}
+
+	n.children = make([]*vecNode, vecWidth)
+	if node != nil {
+		copy(n.children, node.children)
+	}
+	span := 1 << shift
+	for len(vals) > 0 {
+		slot := (idx >> shift) & vecMask
+		k := span - idx&(span-1)
+		if k > len(vals) {
+			k = len(vals)
+		}
+		n.children[slot] = vecStore(n.children[slot], shift-vecBits, idx, vals[:k])
+		idx += k
+		vals = vals[k:]
+	}
+	return n
+}
+
+// Append the values from index from up to index to of the trie to items
+func vecCollect(items []Value, node *vecNode, shift uint, from, to int) []Value {
+	if shift == 0 {
+		return append(items, node.values[from&vecMask:(to-1)&vecMask+1]...)
+	}
+	span := 1 << shift
+	for from < to {
+		end := from - from&(span-1) + span
+		if end > to {
+			end = to
+		}
+		items = vecCollect(items, node.children[(from>>shift)&vecMask], shift-vecBits, from, end)
+		from = end
+	}
+	return items
+}
+
+// A new slice with the values of a followed by the values of b. Buffers can
+// be shared between lists so they are never appended to in place.
+func joinValues(a, b []Value) []Value {
+	res := make([]Value, len(a)+len(b))
+	copy(res, a)
+	copy(res[len(a):], b)
+	return res
+}
+
+// Store vals after the last value of the trie, growing it to the right
+func (t *ListValue) trieAppend(vals []Value) {
+	if t.start == t.end {
+		t.root, t.shift, t.start, t.end = nil, 0, 0, 0
+	}
+	for t.end+len(vals) > vecCapacity(t.shift) {
+		root := &vecNode{children: make([]*vecNode, vecWidth)}
+		root.children[0] = t.root
+		t.root = root
+		t.shift += vecBits
+	}
+	t.root = vecStore(t.root, t.shift, t.end, vals)
+	t.end += len(vals)
+}
+
+// Store vals before the first value of the trie, growing it to the left
+func (t *ListValue) triePrepend(vals []Value) {
+	if t.start == t.end {
+		t.root, t.shift, t.start, t.end = nil, 0, vecWidth, vecWidth
+	}
+	for t.start < len(vals) {
+		offset := vecMask * vecCapacity(t.shift)
+		root := &vecNode{children: make([]*vecNode, vecWidth)}
+		root.children[vecMask] = t.root
+		t.root = root
+		t.shift += vecBits
+		t.start += offset
+		t.end += offset
+	}
+	t.start -= len(vals)
+	t.root = vecStore(t.root, t.shift, t.start, vals)
+}
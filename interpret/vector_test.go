@@ -0,0 +1,266 @@
+package interpret
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func assertListItems(t *testing.T, lst *ListValue, expected []Value) {
+	t.Helper()
+	if lst.Len() != len(expected) {
+		t.Fatalf("Expected length %d, got %d", len(expected), lst.Len())
+	}
+	for i, v := range expected {
+		got, ok := lst.Get(i)
+		if !ok || got != v {
+			t.Fatalf("Expected %v at index %d, got %v", v, i, got)
+		}
+	}
+	items := lst.Items()
+	for i, v := range expected {
+		if items[i] != v {
+			t.Fatalf("Expected %v at index %d of items, got %v", v, i, items[i])
+		}
+	}
+	if _, ok := lst.Get(len(expected)); ok {
+		t.Fatalf("Expected index %d to be out of bounds", len(expected))
+	}
+}
+
+func TestListOperations(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	lst := ListNil()
+	var expected []Value
+	// Keep old versions around to check that they don't change
+	var versions []*ListValue
+	var versionItems [][]Value
+
+	for i := 0; i < 5000; i++ {
+		v := NewInt(i)
+		switch op := rnd.Intn(10); {
+		case op < 3:
+			lst = lst.Append(v)
+			expected = append(append([]Value{}, expected...), v)
+		case op < 6:
+			lst = ListCons(v, lst)
+			expected = append([]Value{v}, expected...)
+		case op < 7 && len(expected) > 0:
+			idx := rnd.Intn(len(expected))
+			lst, _ = lst.Set(idx, v)
+			expected = append([]Value{}, expected...)
+			expected[idx] = v
+		case op < 8:
+			from := rnd.Intn(len(expected)/8 + 1)
+			to := len(expected) - rnd.Intn(len(expected)/8+1)
+			lst = lst.Slice(from, to)
+			expected = expected[from:to]
+		case op < 9:
+			n := rnd.Intn(70)
+			vals := make([]Value, n)
+			for j := range vals {
+				vals[j] = NewInt(-j)
+			}
+			lst = NewList(vals).Concat(lst)
+			expected = append(vals, expected...)
+		default:
+			n := rnd.Intn(70)
+			vals := make([]Value, n)
+			for j := range vals {
+				vals[j] = NewInt(-j)
+			}
+			lst = lst.Concat(NewList(vals))
+			expected = append(append([]Value{}, expected...), vals...)
+		}
+		assertListItems(t, lst, expected)
+		if i%100 == 0 {
+			versions = append(versions, lst)
+			versionItems = append(versionItems, expected)
+		}
+	}
+	for i, lst := range versions {
+		assertListItems(t, lst, versionItems[i])
+	}
+}
+
+func TestListLarge(t *testing.T) {
+	assertRes(t, "lst = []\nfor i in 0..<2000 { lst = i :: lst }\nlst[1500] + lst[-1]", NewInt(499))
+	assertRes(t, "lst = (0..<2000).list()\nlen(lst[100:1900][10:-10])", NewInt(1780))
+	assertRes(t, "lst = (0..<2000).list()\nlst[100:1900][10:-10][0]", NewInt(110))
+	assertRes(t, "(0..<1000).list() + (1000..<3000).list() == (0..<3000).list()", NewBool(true))
+	assertRes(t, "[a, b, c] = (0..<100).list()[40:43]\na + b + c", NewInt(123))
+	assertRes(t, "str((0..<100).list()[30:35])", NewString("list(30, 31, 32, 33, 34)"))
+}
+
+// The list implementation that was used before lists became persistent
+// vectors, kept for comparison in the benchmarks
+type linkedNode struct {
+	Val  Value
+	next *linkedNode
+}
+
+type linkedList struct {
+	head *linkedNode
+	len  int
+}
+
+func (t *linkedList) Get(idx int) (Value, bool) {
+	cur := t.head
+	for cur != nil {
+		if idx == 0 {
+			return cur.Val, true
+		}
+		cur = cur.next
+		idx--
+	}
+	return nil, false
+}
+
+func (t *linkedList) Concat(o *linkedList) *linkedList {
+	if t.head == nil {
+		return o
+	}
+	copyHead := &linkedNode{Val: t.head.Val}
+	copyCur := copyHead
+	for cur := t.head.next; cur != nil; cur = cur.next {
+		copyCur.next = &linkedNode{Val: cur.Val}
+		copyCur = copyCur.next
+	}
+	copyCur.next = o.head
+	return &linkedList{head: copyHead, len: t.len + o.len}
+}
+
+func (t *linkedList) Slice(from, to int) *linkedList {
+	from, to = sliceBounds(t.len, from, to)
+	cur := t.head
+	for i := 0; i < from; i++ {
+		cur = cur.next
+	}
+	var items []Value
+	for i := from; i < to; i++ {
+		items = append(items, cur.Val)
+		cur = cur.next
+	}
+	return newLinkedList(items)
+}
+
+func linkedCons(val Value, tail *linkedList) *linkedList {
+	return &linkedList{head: &linkedNode{Val: val, next: tail.head}, len: tail.len + 1}
+}
+
+func newLinkedList(items []Value) *linkedList {
+	list := &linkedList{}
+	for i := len(items) - 1; i >= 0; i-- {
+		list = linkedCons(items[i], list)
+	}
+	return list
+}
+
+func benchItems(n int) []Value {
+	items := make([]Value, n)
+	for i := range items {
+		items[i] = NewInt(i)
+	}
+	return items
+}
+
+var benchSizes = []int{10, 1000, 100000}
+
+func BenchmarkListGet(b *testing.B) {
+	for _, n := range benchSizes {
+		items := benchItems(n)
+		b.Run(fmt.Sprintf("vector/%d", n), func(b *testing.B) {
+			lst := NewList(items)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				lst.Get(i % n)
+			}
+		})
+		b.Run(fmt.Sprintf("linked/%d", n), func(b *testing.B) {
+			lst := newLinkedList(items)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				lst.Get(i % n)
+			}
+		})
+	}
+}
+
+func BenchmarkListCons(b *testing.B) {
+	b.Run("vector", func(b *testing.B) {
+		lst := ListNil()
+		for i := 0; i < b.N; i++ {
+			lst = ListCons(Nil, lst)
+		}
+	})
+	b.Run("linked", func(b *testing.B) {
+		lst := &linkedList{}
+		for i := 0; i < b.N; i++ {
+			lst = linkedCons(Nil, lst)
+		}
+	})
+}
+
+// Appending one value at a time, like `lst = lst + [x]`
+func BenchmarkListAppend(b *testing.B) {
+	for _, n := range benchSizes {
+		items := benchItems(n)
+		b.Run(fmt.Sprintf("vector/%d", n), func(b *testing.B) {
+			lst, one := NewList(items), NewList([]Value{Nil})
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				lst.Concat(one)
+			}
+		})
+		b.Run(fmt.Sprintf("linked/%d", n), func(b *testing.B) {
+			lst, one := newLinkedList(items), newLinkedList([]Value{Nil})
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				lst.Concat(one)
+			}
+		})
+	}
+}
+
+func BenchmarkListSlice(b *testing.B) {
+	for _, n := range benchSizes {
+		items := benchItems(n)
+		b.Run(fmt.Sprintf("vector/%d", n), func(b *testing.B) {
+			lst := NewList(items)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				lst.Slice(1, -1)
+			}
+		})
+		b.Run(fmt.Sprintf("linked/%d", n), func(b *testing.B) {
+			lst := newLinkedList(items)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				lst.Slice(1, -1)
+			}
+		})
+	}
+}
+
+// Summing a list by index, which made loops over lists quadratic
+func BenchmarkListIndexLoop(b *testing.B) {
+	items := benchItems(1000)
+	b.Run("vector", func(b *testing.B) {
+		lst := NewList(items)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for j := 0; j < lst.Len(); j++ {
+				lst.Get(j)
+			}
+		}
+	})
+	b.Run("linked", func(b *testing.B) {
+		lst := newLinkedList(items)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for j := 0; j < lst.len; j++ {
+				lst.Get(j)
+			}
+		}
+	})
+}
@@ -43,11 +43,16 @@ const (
 	FOR
 	TRY
 	HANDLE
+	FINALLY
 	DO
 	RESUME
 	RETURN
 	IMPORT
 	TYPE
+	EFFECT
+	IN
+	BREAK
+	CONTINUE
 )
 
 var tokens = []string{
@@ -85,11 +90,16 @@ var tokens = []string{
 	FOR:          "FOR",
 	TRY:          "TRY",
 	HANDLE:       "HANDLE",
+	FINALLY:      "FINALLY",
 	DO:           "DO",
 	RESUME:       "RESUME",
 	RETURN:       "RETURN",
 	IMPORT:       "IMPORT",
 	TYPE:         "TYPE",
+	EFFECT:       "EFFECT",
+	IN:           "IN",
+	BREAK:        "BREAK",
+	CONTINUE:     "CONTINUE",
 }
 
 func (t Token) String() string {
@@ -219,10 +229,15 @@ func (l *Lexer) LexTokenItem() TokenItem {
 			return TokenItem{EOF, "", l.pos.Extend(0)}
 		}
 
+		if r3 := l.peekn(3); r3 == "..<" {
+			l.popn(3)
+			return TokenItem{OP, r3, l.step(3)}
+		}
+
 		// two letter lookahead
 		r2 := l.peekn(2)
 		switch r2 {
-		case "==", "!=", ">=", "<=", "&&", "||", "::":
+		case "==", "!=", ">=", "<=", "&&", "||", "::", "..":
 			l.popn(2)
 			return TokenItem{OP, r2, l.step(2)}
 		case "1|", "2|", "*|":
@@ -397,6 +412,8 @@ func (l *Lexer) lexIdentOrKw() TokenItem {
 		return TokenItem{TRY, lit, l.step(len(lit))}
 	case "handle":
 		return TokenItem{HANDLE, lit, l.step(len(lit))}
+	case "finally":
+		return TokenItem{FINALLY, lit, l.step(len(lit))}
 	case "do":
 		return TokenItem{DO, lit, l.step(len(lit))}
 	case "resume":
@@ -407,6 +424,14 @@ func (l *Lexer) lexIdentOrKw() TokenItem {
 		return TokenItem{IMPORT, lit, l.step(len(lit))}
 	case "type":
 		return TokenItem{TYPE, lit, l.step(len(lit))}
+	case "effect":
+		return TokenItem{EFFECT, lit, l.step(len(lit))}
+	case "in":
+		return TokenItem{IN, lit, l.step(len(lit))}
+	case "break":
+		return TokenItem{BREAK, lit, l.step(len(lit))}
+	case "continue":
+		return TokenItem{CONTINUE, lit, l.step(len(lit))}
 	default:
 		return TokenItem{IDENT, lit, l.step(len(lit))}
 	}
@@ -29,6 +29,8 @@ func TestSimpleLex(t *testing.T) {
 		{"\n", EOL},
 		{"=", ASSIGN},
 		{"!=", OP},
+		{"..", OP},
+		{"..<", OP},
 		{"|", PIPE_OP},
 		{"1|", PIPE_OP},
 		{"2|", PIPE_OP},
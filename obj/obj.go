@@ -294,6 +294,15 @@ func (t *ListObject) Concat(o *ListObject) *ListObject {
 	return &ListObject{head: copyHead, len: t.len + o.len}
 }
 
+// The elements of the list in order
+func (t *ListObject) Items() []Object {
+	items := make([]Object, 0, t.len)
+	for cur := t.head; cur != nil; cur = cur.next {
+		items = append(items, cur.Val)
+	}
+	return items
+}
+
 func (t *ListObject) Len() int {
 	return t.len
 }
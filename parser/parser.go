@@ -18,6 +18,8 @@ import (
 // Expr ->
 //   | ReturnStatement
 //	 | ResumeStatement
+//   | BreakStatement
+//   | ContinueStatement
 //   | AssignExpr
 //
 // AssignExpr ->
@@ -48,7 +50,12 @@ import (
 //   | ComparisonExpr
 //
 // ComparisonExpr ->
-//   | ConsExpr (<comp_op> ConsExpr)*
+//   | RangeExpr (<comp_op> RangeExpr)*
+//   | RangeExpr ("in" RangeExpr)*
+//
+// RangeExpr ->
+//   | ConsExpr (".." | "..<") ConsExpr
+//   | ConsExpr
 //
 // ConsExpr ->
 //   | AddExpr (<cons_op> AddExpr)*
@@ -221,6 +228,15 @@ func (p *Parser) parseFullExpr() (ast.Expr, bool) {
 		return res, true
 	}
 
+	brk, ok := p.parseBreakStatement()
+	if ok {
+		return brk, true
+	}
+
+	if cont, ok := p.tokens.expectGet(lexer.CONTINUE); ok {
+		return &ast.ContinueExpr{cont.Area}, true
+	}
+
 	return p.parseExpr()
 }
 
@@ -240,6 +256,18 @@ func (p *Parser) parseReturnStatement() (ast.Expr, bool) {
 	return &ast.ReturnExpr{nil, ret.Area}, true
 }
 
+func (p *Parser) parseBreakStatement() (ast.Expr, bool) {
+	brk, ok := p.tokens.expectGet(lexer.BREAK)
+	if !ok {
+		return nil, false
+	}
+	exp, ok := p.parseExpr()
+	if ok {
+		return &ast.BreakExpr{exp, brk.Area.To(exp.GetArea())}, true
+	}
+	return &ast.BreakExpr{nil, brk.Area}, true
+}
+
 func (p *Parser) parseResumeStatement() (ast.Expr, bool) {
 	res, ok := p.tokens.expectGet(lexer.RESUME)
 	if !ok {
@@ -395,9 +423,17 @@ func (p *Parser) parseAndExpr() (ast.Expr, bool) {
 
 // CompExpr ->
 //
-//	| ConsExpr (<comp-op> ConsExpr)*
+//	| RangeExpr (<comp-op> RangeExpr)*
 func (p *Parser) parseCompExpr() (ast.Expr, bool) {
-	return p.parseBinaryOpExpr([]string{"==", "!=", ">=", "<=", ">", "<"}, p.parseConsExpr)
+	return p.parseBinaryOpExpr([]string{"==", "!=", ">=", "<=", ">", "<", "in"}, p.parseRangeExpr)
+}
+
+// RangeExpr ->
+//
+//	| ConsExpr (".." | "..<") ConsExpr
+//	| ConsExpr
+func (p *Parser) parseRangeExpr() (ast.Expr, bool) {
+	return p.parseBinaryOpExpr([]string{"..", "..<"}, p.parseConsExpr)
 }
 
 // ConsExpr ->
@@ -626,6 +662,7 @@ func (p *Parser) parseSubscrHelper() ([]ast.Expr, lexer.Area, bool) {
 //
 //	| IfExpr
 //	| ForExpr
+//	| ForInExpr
 //	| FnDefExpr
 //	| TypeExpr
 //	| BasicLit
@@ -657,6 +694,10 @@ func (p *Parser) parseAtomExpr() (ast.Expr, bool) {
 	if ok {
 		return typ, true
 	}
+	effect, ok := p.parseEffectDefExpr()
+	if ok {
+		return effect, true
+	}
 	//matchExpr, ok := p.parseMatchExpr()
 	//if ok {
 	//	return matchExpr, true
@@ -824,6 +865,21 @@ func (p *Parser) parseForExpr() (ast.Expr, bool) {
 
 	// ignore EOL
 	p.tokens.beginEolSignificance(false)
+
+	forIn, ok := p.parseForInHead()
+	if ok {
+		then, ok := p.parseBracedBlock("for")
+		if !ok {
+			p.tokens.popEolSignificance()
+			p.tokens.rollback()
+			return nil, false
+		}
+		p.tokens.popEolSignificance()
+		forIn.Then = then
+		forIn.Area = p.tokens.commit()
+		return forIn, true
+	}
+
 	cond, ok := p.parseMultiExpr()
 	if !ok {
 		// TODO
@@ -842,6 +898,32 @@ func (p *Parser) parseForExpr() (ast.Expr, bool) {
 	return &ast.ForExpr{cond, then, a}, true
 }
 
+// The `x in expr` part of a for loop over an iterable. The loop variable can
+// be a list of identifiers to destructure the values into, like `[k, v] in m`
+func (p *Parser) parseForInHead() (*ast.ForInExpr, bool) {
+	p.tokens.begin()
+
+	var pattern ast.Expr
+	pattern, ok := p.parseIdent()
+	if !ok {
+		pattern, ok = p.parseBracketExpr()
+	}
+	if !ok || !p.tokens.expect(lexer.IN) {
+		p.tokens.rollback()
+		return nil, false
+	}
+
+	iterable, ok := p.parseMultiExpr()
+	if !ok {
+		p.error("Expected an expression to iterate over after 'in'", p.tokens.peek().Area)
+		p.tokens.rollback()
+		return nil, false
+	}
+
+	p.tokens.commit()
+	return &ast.ForInExpr{Var: pattern, Iterable: iterable}, true
+}
+
 /*
 func (p *Parser) parseMatchExpr() (ast.Expr, bool) {
 	p.tokens.begin()
@@ -894,16 +976,29 @@ func (p *Parser) parseTryExpr() (ast.Expr, bool) {
 		return nil, false
 	}
 
-	ok = p.tokens.expect(lexer.HANDLE)
-	if !ok {
-		p.error(fmt.Sprintf("Expected 'handle' after 'try', found %s", p.tokens.peek().Lit), p.tokens.peek().Area)
-		p.tokens.popEolSignificance()
-		p.tokens.rollback()
-		return nil, false
+	matchCases := []*ast.HandleCaseExpr{}
+	var returnCase *ast.HandleCaseExpr = nil
+	if p.tokens.expect(lexer.HANDLE) {
+		matchCases, returnCase, ok = p.parseHandleBlock()
+		if !ok {
+			p.tokens.popEolSignificance()
+			p.tokens.rollback()
+			return nil, false
+		}
 	}
 
-	matchCases, ok := p.parseHandleBlock()
-	if !ok {
+	var finally *ast.BlockExpr = nil
+	if p.tokens.expect(lexer.FINALLY) {
+		finally, ok = p.parseBracedBlock("finally")
+		if !ok {
+			p.tokens.popEolSignificance()
+			p.tokens.rollback()
+			return nil, false
+		}
+	}
+
+	if len(matchCases) == 0 && returnCase == nil && finally == nil {
+		p.error(fmt.Sprintf("Expected 'handle' or 'finally' after 'try', found %s", p.tokens.peek().Lit), p.tokens.peek().Area)
 		p.tokens.popEolSignificance()
 		p.tokens.rollback()
 		return nil, false
@@ -911,33 +1006,105 @@ func (p *Parser) parseTryExpr() (ast.Expr, bool) {
 
 	p.tokens.popEolSignificance()
 	a := p.tokens.commit()
-	return &ast.TryExpr{then, matchCases, a}, true
+	return &ast.TryExpr{then, matchCases, returnCase, finally, a}, true
 }
 
-func (p *Parser) parseHandleBlock() ([]*ast.HandleCaseExpr, bool) {
+// Parse the handler cases and the optional return clause of a handle block
+func (p *Parser) parseHandleBlock() ([]*ast.HandleCaseExpr, *ast.HandleCaseExpr, bool) {
 	p.tokens.begin()
 
 	ok := p.tokens.expect(lexer.LBRACE)
 	if !ok {
 		p.error("Expected \"{\"", p.tokens.peek().Area)
 		p.tokens.rollback()
-		return nil, false
+		return nil, nil, false
 	}
 
 	handleCases := []*ast.HandleCaseExpr{}
+	var returnCase *ast.HandleCaseExpr = nil
 
 	for !p.tokens.expect(lexer.RBRACE) {
+		if p.tokens.peekToken() == lexer.RETURN {
+			if returnCase != nil {
+				p.error("Only one return clause is allowed in a handle block", p.tokens.peek().Area)
+				p.tokens.rollback()
+				return nil, nil, false
+			}
+			returnCase, ok = p.parseReturnCase()
+			if !ok {
+				p.tokens.rollback()
+				return nil, nil, false
+			}
+			continue
+		}
 		matchCase, ok := p.parseHandleCase()
 		if !ok {
 			p.error("Expected '}'", p.tokens.peek().Area)
 			p.tokens.rollback()
-			return nil, false
+			return nil, nil, false
 		}
 		handleCases = append(handleCases, matchCase)
 	}
 
 	p.tokens.commit()
-	return handleCases, true
+	return handleCases, returnCase, true
+}
+
+// parse "return(x) -> expr"
+func (p *Parser) parseReturnCase() (*ast.HandleCaseExpr, bool) {
+	p.tokens.begin()
+	startIdx := p.tokens.idx
+
+	ret, ok := p.tokens.expectGet(lexer.RETURN)
+	if !ok {
+		p.tokens.rollback()
+		return nil, false
+	}
+
+	if !p.tokens.expect(lexer.LPAREN) {
+		p.error(fmt.Sprintf("Expected '(', found %s", p.tokens.peek().Lit), p.tokens.peek().Area)
+		p.tokens.rollback()
+		return nil, false
+	}
+
+	param, ok := p.parseParam(false)
+	if !ok {
+		p.error(fmt.Sprintf("Expected parameter of return clause, found %s", p.tokens.peek().Lit), p.tokens.peek().Area)
+		p.tokens.rollback()
+		return nil, false
+	}
+
+	if !p.tokens.expect(lexer.RPAREN) {
+		p.error(fmt.Sprintf("Expected ')', found %s", p.tokens.peek().Lit), p.tokens.peek().Area)
+		p.tokens.rollback()
+		return nil, false
+	}
+
+	patternArea := p.tokens.nonWhitespaceAreaToHere(startIdx)
+
+	if !p.tokens.expect(lexer.SINGLE_ARROW) {
+		p.error("Expected '->'", p.tokens.peek().Area)
+		p.tokens.rollback()
+		return nil, false
+	}
+
+	block, err := p.parseBracedBlockOrSingleExpr()
+	if err != nil {
+		p.codeError(err)
+		p.tokens.rollback()
+		return nil, false
+	}
+
+	a := p.tokens.commit()
+	return &ast.HandleCaseExpr{
+		Pattern: &ast.PatternExpr{
+			Ident:  &ast.Ident{Name: "return", Area: ret.Area},
+			Params: []*ast.ParamExpr{param},
+			Area:   patternArea,
+		},
+		Then: block,
+		Area: a,
+	}, true
 }
 
 /*
@@ -1094,6 +1261,43 @@ func (p *Parser) parseTypeDefExpr() (ast.Expr, bool) {
 	return &ast.TypeDefExpr{ident, paramList, a}, true
 }
 
+func (p *Parser) parseEffectDefExpr() (ast.Expr, bool) {
+	p.tokens.begin()
+
+	ok := p.tokens.expect(lexer.EFFECT)
+	if !ok {
+		p.tokens.rollback()
+		return nil, false
+	}
+
+	ident, ok := p.parseIdent()
+	if !ok {
+		p.error("Expected an effect name", p.tokens.peek().Area)
+		p.tokens.rollback()
+		return nil, false
+	}
+
+	paramList, err := p.parseParamList()
+	if err != nil {
+		p.codeError(err)
+		p.tokens.rollback()
+		return nil, false
+	}
+
+	var returnType *ast.Ident = nil
+	if arrow, ok := p.tokens.expectGet(lexer.SINGLE_ARROW); ok {
+		returnType, ok = p.parseIdent()
+		if !ok {
+			p.error("Expected a return type after '->'", arrow.Area)
+			p.tokens.rollback()
+			return nil, false
+		}
+	}
+
+	a := p.tokens.commit()
+	return &ast.EffectDefExpr{ident, paramList, returnType, a}, true
+}
+
 func (p *Parser) parseFnDefExpr() (ast.Expr, bool) {
 	p.tokens.begin()
 
@@ -1145,6 +1349,16 @@ func (p *Parser) parseFnDefExpr() (ast.Expr, bool) {
 		return nil, false
 	}
 
+	var returnType *ast.Ident = nil
+	if arrow, ok := p.tokens.expectGet(lexer.SINGLE_ARROW); ok {
+		returnType, ok = p.parseIdent()
+		if !ok {
+			p.error("Expected a return type after '->'", arrow.Area)
+			p.tokens.rollback()
+			return nil, false
+		}
+	}
+
 	body, ok := p.parseBracedBlock("function")
 	if !ok {
 		p.tokens.rollback()
@@ -1152,7 +1366,7 @@ func (p *Parser) parseFnDefExpr() (ast.Expr, bool) {
 	}
 
 	a := p.tokens.commit()
-	return &ast.FuncDefExpr{ident, classParam, paramList, body, a}, true
+	return &ast.FuncDefExpr{ident, classParam, paramList, returnType, body, a}, true
 }
 
 func (p *Parser) parseParamList() ([]*ast.ParamExpr, *ast.CodeError) {
@@ -1341,7 +1555,8 @@ func (p *Parser) parseBinaryOpExpr(operators []string, subParser func() (ast.Exp
 
 		}
 
-		if op.Tok == lexer.OP && litMatch {
+		// The membership operator is the keyword 'in'
+		if (op.Tok == lexer.OP || op.Tok == lexer.IN) && litMatch {
 			p.tokens.pop()
 			right, ok := subParser()
 			if ok {
@@ -1404,7 +1619,7 @@ func (p *Parser) parseBracedBlock(name string) (*ast.BlockExpr, bool) {
 
 	ok := p.tokens.expect(lexer.LBRACE)
 	if !ok {
-		p.error(fmt.Sprintf("Expected \"{\" as start of %s-block, found %s", name), p.tokens.peek().Area)
+		p.error(fmt.Sprintf("Expected \"{\" as start of %s-block, found %s", name, p.tokens.peek().Lit), p.tokens.peek().Area)
 		p.tokens.popEolSignificance()
 		p.tokens.rollback()
 		return nil, false
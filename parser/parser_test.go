@@ -328,6 +328,7 @@ func TestParseMisc(t *testing.T) {
 		"a[1] = 1",
 		"(a) => a + 1",
 		"type Foo(a: Int)",
+		"fn f(a: Int) -> Str { str(a) }",
 	}
 	for _, prog := range tests {
 		p := NewParser(prog)
@@ -337,3 +338,213 @@ func TestParseMisc(t *testing.T) {
 		}
 	}
 }
+
+func TestParseReturnType(t *testing.T) {
+	tree := parseForTest(t, "fn f(a: Int) -> Str { str(a) }")
+	fn, ok := tree.Children[0].(*ast.FuncDefExpr)
+	if !ok {
+		t.Fatalf("Expected FuncDefExpr, got %+v", tree.Children[0])
+	}
+	if fn.ReturnType == nil || fn.ReturnType.Name != "Str" {
+		t.Errorf("Expected return type Str, got %+v", fn.ReturnType)
+	}
+
+	tree = parseForTest(t, "fn f(a) { a }")
+	fn = tree.Children[0].(*ast.FuncDefExpr)
+	if fn.ReturnType != nil {
+		t.Errorf("Expected no return type, got %+v", fn.ReturnType)
+	}
+}
+
+func TestParseTryFinally(t *testing.T) {
+	tree := parseForTest(t, "try { a } handle { eff(x) -> { x } } finally { b }\nc")
+	try, ok := tree.Children[0].(*ast.TryExpr)
+	if !ok {
+		t.Fatalf("Expected TryExpr, got %+v", tree.Children[0])
+	}
+	if len(try.HandleBlock) != 1 || try.FinallyBlock == nil {
+		t.Errorf("Expected handler and finally block, got %+v", try)
+	}
+	if len(tree.Children) != 2 {
+		t.Errorf("Expected 2 expressions, got %d", len(tree.Children))
+	}
+
+	tree = parseForTest(t, "try { a } finally { b }")
+	try = tree.Children[0].(*ast.TryExpr)
+	if len(try.HandleBlock) != 0 || try.FinallyBlock == nil {
+		t.Errorf("Expected only finally block, got %+v", try)
+	}
+
+	tree = parseForTest(t, "try { a } handle { eff(x) -> { x } }\nc")
+	try = tree.Children[0].(*ast.TryExpr)
+	if try.FinallyBlock != nil || len(tree.Children) != 2 {
+		t.Errorf("Expected no finally block, got %+v", try)
+	}
+
+	if _, _, err := NewParser("try { a }").Parse(); err == nil {
+		t.Error("Expected error for try without handle or finally")
+	}
+}
+
+func TestParseReturnClause(t *testing.T) {
+	tree := parseForTest(t, "try { a } handle {\neff(x) -> { x }\nreturn(y) -> y + 1\n}")
+	try := tree.Children[0].(*ast.TryExpr)
+	if len(try.HandleBlock) != 1 || try.ReturnCase == nil {
+		t.Fatalf("Expected handler and return clause, got %+v", try)
+	}
+	if try.ReturnCase.Pattern.Params[0].Name.Name != "y" {
+		t.Errorf("Expected return clause parameter y, got %+v", try.ReturnCase.Pattern.Params[0])
+	}
+
+	tree = parseForTest(t, "try { a } handle { return(y) -> y }")
+	try = tree.Children[0].(*ast.TryExpr)
+	if len(try.HandleBlock) != 0 || try.ReturnCase == nil {
+		t.Errorf("Expected only return clause, got %+v", try)
+	}
+
+	for _, prog := range []string{
+		"try { a } handle { return(x) -> x\nreturn(y) -> y }",
+		"try { a } handle { return() -> 1 }",
+		"try { a } handle { return(x, y) -> x }",
+	} {
+		if _, _, err := NewParser(prog).Parse(); err == nil {
+			t.Errorf("Expected error parsing %s", prog)
+		}
+	}
+}
+
+func TestParseEffectDef(t *testing.T) {
+	tree := parseForTest(t, "effect log(msg: Str, level) -> Nil\nx")
+	effect, ok := tree.Children[0].(*ast.EffectDefExpr)
+	if !ok {
+		t.Fatalf("Expected EffectDefExpr, got %+v", tree.Children[0])
+	}
+	if effect.Ident.Name != "log" || len(effect.Params) != 2 || effect.Params[0].Type.Name != "Str" || effect.Params[1].Type != nil {
+		t.Errorf("Unexpected effect definition %+v", effect)
+	}
+	if effect.ReturnType == nil || effect.ReturnType.Name != "Nil" {
+		t.Errorf("Expected return type Nil, got %+v", effect.ReturnType)
+	}
+	if len(tree.Children) != 2 {
+		t.Errorf("Expected 2 expressions, got %d", len(tree.Children))
+	}
+
+	tree = parseForTest(t, "effect ask()")
+	effect = tree.Children[0].(*ast.EffectDefExpr)
+	if len(effect.Params) != 0 || effect.ReturnType != nil {
+		t.Errorf("Unexpected effect definition %+v", effect)
+	}
+
+	if _, _, err := NewParser("effect log(msg) ->").Parse(); err == nil {
+		t.Error("Expected error for missing return type")
+	}
+}
+
+func TestParseForIn(t *testing.T) {
+	tree := parseForTest(t, "for x in xs.reverse() {\n  println(x)\n}")
+	forIn, ok := tree.Children[0].(*ast.ForInExpr)
+	if !ok {
+		t.Fatalf("Expected ForInExpr, got %+v", tree.Children[0])
+	}
+	if v, ok := forIn.Var.(*ast.Ident); !ok || v.Name != "x" {
+		t.Errorf("Expected loop variable x, got %s", forIn.Var)
+	}
+	if _, ok := forIn.Iterable.(*ast.CallExpr); !ok {
+		t.Errorf("Expected call as iterable, got %+v", forIn.Iterable)
+	}
+	if body, ok := forIn.Then.(*ast.BlockExpr); !ok || len(body.Children) != 1 {
+		t.Errorf("Unexpected body %+v", forIn.Then)
+	}
+
+	// A condition starting with an identifier is still a while loop
+	tree = parseForTest(t, "for i < n { i = i + 1 }")
+	if _, ok := tree.Children[0].(*ast.ForExpr); !ok {
+		t.Errorf("Expected ForExpr, got %+v", tree.Children[0])
+	}
+
+	if _, _, err := NewParser("for x in { 1 }").Parse(); err == nil {
+		t.Error("Expected error for missing iterable")
+	}
+
+	tree = parseForTest(t, "for [k, v] in items(m) { println(k) }")
+	forIn, ok = tree.Children[0].(*ast.ForInExpr)
+	if !ok {
+		t.Fatalf("Expected ForInExpr, got %+v", tree.Children[0])
+	}
+	if pattern, ok := forIn.Var.(*ast.ListExpr); !ok || len(pattern.Elems) != 2 {
+		t.Errorf("Expected list pattern, got %s", forIn.Var)
+	}
+
+	// A list condition is still a while loop
+	tree = parseForTest(t, "for [1, 2].len() > n { n = n + 1 }")
+	if _, ok := tree.Children[0].(*ast.ForExpr); !ok {
+		t.Errorf("Expected ForExpr, got %+v", tree.Children[0])
+	}
+}
+
+func TestParseRangeAndIn(t *testing.T) {
+	tree := parseForTest(t, "x in 0..<n - 1 && ok")
+	and := tree.Children[0].(*ast.OpExpr)
+	in, ok := and.Left.(*ast.OpExpr)
+	if !ok || in.Op != "in" {
+		t.Fatalf("Expected in expression, got %+v", and.Left)
+	}
+	rng, ok := in.Right.(*ast.OpExpr)
+	if !ok || rng.Op != "..<" {
+		t.Fatalf("Expected range, got %+v", in.Right)
+	}
+	if end, ok := rng.Right.(*ast.OpExpr); !ok || end.Op != "-" {
+		t.Errorf("Expected subtraction as end of range, got %+v", rng.Right)
+	}
+
+	// The loop variable of a for loop is not a membership test
+	tree = parseForTest(t, "for x in 1..3 { x }")
+	forIn, ok := tree.Children[0].(*ast.ForInExpr)
+	if !ok {
+		t.Fatalf("Expected ForInExpr, got %+v", tree.Children[0])
+	}
+	if rng, ok := forIn.Iterable.(*ast.OpExpr); !ok || rng.Op != ".." {
+		t.Errorf("Expected range as iterable, got %+v", forIn.Iterable)
+	}
+}
+
+func TestParseBreakContinue(t *testing.T) {
+	tree := parseForTest(t, "for x in xs {\n  if x { break x * 2 }\n  continue\n}")
+	body := tree.Children[0].(*ast.ForInExpr).Then.(*ast.BlockExpr)
+	iff := body.Children[0].(*ast.IfExpr)
+	brk, ok := iff.ElifParts[0].Then.(*ast.BlockExpr).Children[0].(*ast.BreakExpr)
+	if !ok {
+		t.Fatalf("Expected BreakExpr, got %+v", iff.ElifParts[0].Then)
+	}
+	if _, ok := brk.Value.(*ast.OpExpr); !ok {
+		t.Errorf("Expected break value, got %+v", brk.Value)
+	}
+	if _, ok := body.Children[1].(*ast.ContinueExpr); !ok {
+		t.Errorf("Expected ContinueExpr, got %+v", body.Children[1])
+	}
+
+	tree = parseForTest(t, "for true { break }")
+	brk = tree.Children[0].(*ast.ForExpr).Then.(*ast.BlockExpr).Children[0].(*ast.BreakExpr)
+	if brk.Value != nil {
+		t.Errorf("Expected break without value, got %+v", brk.Value)
+	}
+}
+
+func TestParseAreas(t *testing.T) {
+	tree := parseForTest(t, "f((y) => div(y, 0))")
+	call := tree.Children[0].(*ast.CallExpr)
+	lambda := call.Args[0].(*ast.FuncDefExpr)
+	tests := []struct {
+		expr     ast.Expr
+		expected lexer.Area
+	}{
+		{call, lexer.Position{0, 0}.Extend(19)},
+		{lambda, lexer.Position{0, 2}.Extend(16)},
+		{lambda.Body.Children[0], lexer.Position{0, 9}.Extend(9)},
+	}
+	for _, test := range tests {
+		if area := test.expr.GetArea(); area != test.expected {
+			t.Errorf("Expected area %v, got %v", test.expected, area)
+		}
+	}
+}
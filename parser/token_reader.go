@@ -89,11 +89,12 @@ func (tr *TokenReader) nonWhitespaceAreaToHere(startIdx int) lexer.Area {
 	for ; s < tr.idx && tr.items[s].Tok.IsWhitespace(); s++ {
 	}
 
-	e := tr.idx
+	// The last consumed token
+	e := tr.idx - 1
 	for ; e > s && tr.items[e].Tok.IsWhitespace(); e-- {
 	}
 
-	if s < e {
+	if s <= e {
 		return tr.items[s].Area.Start.To(tr.items[e].Area.End)
 	} else {
 		// Zero non-witespace tokens
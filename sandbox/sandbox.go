@@ -0,0 +1,205 @@
+// Package sandbox describes what scripts may do outside of the interpreter,
+// like reading files or running commands.
+//
+// A nil *Policy allows everything. A policy denies everything it doesn't
+// allow, so the zero Policy gives scripts no capabilities at all.
+package sandbox
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type Policy struct {
+	Read  Paths
+	Write Paths
+
+	// Commands that may be run, by name or path
+	Commands []string
+
+	// Environment variables that may be read
+	Env []string
+
+	// Whether network access is allowed. There are no network builtins, so
+	// this is for host functions and commands. Nothing stops commands from
+	// using the network, so commands are only allowed together with it.
+	Network bool
+}
+
+// Rules for file system paths. A path is allowed if it is inside one of the
+// Allow paths and not inside one of the Deny paths.
+type Paths struct {
+	Allow []string
+	Deny  []string
+}
+
+// Returned when the policy denies an operation
+type PermissionError struct {
+	Op     string // "read", "write", "run", "getenv" or "connect"
+	Target string
+}
+
+func (e *PermissionError) Error() string {
+	return fmt.Sprintf("Permission denied: %s '%s'", e.Op, e.Target)
+}
+
+func (p *Policy) CheckRead(path string) error {
+	if p == nil || p.Read.allows(path) {
+		return nil
+	}
+	return &PermissionError{"read", path}
+}
+
+func (p *Policy) CheckWrite(path string) error {
+	if p == nil || p.Write.allows(path) {
+		return nil
+	}
+	return &PermissionError{"write", path}
+}
+
+func (p *Policy) CheckCommand(command string) error {
+	if p == nil {
+		return nil
+	}
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	if contains(p.Commands, command) {
+		return nil
+	}
+	return &PermissionError{"run", command}
+}
+
+// Returns an error if the policy allows commands but not the network, which
+// can't be enforced since commands run outside of the sandbox
+func (p *Policy) Validate() error {
+	if p != nil && len(p.Commands) > 0 && !p.Network {
+		return fmt.Errorf("Commands can't be allowed without allowing network access")
+	}
+	return nil
+}
+
+// The entries of env, in the "NAME=value" form of os.Environ, that commands
+// may see
+func (p *Policy) Environ(env []string) []string {
+	if p == nil {
+		return env
+	}
+	res := []string{}
+	for _, entry := range env {
+		name := strings.SplitN(entry, "=", 2)[0]
+		if contains(p.Env, name) {
+			res = append(res, entry)
+		}
+	}
+	return res
+}
+
+func (p *Policy) CheckEnv(name string) error {
+	if p == nil || contains(p.Env, name) {
+		return nil
+	}
+	return &PermissionError{"getenv", name}
+}
+
+func (p *Policy) CheckNetwork(address string) error {
+	if p == nil || p.Network {
+		return nil
+	}
+	return &PermissionError{"connect", address}
+}
+
+func (rules Paths) allows(path string) bool {
+	resolved, err := resolve(path, 0)
+	if err != nil {
+		return false
+	}
+	for _, deny := range rules.Deny {
+		if inside(resolved, resolveRule(deny)) {
+			return false
+		}
+	}
+	for _, allow := range rules.Allow {
+		if inside(resolved, resolveRule(allow)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Symlinks followed before a path is considered a loop
+const MAX_LINKS = 40
+
+// The absolute path with symlinks resolved, so that links can't be used to
+// get out of an allowed directory. Paths that don't exist yet are resolved
+// from their closest existing parent, and dangling links are followed to the
+// file that writing to them would create.
+func resolve(path string, links int) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if real, err := filepath.EvalSymlinks(abs); err == nil {
+		return real, nil
+	}
+	parent := filepath.Dir(abs)
+	if parent == abs {
+		return abs, nil
+	}
+	dir, err := resolve(parent, links)
+	if err != nil {
+		return "", err
+	}
+	full := filepath.Join(dir, filepath.Base(abs))
+	info, err := os.Lstat(full)
+	if os.IsNotExist(err) {
+		return full, nil
+	} else if err != nil {
+		return "", err
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		return full, nil
+	}
+	if links >= MAX_LINKS {
+		return "", fmt.Errorf("Too many levels of symbolic links: %s", path)
+	}
+	target, err := os.Readlink(full)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(dir, target)
+	}
+	return resolve(target, links+1)
+}
+
+// Rules that can't be resolved, like links in a loop, are used as given
+func resolveRule(rule string) string {
+	if resolved, err := resolve(rule, 0); err == nil {
+		return resolved
+	}
+	if abs, err := filepath.Abs(rule); err == nil {
+		return abs
+	}
+	return rule
+}
+
+// Whether path is dir or inside of dir
+func inside(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator))
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
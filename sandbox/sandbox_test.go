@@ -0,0 +1,100 @@
+package sandbox
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sandbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	repo := filepath.Join(dir, "repo")
+	if err := os.MkdirAll(filepath.Join(repo, "secret"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(dir, filepath.Join(repo, "up")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(dir, "outside", "file"), filepath.Join(repo, "dangling")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("new.txt", filepath.Join(repo, "inner")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("loop", filepath.Join(repo, "loop")); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Policy{Read: Paths{Allow: []string{repo}, Deny: []string{filepath.Join(repo, "secret")}}}
+	tests := []struct {
+		path    string
+		allowed bool
+	}{
+		{repo, true},
+		{filepath.Join(repo, "a.txt"), true},
+		{filepath.Join(repo, "new", "b.txt"), true},
+		{filepath.Join(repo, "secret"), false},
+		{filepath.Join(repo, "secret", "key"), false},
+		{filepath.Join(repo, "..", "x"), false},
+		{filepath.Join(repo, "up", "x"), false},
+		{filepath.Join(dir, "repository"), false},
+		{filepath.Join(repo, "dangling"), false},
+		{filepath.Join(repo, "inner"), true},
+		{filepath.Join(repo, "loop"), false},
+	}
+	for _, test := range tests {
+		if err := p.CheckRead(test.path); (err == nil) != test.allowed {
+			t.Errorf("Expected allowed=%v for %s, got %v", test.allowed, test.path, err)
+		}
+	}
+	if err := p.CheckWrite(filepath.Join(repo, "a.txt")); err == nil {
+		t.Error("Expected write to be denied")
+	}
+	w := &Policy{Write: Paths{Allow: []string{repo}}}
+	if err := w.CheckWrite(filepath.Join(repo, "dangling")); err == nil {
+		t.Error("Expected write through dangling link to be denied")
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	var unrestricted *Policy
+	if unrestricted.CheckRead("/etc/passwd") != nil || unrestricted.CheckCommand("rm") != nil || unrestricted.CheckNetwork("example.com:80") != nil {
+		t.Error("Expected nil policy to allow everything")
+	}
+
+	p := &Policy{Commands: []string{"git"}, Env: []string{"HOME"}, Network: true}
+	if err := p.CheckCommand("git"); err != nil {
+		t.Error(err)
+	}
+	if err := p.CheckEnv("HOME"); err != nil {
+		t.Error(err)
+	}
+	err := p.CheckCommand("rm")
+	if perr, ok := err.(*PermissionError); !ok || perr.Op != "run" || err.Error() != "Permission denied: run 'rm'" {
+		t.Errorf("Expected permission error, got %v", err)
+	}
+	if p.CheckEnv("TOKEN") == nil || p.CheckRead(".") == nil {
+		t.Error("Expected operations to be denied")
+	}
+
+	offline := &Policy{Commands: []string{"git"}}
+	if offline.Validate() == nil || offline.CheckCommand("git") == nil || offline.CheckNetwork("example.com:80") == nil {
+		t.Error("Expected commands to be denied without network access")
+	}
+	if (&Policy{}).Validate() != nil {
+		t.Error("Expected policy without commands to be valid")
+	}
+
+	env := p.Environ([]string{"HOME=/home/a", "TOKEN=secret", "HOMEDIR=x"})
+	if len(env) != 1 || env[0] != "HOME=/home/a" {
+		t.Errorf("Expected only HOME in environment, got %v", env)
+	}
+	if env := unrestricted.Environ([]string{"TOKEN=secret"}); len(env) != 1 {
+		t.Errorf("Expected nil policy to keep the environment, got %v", env)
+	}
+}
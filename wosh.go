@@ -0,0 +1,273 @@
+// Package wosh embeds the wosh interpreter in go programs.
+//
+// A typical use is letting users configure hooks in wosh:
+//
+//	w := wosh.New(wosh.Options{})
+//	w.SetGlobal("notify", notify) // go functions are converted to builtins
+//	if _, err := w.RunFile("hooks.wosh"); err != nil { ... }
+//	res, err := w.Call("on_save", event)
+//
+// Functions and types defined at the top level of a script are globals and
+// stay available to later runs and to Call.
+package wosh
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/rymdhund/wosh/interpret"
+	"github.com/rymdhund/wosh/parser"
+	"github.com/rymdhund/wosh/sandbox"
+)
+
+type Value = interpret.Value
+
+type Options struct {
+	// Don't check type annotations at runtime
+	DisableTypeChecks bool
+
+	// Max number of nested calls, 0 means the default
+	MaxCallDepth int
+
+	// Max number of values on the stack of a call, 0 means the default
+	MaxStackSize int
+
+	// Limits of each run or call, 0 means no limit. Exceeding them stops the
+	// run with an *interpret.LimitError.
+	MaxInstructions int
+	Timeout         time.Duration
+	MaxAllocations  int
+
+	// Restrict what scripts can do outside of the interpreter. Go functions
+	// that access files, commands, the environment or the network should
+	// check it with Sandbox.
+	Sandbox *sandbox.Policy
+
+	// Called with the warnings of the static checks of each script, like
+	// effects that might not be handled. Might be nil.
+	Warn func(w *interpret.Warning)
+
+	// Provide the effects log, read_line, now, random and exit to scripts,
+	// see interpret.VM.HandleDefaultEffects. Log writes to stderr and
+	// read_line reads stdin. Exit makes the run return an
+	// *interpret.ExitError.
+	DefaultEffects bool
+}
+
+type Interpreter struct {
+	vm      *interpret.VM
+	options interpret.CompileOptions
+
+	structs   *structTypes
+	converter *interpret.Converter
+}
+
+func New(opts Options) *Interpreter {
+	options := interpret.DefaultCompileOptions
+	options.TypeChecks = !opts.DisableTypeChecks
+	options.Warn = opts.Warn
+	vm := interpret.NewVm()
+	vm.SetLimits(interpret.Limits{
+		MaxCallDepth:    opts.MaxCallDepth,
+		MaxStackSize:    opts.MaxStackSize,
+		MaxInstructions: opts.MaxInstructions,
+		Timeout:         opts.Timeout,
+		MaxAllocations:  opts.MaxAllocations,
+	})
+	vm.SetSandbox(opts.Sandbox)
+	if opts.DefaultEffects {
+		vm.HandleDefaultEffects(os.Stdin, os.Stderr)
+	}
+	structs := &structTypes{
+		woshTypes: map[reflect.Type]*interpret.Type{},
+		goTypes:   map[*interpret.Type]reflect.Type{},
+		fields:    map[*interpret.Type][]int{},
+	}
+	return &Interpreter{
+		vm:        vm,
+		options:   options,
+		structs:   structs,
+		converter: &interpret.Converter{Structs: structs},
+	}
+}
+
+// Run a program and return the value of its last expression
+func (w *Interpreter) RunString(src string) (Value, error) {
+	return w.RunStringContext(context.Background(), src)
+}
+
+// Run a program, stopping it if ctx is done
+func (w *Interpreter) RunStringContext(ctx context.Context, src string) (Value, error) {
+	return w.run(ctx, "<string>", src)
+}
+
+func (w *Interpreter) RunFile(filename string) (Value, error) {
+	return w.RunFileContext(context.Background(), filename)
+}
+
+func (w *Interpreter) RunFileContext(ctx context.Context, filename string) (Value, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return w.run(ctx, filename, string(content))
+}
+
+func (w *Interpreter) run(ctx context.Context, name string, src string) (Value, error) {
+	p := parser.NewParser(src)
+	block, imports, err := p.Parse()
+	if err != nil {
+		return nil, fmt.Errorf("Parsing error: %s", err)
+	}
+	if len(imports) > 0 {
+		return nil, fmt.Errorf("Imports not implemented")
+	}
+	options := w.options
+	options.Source = interpret.NewSource(name, src)
+	options.HostEffects = w.vm.HostEffects()
+	function, err := interpret.CompileProgram(block, options)
+	if err != nil {
+		return nil, err
+	}
+	return w.vm.InterpretContext(ctx, function)
+}
+
+// Set a global to a go value, converted with FromGo
+func (w *Interpreter) SetGlobal(name string, v interface{}) error {
+	value, err := w.FromGo(v)
+	if err != nil {
+		return err
+	}
+	if builtin, ok := value.(*interpret.BuiltinValue); ok && reflect.ValueOf(v).Kind() == reflect.Func {
+		builtin.Name = name
+	}
+	w.vm.SetGlobal(name, value)
+	return nil
+}
+
+// Handle an effect with a go function, converted like in SetGlobal, when
+// scripts don't handle it. The continuation is resumed with the result.
+func (w *Interpreter) HandleEffect(name string, fn interface{}) error {
+	if reflect.ValueOf(fn).Kind() != reflect.Func {
+		return fmt.Errorf("Handler of effect '%s' is not a function", name)
+	}
+	value, err := w.FromGo(fn)
+	if err != nil {
+		return err
+	}
+	builtin := value.(*interpret.BuiltinValue)
+	builtin.Name = name
+	w.vm.HandleEffect(name, builtin)
+	return nil
+}
+
+// The sandbox policy of the interpreter, nil if scripts may do anything
+func (w *Interpreter) Sandbox() *sandbox.Policy {
+	return w.vm.Sandbox()
+}
+
+func (w *Interpreter) GetGlobal(name string) (Value, bool) {
+	return w.vm.GetGlobal(name)
+}
+
+// Call the global function name with arguments converted with FromGo
+func (w *Interpreter) Call(name string, args ...interface{}) (Value, error) {
+	return w.CallContext(context.Background(), name, args...)
+}
+
+// Call the global function name, stopping the call if ctx is done
+func (w *Interpreter) CallContext(ctx context.Context, name string, args ...interface{}) (Value, error) {
+	fn, ok := w.vm.GetGlobal(name)
+	if !ok {
+		return nil, fmt.Errorf("Not defined: %s", name)
+	}
+	values := make([]Value, len(args))
+	for i, arg := range args {
+		v, err := w.FromGo(arg)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
+	}
+	return w.vm.CallContext(ctx, fn, values...)
+}
+
+// Register a go struct type as a wosh type with the given name. The exported
+// fields become attributes, named by their `wosh` tag or the field name with
+// a lower case first letter. Values of the struct type are then converted to
+// and from values of the wosh type, and scripts can construct them and
+// define methods on them.
+func (w *Interpreter) RegisterType(name string, sample interface{}) error {
+	t := reflect.TypeOf(sample)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return fmt.Errorf("Can only register struct types, got %T", sample)
+	}
+
+	attributes := []string{}
+	fields := []int{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			// unexported
+			continue
+		}
+		attributes = append(attributes, interpret.AttributeName(field))
+		fields = append(fields, i)
+	}
+
+	typ := &interpret.Type{Name: name, Attributes: attributes}
+	w.structs.woshTypes[t] = typ
+	w.structs.goTypes[typ] = t
+	w.structs.fields[typ] = fields
+	w.vm.SetGlobal(name, interpret.NewTypeValue(typ))
+	return nil
+}
+
+// The types registered with RegisterType, by go type and by wosh type
+type structTypes struct {
+	woshTypes map[reflect.Type]*interpret.Type
+	goTypes   map[*interpret.Type]reflect.Type
+	fields    map[*interpret.Type][]int // struct field index of each attribute
+}
+
+func (s *structTypes) WoshType(t reflect.Type) (*interpret.Type, []int, bool) {
+	typ, ok := s.woshTypes[t]
+	return typ, s.fields[typ], ok
+}
+
+func (s *structTypes) GoType(typ *interpret.Type) (reflect.Type, []int, bool) {
+	t, ok := s.goTypes[typ]
+	return t, s.fields[typ], ok
+}
+
+// Convert a go value to a wosh value.
+//
+// Integers, strings and bools become Int, Str and Bool. Slices and arrays
+// become lists and maps with string keys become maps. Structs of registered
+// types become values of that type and other structs become maps. Functions
+// become builtins with their arguments and results converted. Nil becomes ().
+func (w *Interpreter) FromGo(v interface{}) (Value, error) {
+	return w.converter.FromGo(v)
+}
+
+// Convert a wosh value to a go value.
+//
+// Int, Str and Bool become int, string and bool, lists become []interface{},
+// maps become map[string]interface{} and () becomes nil. Values of registered
+// types become their struct type and other custom values become maps of their
+// attributes. Other values, like functions, are returned as they are.
+func (w *Interpreter) ToGo(v Value) (interface{}, error) {
+	return w.converter.ToGo(v)
+}
+
+// Convert a wosh value and store it in the value that target points to
+func (w *Interpreter) ToGoInto(v Value, target interface{}) error {
+	return w.converter.ToGoInto(v, target)
+}
@@ -0,0 +1,356 @@
+package wosh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rymdhund/wosh/interpret"
+)
+
+type Event struct {
+	Name  string
+	Count int
+	Tags  []string `wosh:"labels"`
+	note  string
+}
+
+func TestRunAndCall(t *testing.T) {
+	w := New(Options{})
+	if _, err := w.RunString("fn add(a, b) { a + b }"); err != nil {
+		t.Fatal(err)
+	}
+	res, err := w.Call("add", 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := w.ToGo(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 3 {
+		t.Errorf("expected 3, got %v", v)
+	}
+
+	// Globals are kept between runs
+	res, err = w.RunString("add('a', 'b')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := w.ToGo(res); v != "ab" {
+		t.Errorf("expected \"ab\", got %v", v)
+	}
+
+	if _, err := w.Call("missing"); err == nil {
+		t.Error("expected error calling undefined function")
+	}
+	if _, err := w.Call("add", 1); err == nil {
+		t.Error("expected error calling with too few arguments")
+	}
+	if _, err := w.RunString("add(1"); err == nil {
+		t.Error("expected parse error")
+	}
+	if _, err := w.RunString("add(1, 'a')"); err == nil {
+		t.Error("expected runtime error")
+	}
+}
+
+func TestRunFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wosh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "hooks.wosh")
+	if err := ioutil.WriteFile(filename, []byte("fn on_save(name) { 'saved ' + name }"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := New(Options{})
+	if _, err := w.RunFile(filename); err != nil {
+		t.Fatal(err)
+	}
+	res, err := w.Call("on_save", "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := w.ToGo(res); v != "saved a.txt" {
+		t.Errorf("unexpected result %v", v)
+	}
+
+	if err := ioutil.WriteFile(filename, []byte("x = 1\n1 / 0"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.RunFile(filename)
+	rtErr, ok := err.(*interpret.RuntimeError)
+	if !ok || len(rtErr.Trace) != 1 || rtErr.Trace[0].FileName() != filename {
+		t.Errorf("Expected runtime error in %s, got %v", filename, err)
+	}
+
+	if _, err := w.RunFile(filepath.Join(dir, "missing.wosh")); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
+
+func TestGlobals(t *testing.T) {
+	w := New(Options{})
+	if err := w.SetGlobal("limit", 10); err != nil {
+		t.Fatal(err)
+	}
+	calls := []string{}
+	err := w.SetGlobal("notify", func(msg string, n int) error {
+		if n < 0 {
+			return fmt.Errorf("negative")
+		}
+		calls = append(calls, fmt.Sprintf("%s %d", msg, n))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.RunString("notify('hello', limit)\nanswer = 42\nfn answer() { 42 }"); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(calls, []string{"hello 10"}) {
+		t.Errorf("unexpected calls %v", calls)
+	}
+	if _, ok := w.GetGlobal("answer"); !ok {
+		t.Error("expected answer to be a global")
+	}
+	if _, ok := w.GetGlobal("nothing"); ok {
+		t.Error("expected nothing to not be a global")
+	}
+	if _, err := w.RunString("notify('hello', -1)"); err == nil {
+		t.Error("expected error from go function")
+	}
+	if _, err := w.RunString("notify(1, 2)"); err == nil {
+		t.Error("expected conversion error")
+	}
+	if err := w.SetGlobal("f", 1.5); err == nil {
+		t.Error("expected error converting float")
+	}
+}
+
+func TestConversions(t *testing.T) {
+	w := New(Options{})
+	tests := []struct {
+		in       interface{}
+		expected interface{}
+	}{
+		{nil, nil},
+		{1, 1},
+		{uint8(2), 2},
+		{"a", "a"},
+		{true, true},
+		{[]int{1, 2}, []interface{}{1, 2}},
+		{[2]string{"a", "b"}, []interface{}{"a", "b"}},
+		{map[string]int{"a": 1}, map[string]interface{}{"a": 1}},
+		{map[string]interface{}{"a": []interface{}{"b", nil}}, map[string]interface{}{"a": []interface{}{"b", nil}}},
+		{Event{"save", 2, []string{"x"}, "hidden"}, map[string]interface{}{"name": "save", "count": 2, "labels": []interface{}{"x"}}},
+		{&Event{Name: "ptr"}, map[string]interface{}{"name": "ptr", "count": 0, "labels": []interface{}{}}},
+	}
+	for _, test := range tests {
+		v, err := w.FromGo(test.in)
+		if err != nil {
+			t.Errorf("FromGo(%v): %s", test.in, err)
+			continue
+		}
+		res, err := w.ToGo(v)
+		if err != nil {
+			t.Errorf("ToGo(%s): %s", v, err)
+			continue
+		}
+		if !reflect.DeepEqual(res, test.expected) {
+			t.Errorf("expected %#v, got %#v", test.expected, res)
+		}
+	}
+
+	var counts map[string][]int
+	v, _ := w.FromGo(map[string][]int{"a": {1, 2}})
+	if err := w.ToGoInto(v, &counts); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(counts, map[string][]int{"a": {1, 2}}) {
+		t.Errorf("unexpected %v", counts)
+	}
+
+	var n int
+	if err := w.ToGoInto(interpret.NewString("a"), &n); err == nil {
+		t.Error("expected error converting Str to int")
+	}
+	if _, err := w.FromGo(map[int]int{1: 1}); err == nil {
+		t.Error("expected error converting map with int keys")
+	}
+
+	// Functions are kept as wosh values
+	fn, _ := w.FromGo(func() int { return 1 })
+	res, err := w.ToGo(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != fn {
+		t.Errorf("expected function value, got %v", res)
+	}
+}
+
+func TestRegisterType(t *testing.T) {
+	w := New(Options{})
+	if err := w.RegisterType("Event", Event{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.RegisterType("Int", 1); err == nil {
+		t.Error("expected error registering non struct")
+	}
+
+	_, err := w.RunString(`
+	fn (e: Event) describe() {
+		e.name + ' ' + str(e.count)
+	}
+	fn bump(e: Event) {
+		Event(e.name, e.count + 1, e.labels)
+	}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := w.Call("bump", Event{Name: "save", Count: 1, Tags: []string{"a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e Event
+	if err := w.ToGoInto(res, &e); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(e, Event{Name: "save", Count: 2, Tags: []string{"a"}}) {
+		t.Errorf("unexpected event %+v", e)
+	}
+	if v, _ := w.ToGo(res); !reflect.DeepEqual(v, e) {
+		t.Errorf("expected ToGo to return the struct, got %#v", v)
+	}
+
+	res, err = w.RunString("Event('open', 3, []).describe()")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := w.ToGo(res); v != "open 3" {
+		t.Errorf("unexpected %v", v)
+	}
+
+	// Callbacks into wosh from go functions
+	err = w.SetGlobal("twice", func(f Value) (Value, error) {
+		v, err := w.Call("bump", Event{Name: "x"})
+		if err != nil {
+			return nil, err
+		}
+		return interpret.NewList([]Value{f, v}), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.RunString("twice(1)[1].describe()"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDisableTypeChecks(t *testing.T) {
+	w := New(Options{DisableTypeChecks: true})
+	res, err := w.RunString("fn f(x: Int) { x }\nf('a')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := w.ToGo(res); v != "a" {
+		t.Errorf("unexpected %v", v)
+	}
+	if _, err := New(Options{}).RunString("fn f(x: Int) { x }\nf('a')"); err == nil {
+		t.Error("expected type error")
+	}
+}
+
+func TestLimits(t *testing.T) {
+	prog := "fn f(n) { if n == 0 { 0 } else { 1 + f(n - 1) } }\nf(10)"
+	if _, err := New(Options{MaxCallDepth: 5}).RunString(prog); err == nil {
+		t.Error("expected stack overflow")
+	}
+	res, err := New(Options{}).RunString(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := New(Options{}).ToGo(res); v != 10 {
+		t.Errorf("unexpected %v", v)
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	warnings := []string{}
+	w := New(Options{Warn: func(w *interpret.Warning) {
+		warnings = append(warnings, w.String())
+	}})
+	_, err := w.RunString("fn f() { do log(1) }\ntry { f() } handle { log(x) -> 1 }\nf()")
+	if err == nil {
+		t.Error("expected missing handler error")
+	}
+	expected := "Warning on line 3:1: Effect 'log' performed by 'f' is not handled"
+	if len(warnings) != 1 || warnings[0] != expected {
+		t.Errorf("expected %s, got %v", expected, warnings)
+	}
+}
+
+func TestRunLimits(t *testing.T) {
+	w := New(Options{MaxInstructions: 1000})
+	_, err := w.RunString("fn spin() { for true { 1 } }\nspin()")
+	if _, ok := err.(*interpret.LimitError); !ok {
+		t.Errorf("expected limit error, got %v", err)
+	}
+	// The limits are per run
+	if _, err := w.RunString("1 + 1"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = New(Options{}).RunStringContext(ctx, "for true { 1 }")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := w.CallContext(ctx, "spin"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected canceled, got %v", err)
+	}
+}
+
+func TestHandleEffect(t *testing.T) {
+	w := New(Options{})
+	if err := w.HandleEffect("ask", 1); err == nil {
+		t.Error("expected error for a handler that isn't a function")
+	}
+	err := w.HandleEffect("ask", func(question string) string { return "answer to " + question })
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := w.RunString(`do ask("q")`)
+	if err != nil || res.String() != `"answer to q"` {
+		t.Errorf("expected answer, got %v, %v", res, err)
+	}
+	_, err = w.RunString(`do ask(1)`)
+	if err == nil {
+		t.Error("expected type error")
+	}
+
+	w = New(Options{DefaultEffects: true})
+	res, err = w.RunString("do now() > 0")
+	if err != nil || res.String() != "true" {
+		t.Errorf("expected true, got %v, %v", res, err)
+	}
+	_, err = w.RunString("do exit(2)")
+	if exit, ok := err.(*interpret.ExitError); !ok || exit.Code != 2 {
+		t.Errorf("expected exit error, got %v", err)
+	}
+}